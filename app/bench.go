@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+)
+
+// bench downloads a url at several concurrencies and reports what each took,
+// the scenarios of the lib benchmarks against a real server.
+func bench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	dirPath := flags.String("d", "", "directory to download into, a temporary one when empty")
+	levels := flags.String("c", "1,4,16", "comma separated concurrencies to measure")
+	runs := flags.Int("n", 1, "downloads per concurrency, the averages are reported")
+	maxPerHost := flags.Int("max-per-host", 0, "connections per host across all files, unlimited when 0")
+	hostDelay := flags.Duration("host-delay", 0, "minimum delay between requests to the same host, e.g. 200ms")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: godownload bench [flags] url")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *runs < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var concurrencies []int64
+	for _, level := range strings.Split(*levels, ",") {
+		concurrency, err := strconv.ParseInt(strings.TrimSpace(level), 10, 64)
+		if err != nil || concurrency < 1 {
+			return fmt.Errorf("invalid concurrency %q", level)
+		}
+		concurrencies = append(concurrencies, concurrency)
+	}
+	dir := *dirPath
+	if dir == "" {
+		temp, err := ioutil.TempDir("", "godownload-bench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(temp)
+		dir = temp
+	}
+
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: newClient(*maxPerHost, *hostDelay)}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "concurrency\tsize\ttime\tMiB/s\tallocs\talloc MiB\tsyscalls\tpeak disk MiB\t")
+	for _, concurrency := range concurrencies {
+		total := lib.BenchResult{Concurrency: concurrency}
+		for i := 0; i < *runs; i++ {
+			result, err := downloader.Bench(dir, flags.Arg(0), concurrency)
+			if err != nil {
+				return err
+			}
+			total.Size = result.Size
+			total.Duration += result.Duration
+			total.Allocs += result.Allocs
+			total.AllocBytes += result.AllocBytes
+			total.Syscalls += result.Syscalls
+			if result.PeakDisk > total.PeakDisk {
+				total.PeakDisk = result.PeakDisk
+			}
+		}
+		n := int64(*runs)
+		total.Duration /= time.Duration(n)
+		syscalls := "-"
+		if total.Syscalls >= 0 {
+			syscalls = strconv.FormatInt(total.Syscalls/n, 10)
+		}
+		fmt.Fprintf(table, "%d\t%d\t%v\t%.1f\t%d\t%.1f\t%s\t%.1f\t\n", concurrency, total.Size, total.Duration.Round(time.Millisecond),
+			total.Throughput()/(1<<20), total.Allocs/uint64(n), float64(total.AllocBytes)/float64(n)/(1<<20), syscalls, float64(total.PeakDisk)/(1<<20))
+	}
+	return table.Flush()
+}
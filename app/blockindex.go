@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/amithnair91/godownload/lib"
+)
+
+// blockIndexMake writes the block index of every file next to it, for clients
+// updating an older copy with -delta.
+func blockIndexMake(args []string) error {
+	flags := flag.NewFlagSet("blockindex", flag.ExitOnError)
+	blockSize := flags.Int("b", lib.DefaultBlockSize, "block size in bytes")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: godownload blockindex [flags] file...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	for _, filePath := range flags.Args() {
+		if err := writeBlockIndex(filePath, *blockSize); err != nil {
+			return err
+		}
+		fmt.Println(filePath + lib.DeltaSuffix)
+	}
+	return nil
+}
+
+func writeBlockIndex(filePath string, blockSize int) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	index, err := lib.GenerateBlockIndex(file, blockSize)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(filePath + lib.DeltaSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err = index.WriteTo(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/amithnair91/godownload/lib"
+)
+
+func cachePrune(args []string) error {
+	defaultDir, _ := lib.DefaultCacheDir()
+	flags := flag.NewFlagSet("cache-prune", flag.ExitOnError)
+	cacheDir := flags.String("cache", defaultDir, "cache directory")
+	maxSize := flags.String("max-size", "", "size to shrink the cache to, e.g. 500M or 10G, required")
+	flags.Parse(args)
+	if *maxSize == "" {
+		return fmt.Errorf("cache-prune needs -max-size, use -max-size 0 to empty the cache")
+	}
+
+	size, err := parseSize(*maxSize)
+	if err != nil {
+		return err
+	}
+	cache := lib.Cache{Dir: *cacheDir}
+	removed, freed, err := cache.Prune(size)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed %d files, freed %d bytes\n", removed, freed)
+	return nil
+}
+
+// parseSize reads a byte count with an optional K, M, G or T suffix in
+// powers of 1024.
+func parseSize(size string) (int64, error) {
+	trimmed := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B"), "I")
+	if trimmed == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	if unit := strings.Index("KMGT", trimmed[len(trimmed)-1:]); unit >= 0 {
+		multiplier = 1 << (10 * uint(unit+1))
+		trimmed = trimmed[:len(trimmed)-1]
+	}
+	value, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
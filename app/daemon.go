@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+)
+
+func daemon(args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	listen := flags.String("listen", "tcp:127.0.0.1:6801", "unix:<socket path> or tcp:<host:port> to serve the control API on")
+	dirPath := flags.String("d", "./", "default directory to download into")
+	maxActive := flags.Int("j", 5, "number of jobs downloading at once")
+	concurrency := flags.Int64("c", 4, "default number of concurrent segments per job")
+	cacheDir := flags.String("cache", "", "shared download cache directory, disabled when empty")
+	token := flags.String("rpc-secret", "", "token clients must send to every endpoint, as a bearer token or aria2's token:<secret>, a random one is made when empty")
+	tokenFile := flags.String("token-file", "", "file to write the token to instead of printing it, readable only by you")
+	statePath := flags.String("state", "", "file to keep jobs in across restarts, jobs are lost on exit when empty")
+	keep := flags.Duration("keep", 0, "how long to remember finished jobs, e.g. 168h, forever when 0")
+	maxPerHost := flags.Int("max-per-host", 0, "connections per host across all jobs, unlimited when 0")
+	hostDelay := flags.Duration("host-delay", 0, "minimum delay between requests to the same host, e.g. 200ms")
+	limits := flags.String("limit", "", "bandwidth by time of day, e.g. \"mon-fri 09:00-18:00=1M;18:00-09:00=0\", unlimited when empty")
+	flags.Parse(args)
+
+	network, address, err := parseListenAddress(*listen)
+	if err != nil {
+		return err
+	}
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: newClient(*maxPerHost, *hostDelay)}
+	if *cacheDir != "" {
+		downloader.Cache = &lib.Cache{Dir: *cacheDir}
+	}
+	bandwidth, err := parseBandwidthRules(*limits)
+	if err != nil {
+		return err
+	}
+	options := lib.QueueOptions{MaxActive: *maxActive, Dir: *dirPath, Concurrency: *concurrency, Retention: *keep, Bandwidth: bandwidth}
+	if *statePath != "" {
+		options.Store = &lib.FileJobStore{Path: *statePath}
+	}
+	queue, err := lib.NewJobQueue(downloader, options)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		queue.Close()
+		if network == "unix" {
+			os.Remove(address)
+		}
+		os.Exit(0)
+	}()
+
+	if *token == "" {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return err
+		}
+		*token = hex.EncodeToString(random)
+	}
+	if *tokenFile != "" {
+		if err := ioutil.WriteFile(*tokenFile, []byte(*token+"\n"), 0600); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("token: %s\n", *token)
+	}
+	fmt.Printf("godownload daemon listening on %s\n", *listen)
+	d := &lib.Daemon{Queue: queue, Token: *token}
+	return d.ListenAndServe(network, address)
+}
+
+func parseListenAddress(listen string) (network string, address string, err error) {
+	tokens := strings.SplitN(listen, ":", 2)
+	if len(tokens) != 2 || (tokens[0] != "unix" && tokens[0] != "tcp") || tokens[1] == "" {
+		return "", "", fmt.Errorf("invalid listen address %q, expected unix:<path> or tcp:<host:port>", listen)
+	}
+	return tokens[0], tokens[1], nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseBandwidthRules reads ";" separated "[days ]HH:MM-HH:MM=<size>" rules,
+// days being weekdays like "mon-fri" or "sat,sun".
+func parseBandwidthRules(value string) ([]lib.BandwidthRule, error) {
+	var rules []lib.BandwidthRule
+	for _, spec := range strings.Split(value, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		var rule lib.BandwidthRule
+		fields := strings.Fields(spec)
+		if len(fields) == 2 {
+			days, err := parseWeekdays(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			rule.Days = days
+			fields = fields[1:]
+		}
+		window := strings.SplitN(fields[0], "=", 2)
+		clocks := strings.SplitN(window[0], "-", 2)
+		if len(fields) != 1 || len(window) != 2 || len(clocks) != 2 {
+			return nil, fmt.Errorf("invalid bandwidth rule %q, expected [days ]HH:MM-HH:MM=<size>", spec)
+		}
+		limit, err := parseSize(window[1])
+		if err != nil {
+			return nil, err
+		}
+		rule.From, rule.To, rule.Limit = clocks[0], clocks[1], limit
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseWeekdays(value string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, item := range strings.Split(strings.ToLower(value), ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		from, ok := weekdays[bounds[0]]
+		to := from
+		if len(bounds) == 2 {
+			var found bool
+			to, found = weekdays[bounds[1]]
+			ok = ok && found
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid days %q", value)
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			days = append(days, day)
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
@@ -1,19 +1,248 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/amithnair91/godownload/lib"
 )
 
+var commands = map[string]func(args []string) error{
+	"bench":       bench,
+	"blockindex":  blockIndexMake,
+	"cache-prune": cachePrune,
+	"daemon":      daemon,
+	"serve":       serve,
+	"sync":        syncManifest,
+}
+
 func main() {
+	run := download
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if command, ok := commands[args[0]]; ok {
+			run, args = command, args[1:]
+		}
+	}
+	if err := run(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// newClient returns the protocol client, made polite towards hosts when a
+// limit is given. Requests a host turned down with 429 or 503 are retried
+// once its back-off is over.
+func newClient(maxPerHost int, hostDelay time.Duration) lib.Client {
+	client := lib.NewProtocolClient()
+	if maxPerHost == 0 && hostDelay == 0 {
+		return client
+	}
+	return &lib.RetryClient{Client: &lib.HostLimitClient{Client: client, MaxConnections: maxPerHost, Delay: hostDelay}}
+}
+
+func download(args []string) error {
+	flags := flag.NewFlagSet("godownload", flag.ExitOnError)
+	dirPath := flags.String("d", "./", "directory to download into")
+	concurrency := flags.Int64("c", 7, "number of concurrent segments per file")
+	cacheDir := flags.String("cache", "", "shared download cache directory, disabled when empty")
+	cacheSize := flags.String("cache-size", "", "evict least recently used cache entries beyond this size, e.g. 10G")
+	maxPerHost := flags.Int("max-per-host", 0, "connections per host across all files, unlimited when 0")
+	hostDelay := flags.Duration("host-delay", 0, "minimum delay between requests to the same host, e.g. 200ms")
+	output := flags.String("O", "", "write the single url to this file instead of -d, - for stdout")
+	extractDir := flags.String("x", "", "extract zip and tar archives into this directory instead of saving them")
+	stripComponents := flags.Int("strip-components", 0, "leading path elements to remove from extracted entries")
+	include := flags.String("include", "", "comma separated globs of the entries to extract, all when empty")
+	exclude := flags.String("exclude", "", "comma separated globs of entries not to extract")
+	decompress := flags.Bool("decompress", false, "save .gz, .bz2, .xz and .zst files decompressed")
+	delta := flags.Bool("delta", false, "update the existing file, fetching only the blocks that changed according to the .blockindex file next to the url")
+	deltaFrom := flags.String("delta-from", "", "older version to take unchanged blocks from with -delta, the existing file by default")
+	verify := flags.String("verify", "", "<algorithm>:<hex> digest downloaded files must have, \"server\" for the one the server advertises")
+	chmod := flags.String("chmod", "", "octal permissions to give downloaded files, e.g. 0755")
+	move := flags.String("move", "", "template to move downloaded files to, e.g. \"{{.Host}}/{{.Date}}/\"")
+	command := flags.String("exec", "", "shell command to run on every downloaded file, which is described in GODOWNLOAD_* variables")
+	keyring := flags.String("keyring", "", "PGP keyring file, downloaded files need a valid .asc or .sig signature made with one of its keys")
+	minisignKey := flags.String("minisign-key", "", "minisign public key or key file, downloaded files need a valid .minisig signature made with it")
+	signatureFile := flags.String("signature", "", "detached signature of the single url instead of the one next to it")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: godownload [flags] url...")
+		fmt.Fprintln(os.Stderr, "       godownload bench [flags] url")
+		fmt.Fprintln(os.Stderr, "       godownload blockindex [flags] file...")
+		fmt.Fprintln(os.Stderr, "       godownload cache-prune [flags]")
+		fmt.Fprintln(os.Stderr, "       godownload daemon [flags]")
+		fmt.Fprintln(os.Stderr, "       godownload serve [flags] dir")
+		fmt.Fprintln(os.Stderr, "       godownload sync [flags] manifest.yaml")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
 	file := lib.File{}
-	client := lib.HTTPClient{}
-	client.NewHttpClient()
-	downloader := lib.Downloader{FileUtils: &file, Client: &client}
-	println("Start Download of File")
+	downloader := lib.Downloader{FileUtils: &file, Client: newClient(*maxPerHost, *hostDelay)}
+	hooks, err := newHooks(*verify, *chmod, *move, *command)
+	if err != nil {
+		return err
+	}
+	if len(hooks) > 0 && (*extractDir != "" || *decompress || *delta || *deltaFrom != "" || *output != "") {
+		return fmt.Errorf("-verify, -chmod, -move and -exec can't be combined with -x, -decompress, -delta or -O")
+	}
+	downloader.Hooks = hooks
+	if downloader.Verifier, err = newVerifier(*keyring, *minisignKey); err != nil {
+		return err
+	}
+	if downloader.Verifier != nil && *output != "" {
+		return fmt.Errorf("-keyring and -minisign-key can't be combined with -O")
+	}
+	var signature []byte
+	if *signatureFile != "" {
+		if *extractDir != "" || *decompress || *delta || *deltaFrom != "" || *output != "" {
+			return fmt.Errorf("-signature can't be combined with -x, -decompress, -delta or -O")
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("-signature takes a single url, got %d", flags.NArg())
+		}
+		if signature, err = ioutil.ReadFile(*signatureFile); err != nil {
+			return err
+		}
+	}
+	if *output != "" {
+		if flags.NArg() != 1 {
+			return fmt.Errorf("-O takes a single url, got %d", flags.NArg())
+		}
+		if *cacheDir != "" {
+			return fmt.Errorf("-O and -cache can't be combined")
+		}
+		return stream(&downloader, flags.Arg(0), *output, *concurrency)
+	}
+	if *cacheDir != "" {
+		maxSize, err := parseSize(*cacheSize)
+		if err != nil {
+			return err
+		}
+		downloader.Cache = &lib.Cache{Dir: *cacheDir, MaxSize: maxSize}
+	}
 
-	err := downloader.DownloadFileConcurrent("./", "http://dynamodb-local.s3-website-us-west-2.amazonaws.com/dynamodb_local_2016-05-17.zip", 7)
+	for _, url := range flags.Args() {
+		println("Start Download of File", url)
+		switch {
+		case *extractDir != "":
+			options := lib.ExtractOptions{StripComponents: *stripComponents, Include: splitList(*include), Exclude: splitList(*exclude)}
+			err = downloader.DownloadAndExtract(*extractDir, url, *concurrency, options)
+		case *decompress:
+			err = downloader.DownloadDecompressed(*dirPath, url, *concurrency)
+		case *delta || *deltaFrom != "":
+			var result *lib.DeltaResult
+			if result, err = downloader.DownloadDelta(*dirPath, url, *deltaFrom, *concurrency); err == nil {
+				println("  reused", result.Reused, "bytes, fetched", result.Fetched, "bytes in", result.Ranges, "ranges")
+			}
+		default:
+			var result *lib.DownloadResult
+			if signature != nil {
+				result, err = downloader.DownloadFileWithSignature(*dirPath, url, signature, *concurrency)
+			} else {
+				result, err = downloader.DownloadFileWithResult(*dirPath, url, *concurrency)
+			}
+			if result != nil {
+				if result.Signer != nil {
+					println("  signed by", result.Signer.Identity, result.Signer.KeyID)
+				}
+				for _, hook := range result.Hooks {
+					println(" ", hook.Name+":", hook.Output, hook.Error)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		println("Finished Downloading File", url)
+	}
+	return nil
+}
+
+// newHooks builds the hooks of the download flags in the order they run.
+func newHooks(verify string, chmod string, move string, command string) ([]lib.Hook, error) {
+	var hooks []lib.Hook
+	if verify == "server" {
+		hooks = append(hooks, &lib.VerifyHook{})
+	} else if verify != "" {
+		hooks = append(hooks, &lib.VerifyHook{Digest: verify})
+	}
+	if chmod != "" {
+		mode, err := strconv.ParseUint(chmod, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -chmod %q", chmod)
+		}
+		hooks = append(hooks, &lib.ChmodHook{Mode: os.FileMode(mode)})
+	}
+	if move != "" {
+		hooks = append(hooks, &lib.MoveHook{Template: move})
+	}
+	if command != "" {
+		shell := []string{"sh", "-c", command}
+		if runtime.GOOS == "windows" {
+			shell = []string{"cmd", "/C", command}
+		}
+		hooks = append(hooks, &lib.CommandHook{Command: shell})
+	}
+	return hooks, nil
+}
+
+// newVerifier reads the key of the -keyring or -minisign-key flag, nil
+// when neither is given.
+func newVerifier(keyring string, minisignKey string) (lib.SignatureVerifier, error) {
+	switch {
+	case keyring != "" && minisignKey != "":
+		return nil, fmt.Errorf("-keyring and -minisign-key can't be combined")
+	case keyring != "":
+		file, err := os.Open(keyring)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return lib.NewPGPVerifier(file)
+	case minisignKey != "":
+		text := minisignKey
+		if data, err := ioutil.ReadFile(minisignKey); err == nil {
+			text = string(data)
+		}
+		key, err := lib.ParseMinisignKey(text)
+		if err != nil {
+			return nil, err
+		}
+		return &lib.MinisignVerifier{Keys: []*lib.MinisignKey{key}}, nil
+	}
+	return nil, nil
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
 
-	println(fmt.Sprintf("%v", err))
-	println("Finished Downloading File")
+// stream writes url to outputPath, or to stdout for "-", without any part
+// files.
+func stream(downloader *lib.Downloader, url string, outputPath string, concurrency int64) error {
+	if outputPath == "-" {
+		return downloader.DownloadToWriter(os.Stdout, url, concurrency, lib.StreamOptions{})
+	}
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	if err = downloader.DownloadToWriter(file, url, concurrency, lib.StreamOptions{}); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
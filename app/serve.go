@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/amithnair91/godownload/lib"
+)
+
+// serve shares a directory over http, with ranges and digests godownload
+// clients make use of.
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	rate := flags.String("rate", "", "limit every response to this many bytes per second, e.g. 1M, unlimited when empty")
+	errorRate := flags.Float64("error-rate", 0, "share of requests answered with 503, for testing clients")
+	resetRate := flags.Float64("reset-rate", 0, "share of responses cut off half way, for testing clients")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: godownload serve [flags] dir")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	limit, err := parseSize(*rate)
+	if err != nil {
+		return err
+	}
+	server := &lib.FileServer{FS: lib.OSFS{}, Root: flags.Arg(0), Options: lib.ServeOptions{Rate: limit, ErrorRate: *errorRate, ResetRate: *resetRate}}
+	fmt.Printf("serving %s on %s\n", flags.Arg(0), *addr)
+	return http.ListenAndServe(*addr, server)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/amithnair91/godownload/lib"
+)
+
+// syncManifest makes the directory of a manifest match it and writes the
+// lockfile next to the manifest.
+func syncManifest(args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	lockPath := flags.String("lock", "", "lockfile to read and write, the manifest name with a .lock extension by default")
+	parallel := flags.Int("p", 4, "number of artifacts downloaded at once")
+	concurrency := flags.Int64("c", 4, "number of concurrent segments per artifact")
+	prune := flags.Bool("prune", false, "remove files of the directory that are not in the manifest, which needs its own dir")
+	cacheDir := flags.String("cache", "", "shared download cache directory, disabled when empty")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: godownload sync [flags] manifest.yaml")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	manifestPath := flags.Arg(0)
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return err
+	}
+	manifest, err := lib.ParseManifest(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if *lockPath == "" {
+		*lockPath = strings.TrimSuffix(manifestPath, filepath.Ext(manifestPath)) + ".lock"
+	}
+	dirPath := filepath.Join(filepath.Dir(manifestPath), manifest.Dir)
+	if *prune {
+		// the directory of the manifest tends to hold more, like a .git
+		rel, err := filepath.Rel(filepath.Dir(manifestPath), dirPath)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+			return fmt.Errorf("-prune needs a dir in the manifest below the one it is in")
+		}
+	}
+
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}
+	if *cacheDir != "" {
+		downloader.Cache = &lib.Cache{Dir: *cacheDir}
+	}
+	options := lib.ManifestSyncOptions{Parallel: *parallel, Concurrency: *concurrency, Lockfile: *lockPath, Prune: *prune, Keep: []string{manifestPath}}
+	result, syncErr := downloader.SyncManifest(manifest, dirPath, options)
+	if result != nil {
+		var paths []string
+		for artifactPath := range result.Files {
+			paths = append(paths, artifactPath)
+		}
+		sort.Strings(paths)
+		for _, artifactPath := range paths {
+			fmt.Printf("%-9s %s\n", result.Files[artifactPath], artifactPath)
+		}
+		for artifactPath, err := range result.Failed {
+			fmt.Printf("%-9s %s: %v\n", "failed", artifactPath, err)
+		}
+		for _, artifactPath := range result.Removed {
+			fmt.Printf("%-9s %s\n", "removed", artifactPath)
+		}
+	}
+	return syncErr
+}
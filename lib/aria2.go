@@ -0,0 +1,260 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// aria2Statuses maps job statuses onto the ones aria2 reports, paused jobs
+// count as waiting in its global stats.
+var aria2Statuses = map[JobStatus]string{
+	JobQueued:   "waiting",
+	JobActive:   "active",
+	JobPaused:   "paused",
+	JobComplete: "complete",
+	JobError:    "error",
+	JobRemoved:  "removed",
+}
+
+// aria2Methods implements the part of the aria2 JSON-RPC interface that web
+// frontends need to add, watch and control downloads. Every call has to
+// start with "token:<Token>" like with aria2's --rpc-secret.
+func (d *Daemon) aria2Methods() map[string]rpcMethod {
+	withGID := func(call func(id string) (Job, error)) rpcMethod {
+		return d.aria2Call(func(params []json.RawMessage) (interface{}, error) {
+			var gid string
+			if err := aria2Param(params, 0, &gid); err != nil {
+				return nil, err
+			}
+			job, err := call(gid)
+			if err != nil {
+				return nil, err
+			}
+			return job.ID, nil
+		})
+	}
+	tellList := func(statuses ...JobStatus) rpcMethod {
+		return d.aria2Call(func(params []json.RawMessage) (interface{}, error) {
+			offset, num, keys := 0, -1, []string(nil)
+			if len(statuses) == 1 && statuses[0] == JobActive {
+				aria2Param(params, 0, &keys)
+			} else {
+				if err := aria2Param(params, 0, &offset); err != nil {
+					return nil, err
+				}
+				if err := aria2Param(params, 1, &num); err != nil {
+					return nil, err
+				}
+				aria2Param(params, 2, &keys)
+			}
+
+			var matched []map[string]interface{}
+			for _, job := range d.Queue.List() {
+				for _, status := range statuses {
+					if job.Status == status {
+						matched = append(matched, aria2JobStatus(job, keys))
+					}
+				}
+			}
+			if offset < 0 || offset > len(matched) {
+				offset = len(matched)
+			}
+			matched = matched[offset:]
+			if num >= 0 && num < len(matched) {
+				matched = matched[:num]
+			}
+			if matched == nil {
+				matched = []map[string]interface{}{}
+			}
+			return matched, nil
+		})
+	}
+
+	return map[string]rpcMethod{
+		"aria2.addUri": d.aria2Call(func(params []json.RawMessage) (interface{}, error) {
+			var uris []string
+			if err := aria2Param(params, 0, &uris); err != nil {
+				return nil, err
+			}
+			if len(uris) == 0 {
+				return nil, invalidParams(errors.New("no uri given"))
+			}
+			options, err := aria2Options(params, 1)
+			if err != nil {
+				return nil, err
+			}
+			job, err := d.Queue.Add(uris[0], options)
+			if err != nil {
+				return nil, err
+			}
+			return job.ID, nil
+		}),
+		"aria2.tellStatus": d.aria2Call(func(params []json.RawMessage) (interface{}, error) {
+			var gid string
+			var keys []string
+			if err := aria2Param(params, 0, &gid); err != nil {
+				return nil, err
+			}
+			aria2Param(params, 1, &keys)
+			job, err := d.Queue.Status(gid)
+			if err != nil {
+				return nil, err
+			}
+			return aria2JobStatus(job, keys), nil
+		}),
+		"aria2.tellActive":  tellList(JobActive),
+		"aria2.tellWaiting": tellList(JobQueued, JobPaused),
+		"aria2.tellStopped": tellList(JobComplete, JobError, JobRemoved),
+		"aria2.pause":       withGID(d.Queue.Pause),
+		"aria2.unpause":     withGID(d.Queue.Resume),
+		"aria2.remove":      withGID(d.Queue.Cancel),
+		"aria2.getGlobalStat": d.aria2Call(func(params []json.RawMessage) (interface{}, error) {
+			var speed int64
+			counts := map[string]int{}
+			for _, job := range d.Queue.List() {
+				speed += job.Speed
+				switch job.Status {
+				case JobActive:
+					counts["numActive"]++
+				case JobQueued, JobPaused:
+					counts["numWaiting"]++
+				default:
+					counts["numStopped"]++
+				}
+			}
+			return map[string]string{
+				"downloadSpeed":   strconv.FormatInt(speed, 10),
+				"uploadSpeed":     "0",
+				"numActive":       strconv.Itoa(counts["numActive"]),
+				"numWaiting":      strconv.Itoa(counts["numWaiting"]),
+				"numStopped":      strconv.Itoa(counts["numStopped"]),
+				"numStoppedTotal": strconv.Itoa(counts["numStopped"]),
+			}, nil
+		}),
+		"aria2.changeOption": d.aria2Call(func(params []json.RawMessage) (interface{}, error) {
+			var gid string
+			if err := aria2Param(params, 0, &gid); err != nil {
+				return nil, err
+			}
+			options, err := aria2Options(params, 1)
+			if err != nil {
+				return nil, err
+			}
+			if _, err = d.Queue.SetJobOptions(gid, options); err != nil {
+				return nil, err
+			}
+			return "OK", nil
+		}),
+	}
+}
+
+// aria2Call checks and strips the secret token before calling method with
+// the positional params.
+func (d *Daemon) aria2Call(method func(params []json.RawMessage) (interface{}, error)) rpcMethod {
+	return func(raw json.RawMessage) (interface{}, error) {
+		var params []json.RawMessage
+		if len(raw) > 0 && string(raw) != "null" {
+			if err := json.Unmarshal(raw, &params); err != nil {
+				return nil, invalidParams(err)
+			}
+		}
+		var token string
+		if len(params) > 0 && json.Unmarshal(params[0], &token) == nil && strings.HasPrefix(token, "token:") {
+			params = params[1:]
+		} else {
+			token = ""
+		}
+		if d.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte("token:"+d.Token)) != 1 {
+			return nil, errors.New("Unauthorized")
+		}
+		return method(params)
+	}
+}
+
+func aria2Param(params []json.RawMessage, index int, value interface{}) error {
+	if index >= len(params) {
+		return invalidParams(fmt.Errorf("missing parameter %d", index+1))
+	}
+	if err := json.Unmarshal(params[index], value); err != nil {
+		return invalidParams(err)
+	}
+	return nil
+}
+
+// aria2Options reads the aria2 options godownload supports, "dir" and the
+// number of connections given as "split" or "max-connection-per-server".
+func aria2Options(params []json.RawMessage, index int) (JobOptions, error) {
+	var options JobOptions
+	if index >= len(params) {
+		return options, nil
+	}
+	var values map[string]string
+	if err := json.Unmarshal(params[index], &values); err != nil {
+		return options, invalidParams(err)
+	}
+	options.Dir = values["dir"]
+	for _, name := range []string{"max-connection-per-server", "split"} {
+		if value, ok := values[name]; ok {
+			concurrency, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || concurrency < 1 {
+				return options, invalidParams(fmt.Errorf("invalid %s %q", name, value))
+			}
+			options.Concurrency = concurrency
+		}
+	}
+	return options, nil
+}
+
+// aria2JobStatus renders a job the way aria2.tellStatus does, numbers as
+// strings, limited to keys when any are given.
+func aria2JobStatus(job Job, keys []string) map[string]interface{} {
+	fileName := job.FileName
+	if u, err := url.Parse(job.URL); err == nil && fileName == "" {
+		fileName = path.Base(u.Path)
+	}
+	total := strconv.FormatInt(job.TotalBytes, 10)
+	done := strconv.FormatInt(job.DoneBytes, 10)
+	status := map[string]interface{}{
+		"gid":             job.ID,
+		"status":          aria2Statuses[job.Status],
+		"totalLength":     total,
+		"completedLength": done,
+		"uploadLength":    "0",
+		"downloadSpeed":   strconv.FormatInt(job.Speed, 10),
+		"uploadSpeed":     "0",
+		"connections":     strconv.Itoa(job.Connections),
+		"numPieces":       strconv.FormatInt(job.Concurrency, 10),
+		"dir":             job.Dir,
+		"files": []map[string]interface{}{{
+			"index":           "1",
+			"path":            filepath.Join(job.Dir, fileName),
+			"length":          total,
+			"completedLength": done,
+			"selected":        "true",
+			"uris":            []map[string]string{{"uri": job.URL, "status": "used"}},
+		}},
+	}
+	if job.Status == JobError {
+		status["errorCode"] = "1"
+		status["errorMessage"] = job.Error
+	} else {
+		status["errorCode"] = "0"
+	}
+	if len(keys) == 0 {
+		return status
+	}
+	filtered := map[string]interface{}{}
+	for _, key := range keys {
+		if value, ok := status[key]; ok {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
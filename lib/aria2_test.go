@@ -0,0 +1,97 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDaemonServesAria2RPC(t *testing.T) {
+	files := newGatedTestServer(map[string][]byte{"/iso/disk.img": testContent(16 * 1024), "/iso/small.txt": []byte("hello")}, "/iso/disk.img")
+	defer files.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	queue, err := lib.NewJobQueue(lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}, lib.QueueOptions{Dir: dir, MaxActive: 1})
+	assert.NoError(t, err)
+	defer queue.Close()
+	server := httptest.NewServer(&lib.Daemon{Queue: queue, Token: "s3cret"})
+	defer server.Close()
+	endpoint := server.URL + "/jsonrpc"
+
+	response := callRPC(t, http.DefaultClient, endpoint, "aria2.addUri", []interface{}{[]string{files.URL + "/iso/disk.img"}})
+	assert.Equal(t, "Unauthorized", response.Error.Message)
+	response = callRPC(t, http.DefaultClient, endpoint, "aria2.addUri", []interface{}{"token:wrong", []string{files.URL + "/iso/disk.img"}})
+	assert.Equal(t, "Unauthorized", response.Error.Message)
+	open := httptest.NewServer(&lib.Daemon{Queue: queue})
+	defer open.Close()
+	response = callRPC(t, http.DefaultClient, open.URL+"/jsonrpc", "aria2.addUri", []interface{}{"token:", []string{files.URL + "/iso/disk.img"}})
+	assert.Equal(t, "Unauthorized", response.Error.Message)
+	assert.Empty(t, queue.List())
+
+	response = callRPC(t, http.DefaultClient, endpoint, "aria2.addUri", []interface{}{"token:s3cret", []string{files.URL + "/iso/disk.img"}, map[string]string{"split": "2"}})
+	assert.Nil(t, response.Error)
+	var gid string
+	assert.NoError(t, json.Unmarshal(response.Result, &gid))
+	assert.Regexp(t, "^[0-9a-f]{16}$", gid)
+	response = callRPC(t, http.DefaultClient, endpoint, "aria2.addUri", []interface{}{"token:s3cret", []string{files.URL + "/iso/small.txt"}})
+	var waitingGID string
+	assert.NoError(t, json.Unmarshal(response.Result, &waitingGID))
+
+	waitFor(t, func() bool {
+		job, _ := queue.Status(gid)
+		return job.DoneBytes >= 1024
+	})
+	response = callRPC(t, http.DefaultClient, endpoint, "aria2.tellActive", []interface{}{"token:s3cret", []string{"gid", "status", "totalLength", "files"}})
+	var active []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(response.Result, &active))
+	assert.Len(t, active, 1)
+	assert.Equal(t, gid, active[0]["gid"])
+	assert.Equal(t, "active", active[0]["status"])
+	assert.Equal(t, "16384", active[0]["totalLength"])
+	assert.Equal(t, filepath.Join(dir, "disk.img"), active[0]["files"].([]interface{})[0].(map[string]interface{})["path"])
+	assert.Len(t, active[0], 4)
+
+	response = callRPC(t, http.DefaultClient, endpoint, "aria2.changeOption", []interface{}{"token:s3cret", waitingGID, map[string]string{"max-connection-per-server": "3"}})
+	assert.Equal(t, `"OK"`, string(response.Result))
+	response = callRPC(t, http.DefaultClient, endpoint, "aria2.tellWaiting", []interface{}{"token:s3cret", 0, 10, []string{"gid", "numPieces"}})
+	var waiting []map[string]string
+	assert.NoError(t, json.Unmarshal(response.Result, &waiting))
+	assert.Equal(t, []map[string]string{{"gid": waitingGID, "numPieces": "3"}}, waiting)
+
+	response = callRPC(t, http.DefaultClient, endpoint, "aria2.getGlobalStat", []interface{}{"token:s3cret"})
+	var stat map[string]string
+	assert.NoError(t, json.Unmarshal(response.Result, &stat))
+	assert.Equal(t, "1", stat["numActive"])
+	assert.Equal(t, "1", stat["numWaiting"])
+	assert.Equal(t, "0", stat["numStopped"])
+
+	response = callRPC(t, http.DefaultClient, endpoint, "aria2.pause", []interface{}{"token:s3cret", gid})
+	assert.Equal(t, `"`+gid+`"`, string(response.Result))
+	waitFor(t, func() bool { return jobStatus(queue, waitingGID) == lib.JobComplete })
+	response = callRPC(t, http.DefaultClient, endpoint, "aria2.tellStatus", []interface{}{"token:s3cret", gid, []string{"status"}})
+	assert.JSONEq(t, `{"status":"paused"}`, string(response.Result))
+
+	files.open("/iso/disk.img")
+	response = callRPC(t, http.DefaultClient, endpoint, "aria2.unpause", []interface{}{"token:s3cret", gid})
+	assert.Nil(t, response.Error)
+	waitFor(t, func() bool { return jobStatus(queue, gid) == lib.JobComplete })
+	response = callRPC(t, http.DefaultClient, endpoint, "aria2.tellStatus", []interface{}{"token:s3cret", gid})
+	var status map[string]interface{}
+	assert.NoError(t, json.Unmarshal(response.Result, &status))
+	assert.Equal(t, "complete", status["status"])
+	assert.Equal(t, "16384", status["completedLength"])
+	assert.Equal(t, "0", status["errorCode"])
+
+	response = callRPC(t, http.DefaultClient, endpoint, "aria2.remove", []interface{}{"token:s3cret", gid})
+	assert.Equal(t, 1, response.Error.Code)
+	response = callRPC(t, http.DefaultClient, endpoint, "aria2.tellStopped", []interface{}{"token:s3cret", 0, 1, []string{"gid"}})
+	assert.Equal(t, `[{"gid":"`+gid+`"}]`, string(response.Result))
+}
@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BandwidthRule limits the combined speed of a JobQueue between two clock
+// times, "15:04" in local time, optionally only on some days. A window whose
+// To is before From runs past midnight, one where they are equal all day.
+type BandwidthRule struct {
+	Days []time.Weekday `json:"days,omitempty"`
+	From string         `json:"from"`
+	To   string         `json:"to"`
+	// Limit in bytes per second, zero means unlimited.
+	Limit int64 `json:"limit"`
+}
+
+func (r BandwidthRule) validate() error {
+	for _, clock := range []string{r.From, r.To} {
+		if _, err := time.Parse("15:04", clock); err != nil {
+			return fmt.Errorf("invalid time %q, expected HH:MM", clock)
+		}
+	}
+	if r.Limit < 0 {
+		return fmt.Errorf("invalid limit %d", r.Limit)
+	}
+	return nil
+}
+
+// matches reports whether t falls in the window. The day of a window that
+// runs past midnight is the day it starts on.
+func (r BandwidthRule) matches(t time.Time) bool {
+	from, errFrom := time.Parse("15:04", r.From)
+	to, errTo := time.Parse("15:04", r.To)
+	if errFrom != nil || errTo != nil {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	start := from.Hour()*60 + from.Minute()
+	end := to.Hour()*60 + to.Minute()
+
+	day := t.Weekday()
+	switch {
+	case start == end:
+	case start < end:
+		if minute < start || minute >= end {
+			return false
+		}
+	case minute >= start:
+	case minute < end:
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+	if len(r.Days) == 0 {
+		return true
+	}
+	for _, ruleDay := range r.Days {
+		if ruleDay == day {
+			return true
+		}
+	}
+	return false
+}
+
+// bandwidthLimit is the limit of the first rule matching t, zero when none
+// does.
+func bandwidthLimit(rules []BandwidthRule, t time.Time) int64 {
+	for _, rule := range rules {
+		if rule.matches(t) {
+			return rule.Limit
+		}
+	}
+	return 0
+}
+
+// rateLimiter spreads reads of all jobs over time so that together they
+// stay under a limit.
+type rateLimiter struct {
+	mutex sync.Mutex
+	limit int64
+	next  time.Time
+}
+
+func (l *rateLimiter) setLimit(limit int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limit = limit
+}
+
+// chunk is the most a single read should ask for so waits stay short.
+func (l *rateLimiter) chunk(size int) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.limit > 0 && int64(size) > l.limit/10+1 {
+		return int(l.limit/10 + 1)
+	}
+	return size
+}
+
+// wait blocks until n more bytes fit under the limit or done is closed.
+func (l *rateLimiter) wait(n int, done <-chan struct{}) {
+	l.mutex.Lock()
+	if l.limit <= 0 {
+		l.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.limit))
+	delay := l.next.Sub(now)
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-done:
+	}
+}
@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// BenchResult measures a download made by Bench. Syscalls counts the read
+// and write system calls of the whole process, -1 where the platform
+// doesn't tell. PeakDisk is the most bytes the download had on disk at once,
+// parts and file together.
+type BenchResult struct {
+	Concurrency int64
+	Size        int64
+	Duration    time.Duration
+	Allocs      uint64
+	AllocBytes  uint64
+	Syscalls    int64
+	PeakDisk    int64
+}
+
+// Throughput is the speed of the download in bytes per second.
+func (r *BenchResult) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Size) / r.Duration.Seconds()
+}
+
+// Bench downloads url into dirPath with DownloadFileConcurrent, measures it
+// and removes the file again, or the parts and segments when it fails. The
+// Cache, Hooks and Verifier are left out, so only the download itself is
+// measured.
+func (d *Downloader) Bench(dirPath string, url string, concurrency int64) (*BenchResult, error) {
+	usage := &diskUsageFS{FS: d.fs(), sizes: map[string]int64{}}
+	downloader := Downloader{Client: d.Client, FileUtils: &File{FS: usage}}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	syscalls := processSyscalls()
+	start := time.Now()
+	result, err := downloader.DownloadFileWithResult(dirPath, url, concurrency)
+	duration := time.Since(start)
+	if syscalls >= 0 {
+		syscalls = processSyscalls() - syscalls
+	}
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		usage.removeAll()
+		return nil, err
+	}
+
+	info, err := usage.Stat(result.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err = usage.Remove(result.Path); err != nil {
+		return nil, err
+	}
+	return &BenchResult{
+		Concurrency: concurrency,
+		Size:        info.Size(),
+		Duration:    duration,
+		Allocs:      after.Mallocs - before.Mallocs,
+		AllocBytes:  after.TotalAlloc - before.TotalAlloc,
+		Syscalls:    syscalls,
+		PeakDisk:    usage.peakUsage(),
+	}, nil
+}
+
+// diskUsageFS keeps track of the size of the files written through it and
+// of the most they took together.
+type diskUsageFS struct {
+	FS
+	mutex sync.Mutex
+	sizes map[string]int64
+	total int64
+	peak  int64
+}
+
+func usageKey(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
+// resize records the size of name, a negative size removes it.
+func (fs *diskUsageFS) resize(name string, size int64) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.resizeLocked(usageKey(name), size)
+}
+
+func (fs *diskUsageFS) resizeLocked(key string, size int64) {
+	fs.total -= fs.sizes[key]
+	delete(fs.sizes, key)
+	if size >= 0 {
+		fs.sizes[key] = size
+		fs.total += size
+	}
+	if fs.total > fs.peak {
+		fs.peak = fs.total
+	}
+}
+
+// grow records that name reaches at least end bytes.
+func (fs *diskUsageFS) grow(name string, end int64) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	key := usageKey(name)
+	if end > fs.sizes[key] {
+		fs.resizeLocked(key, end)
+	}
+}
+
+func (fs *diskUsageFS) peakUsage() int64 {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.peak
+}
+
+// removeAll removes the files written through fs that are still there.
+func (fs *diskUsageFS) removeAll() {
+	fs.mutex.Lock()
+	var names []string
+	for key := range fs.sizes {
+		names = append(names, key)
+	}
+	fs.mutex.Unlock()
+	for _, name := range names {
+		fs.Remove(filepath.FromSlash(name))
+	}
+}
+
+func (fs *diskUsageFS) Create(name string) (FSFile, error) {
+	file, err := fs.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.resize(name, 0)
+	return &usageFile{FSFile: file, fs: fs, name: name}, nil
+}
+
+func (fs *diskUsageFS) OpenFile(name string, flag int, perm os.FileMode) (FSFile, error) {
+	file, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	if flag&os.O_TRUNC == 0 {
+		if info, err := file.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	fs.resize(name, size)
+	usage := &usageFile{FSFile: file, fs: fs, name: name}
+	if flag&os.O_APPEND != 0 {
+		usage.offset = size
+	}
+	return usage, nil
+}
+
+func (fs *diskUsageFS) Rename(oldName string, newName string) error {
+	if err := fs.FS.Rename(oldName, newName); err != nil {
+		return err
+	}
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	size, ok := fs.sizes[usageKey(oldName)]
+	fs.resizeLocked(usageKey(oldName), -1)
+	if ok {
+		fs.resizeLocked(usageKey(newName), size)
+	}
+	return nil
+}
+
+func (fs *diskUsageFS) Remove(name string) error {
+	if err := fs.FS.Remove(name); err != nil {
+		return err
+	}
+	fs.resize(name, -1)
+	return nil
+}
+
+// usageFile tells its diskUsageFS how far it is written, following the
+// offset itself rather than asking the file.
+type usageFile struct {
+	FSFile
+	fs     *diskUsageFS
+	name   string
+	offset int64
+}
+
+func (f *usageFile) Write(p []byte) (int, error) {
+	n, err := f.FSFile.Write(p)
+	f.offset += int64(n)
+	f.fs.grow(f.name, f.offset)
+	return n, err
+}
+
+func (f *usageFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.FSFile.WriteAt(p, off)
+	f.fs.grow(f.name, off+int64(n))
+	return n, err
+}
+
+func (f *usageFile) Seek(offset int64, whence int) (int64, error) {
+	position, err := f.FSFile.Seek(offset, whence)
+	if err == nil {
+		f.offset = position
+	}
+	return position, err
+}
+
+func (f *usageFile) Read(p []byte) (int, error) {
+	n, err := f.FSFile.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *usageFile) Truncate(size int64) error {
+	if err := f.FSFile.Truncate(size); err != nil {
+		return err
+	}
+	f.fs.resize(f.name, size)
+	return nil
+}
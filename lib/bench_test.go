@@ -0,0 +1,80 @@
+package lib_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/amithnair91/godownload/testserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBench(t *testing.T) {
+	server := testserver.New(testserver.Options{})
+	defer server.Close()
+	url := server.Add("file.bin", randomContent(20, 100000))
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+	result, err := downloader.Bench("dl", url, 4)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), result.Concurrency)
+	assert.Equal(t, int64(100000), result.Size)
+	// the parts and the merged file
+	assert.True(t, result.PeakDisk >= 200000, "peak disk usage %d", result.PeakDisk)
+	assert.True(t, result.Allocs > 0)
+	assert.True(t, result.Throughput() > 0)
+	assert.Empty(t, fs.Files())
+}
+
+func TestBenchRemovesPartsWhenTheDownloadFails(t *testing.T) {
+	server := testserver.New(testserver.Options{ResetAfter: 10000})
+	defer server.Close()
+	url := server.Add("file.bin", randomContent(21, 100000))
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+	_, err := downloader.Bench("dl", url, 4)
+
+	assert.Error(t, err)
+	assert.Empty(t, fs.Files())
+}
+
+func BenchmarkDownload(b *testing.B) {
+	server := testserver.New(testserver.Options{})
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{}}
+
+	for _, size := range []int{1 << 20, 16 << 20, 64 << 20} {
+		url := server.Add(fmt.Sprintf("%dMiB.bin", size>>20), randomContent(int64(size), size))
+		for _, concurrency := range []int64{1, 4, 16} {
+			b.Run(fmt.Sprintf("%dMiB/c%d", size>>20, concurrency), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				var syscalls, peak int64
+				for i := 0; i < b.N; i++ {
+					result, err := downloader.Bench(dir, url, concurrency)
+					if err != nil {
+						b.Fatal(err)
+					}
+					syscalls += result.Syscalls
+					if result.PeakDisk > peak {
+						peak = result.PeakDisk
+					}
+				}
+				if syscalls >= 0 {
+					b.ReportMetric(float64(syscalls)/float64(b.N), "syscalls/op")
+				}
+				b.ReportMetric(float64(peak), "peak-disk-B")
+			})
+		}
+	}
+}
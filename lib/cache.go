@@ -0,0 +1,349 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Cache is a content addressable store that Downloader consults before
+// fetching a file. Files are kept once per sha256 under Dir/blobs and can be
+// found by any digest they were verified against or by their url together
+// with its ETag or Last-Modified. Files are reflinked or copied in and out,
+// never hardlinked, so editing a downloaded file leaves the blob alone, and
+// every hit is hashed again before it is used. Several processes may share
+// Dir, every change to the index is made under an exclusive lock on
+// Dir/.lock. Dir is on FS, the local disk when it is nil.
+type Cache struct {
+	Dir string
+	FS  FS
+	// MaxSize in bytes, least recently used files are evicted once the
+	// cache grows beyond it. Zero means unlimited.
+	MaxSize int64
+}
+
+type cacheIndex struct {
+	Blobs map[string]*cacheBlob `json:"blobs"`
+	// Keys maps digests and url keys to the sha256 digest of a blob.
+	Keys map[string]string `json:"keys"`
+}
+
+type cacheBlob struct {
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// DefaultCacheDir is the per user cache directory for godownload.
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "godownload"), nil
+}
+
+// FetchDigest places the file with the given "<algorithm>:<hex>" digest at
+// destPath and reports whether it was cached.
+func (c *Cache) FetchDigest(digest string, destPath string) (bool, error) {
+	return c.fetch(c.fs(), destPath, []string{digest})
+}
+
+// FetchURL places the version of url identified by validators at destPath
+// and reports whether it was cached.
+func (c *Cache) FetchURL(url string, validators Validators, destPath string) (bool, error) {
+	key := urlCacheKey(url, validators)
+	if key == "" {
+		return false, nil
+	}
+	return c.fetch(c.fs(), destPath, []string{key})
+}
+
+// Store adds the file at filePath to the cache under its sha256, the given
+// digests and, when validators are known, its url.
+func (c *Cache) Store(filePath string, url string, validators Validators, digests ...string) error {
+	return c.store(c.fs(), filePath, url, validators, digests...)
+}
+
+func (c *Cache) store(fs FS, filePath string, url string, validators Validators, digests ...string) error {
+	info, err := fs.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	sum, err := (&File{FS: fs}).Checksum(filePath, "sha256")
+	if err != nil {
+		return err
+	}
+	blobDigest := "sha256:" + sum
+
+	// copied outside the lock, which is only held to move it into place
+	blobPath := c.blobPath(blobDigest)
+	tempPath := ""
+	if _, err := c.fs().Stat(blobPath); os.IsNotExist(err) {
+		if err = c.fs().MkdirAll(filepath.Dir(blobPath), os.ModePerm); err != nil {
+			return err
+		}
+		tempPath = fmt.Sprintf("%s.%d.%d.tmp", blobPath, os.Getpid(), time.Now().UnixNano())
+		if err = cloneFile(fs, filePath, c.fs(), tempPath); err != nil {
+			return err
+		}
+		defer c.fs().Remove(tempPath)
+	}
+
+	return c.update(func(index *cacheIndex) error {
+		if _, err := c.fs().Stat(blobPath); os.IsNotExist(err) && tempPath != "" {
+			if err = c.fs().Rename(tempPath, blobPath); err != nil {
+				return err
+			}
+		}
+		index.Blobs[blobDigest] = &cacheBlob{Size: info.Size(), LastUsed: time.Now()}
+		for _, digest := range append(digests, blobDigest) {
+			if digest != "" {
+				index.Keys[cacheKey(digest)] = blobDigest
+			}
+		}
+		if key := urlCacheKey(url, validators); key != "" {
+			index.Keys[key] = blobDigest
+		}
+		if c.MaxSize > 0 {
+			c.evict(index, c.MaxSize)
+		}
+		return nil
+	})
+}
+
+// Prune evicts least recently used files until the cache holds at most
+// maxSize bytes and returns how many files and bytes were removed.
+func (c *Cache) Prune(maxSize int64) (removed int, freed int64, err error) {
+	err = c.update(func(index *cacheIndex) error {
+		removed, freed = c.evict(index, maxSize)
+		return nil
+	})
+	return removed, freed, err
+}
+
+// fetch places the first cached key at destPath on fs. The blob is copied
+// to a part and hashed again outside the cache lock, and checks are run on
+// the part before it is moved into place. A part that fails them is removed
+// and the error returned.
+func (c *Cache) fetch(fs FS, destPath string, keys []string, checks ...partCheck) (bool, error) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		blobDigest := ""
+		err := c.update(func(index *cacheIndex) error {
+			digest, ok := index.Keys[cacheKey(key)]
+			if !ok {
+				return nil
+			}
+			blob, ok := index.Blobs[digest]
+			info, err := c.fs().Stat(c.blobPath(digest))
+			if !ok || err != nil || info.Size() != blob.Size {
+				// removed or modified behind our back
+				c.remove(index, digest)
+				return nil
+			}
+			blobDigest = digest
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+		if blobDigest == "" {
+			continue
+		}
+
+		if err = fs.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
+			return false, err
+		}
+		partPath := destPath + partSuffix
+		fs.Remove(partPath)
+		if err = cloneFile(c.fs(), c.blobPath(blobDigest), fs, partPath); os.IsNotExist(err) {
+			// evicted meanwhile
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		sum, err := (&File{FS: fs}).Checksum(partPath, "sha256")
+		if err != nil || "sha256:"+sum != blobDigest {
+			// corrupted on disk
+			fs.Remove(partPath)
+			if err = c.update(func(index *cacheIndex) error {
+				c.remove(index, blobDigest)
+				return nil
+			}); err != nil {
+				return false, err
+			}
+			continue
+		}
+		for _, check := range checks {
+			if check == nil {
+				continue
+			}
+			if err = check(partPath); err != nil {
+				fs.Remove(partPath)
+				return false, err
+			}
+		}
+		if err = fs.Rename(partPath, destPath); err != nil {
+			fs.Remove(partPath)
+			return false, err
+		}
+		return true, c.update(func(index *cacheIndex) error {
+			if blob, ok := index.Blobs[blobDigest]; ok {
+				blob.LastUsed = time.Now()
+			}
+			return nil
+		})
+	}
+	return false, nil
+}
+
+// update runs fn on the index under the cache lock and saves the result.
+func (c *Cache) update(fn func(index *cacheIndex) error) error {
+	if err := c.fs().MkdirAll(c.Dir, os.ModePerm); err != nil {
+		return err
+	}
+	unlock, err := c.fs().Lock(filepath.Join(c.Dir, ".lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	indexPath := filepath.Join(c.Dir, "index.json")
+	index := &cacheIndex{}
+	if data, err := readFile(c.fs(), indexPath); err == nil {
+		json.Unmarshal(data, index)
+	}
+	if index.Blobs == nil {
+		index.Blobs = map[string]*cacheBlob{}
+	}
+	if index.Keys == nil {
+		index.Keys = map[string]string{}
+	}
+
+	if err = fn(index); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tempPath := fmt.Sprintf("%s.%d.tmp", indexPath, os.Getpid())
+	if err = writeFile(c.fs(), tempPath, data); err != nil {
+		return err
+	}
+	return c.fs().Rename(tempPath, indexPath)
+}
+
+func (c *Cache) evict(index *cacheIndex, maxSize int64) (removed int, freed int64) {
+	var total int64
+	var digests []string
+	for digest, blob := range index.Blobs {
+		total += blob.Size
+		digests = append(digests, digest)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return index.Blobs[digests[i]].LastUsed.Before(index.Blobs[digests[j]].LastUsed)
+	})
+	for _, digest := range digests {
+		if total <= maxSize {
+			break
+		}
+		size := index.Blobs[digest].Size
+		c.remove(index, digest)
+		total -= size
+		freed += size
+		removed++
+	}
+	return removed, freed
+}
+
+func (c *Cache) remove(index *cacheIndex, blobDigest string) {
+	c.fs().Remove(c.blobPath(blobDigest))
+	delete(index.Blobs, blobDigest)
+	for key, digest := range index.Keys {
+		if digest == blobDigest {
+			delete(index.Keys, key)
+		}
+	}
+}
+
+func (c *Cache) fs() FS {
+	if c.FS == nil {
+		return OSFS{}
+	}
+	return c.FS
+}
+
+func (c *Cache) blobPath(blobDigest string) string {
+	return filepath.Join(c.Dir, "blobs", "sha256", strings.TrimPrefix(blobDigest, "sha256:"))
+}
+
+// cacheKey is the index key of a digest or url key. Only the hex of
+// "<algorithm>:<hex>" digests is case insensitive, urls and ETags are not.
+func cacheKey(key string) string {
+	if strings.HasPrefix(key, "url:") {
+		return key
+	}
+	return strings.ToLower(key)
+}
+
+func urlCacheKey(url string, validators Validators) string {
+	switch {
+	case validators.ETag != "":
+		return fmt.Sprintf("url:%s etag:%s", url, validators.ETag)
+	case !validators.LastModified.IsZero():
+		return fmt.Sprintf("url:%s modified:%d", url, validators.LastModified.Unix())
+	}
+	return ""
+}
+
+// cloneFile makes dst a copy of src, a copy on write clone when both are on
+// the local disk. A hardlink would let writes to one change the other.
+func cloneFile(srcFS FS, src string, dstFS FS, dst string) error {
+	_, srcOS := srcFS.(OSFS)
+	_, dstOS := dstFS.(OSFS)
+	if srcOS && dstOS && reflinkFile(src, dst) == nil {
+		return nil
+	}
+	in, err := srcFS.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := dstFS.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		dstFS.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// downloadCached serves the file from the cache when the requested digest,
+// the digest the server advertises or the url with its validators are
+// known, once it passed checks. Otherwise it runs download, which checks
+// the file against digest, and adds the result to the cache.
+func (d *Downloader) downloadCached(dirPath string, fileName string, url string, headResp *Response, digest string, download func() error, checks ...partCheck) error {
+	filePath := fmt.Sprintf("%s/%s", dirPath, fileName)
+	validators := Validators{ETag: headResp.ETag, LastModified: headResp.LastModified}
+	hit, err := d.Cache.fetch(d.fs(), filePath, []string{digest, headResp.Digest, urlCacheKey(url, validators)}, checks...)
+	if err != nil || hit {
+		return err
+	}
+
+	if err = download(); err != nil {
+		return err
+	}
+	return d.Cache.store(d.fs(), filePath, url, validators, headResp.Digest, digest)
+}
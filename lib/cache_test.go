@@ -0,0 +1,296 @@
+package lib_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func newArtifactTestServer(files map[string][]byte, gets *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "GET" {
+			atomic.AddInt32(gets, 1)
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, len(content)))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func TestDownloadFileConcurrentReusesCachedFileAcrossDirectories(t *testing.T) {
+	var gets int32
+	content := testContent(100 * 1024)
+	server := newArtifactTestServer(map[string][]byte{"/artifact.jar": content}, &gets)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient(), Cache: &lib.Cache{Dir: filepath.Join(dir, "cache")}}
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "job1"), os.ModePerm))
+	err = downloader.DownloadFileConcurrent(filepath.Join(dir, "job1"), server.URL+"/artifact.jar", 4)
+	assert.NoError(t, err)
+	before := atomic.LoadInt32(&gets)
+
+	err = downloader.DownloadFileConcurrent(filepath.Join(dir, "job2"), server.URL+"/artifact.jar", 4)
+
+	assert.NoError(t, err)
+	assert.Equal(t, before, atomic.LoadInt32(&gets))
+	for _, job := range []string{"job1", "job2"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, job, "artifact.jar"))
+		assert.NoError(t, err)
+		assert.Equal(t, content, data)
+	}
+}
+
+func TestDownloadFileWithDigestHitsCacheWithoutNetwork(t *testing.T) {
+	var gets int32
+	content := []byte("release 1.2.3")
+	server := newArtifactTestServer(map[string][]byte{"/a/tool.bin": content, "/b/tool.bin": content}, &gets)
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient(), Cache: &lib.Cache{Dir: filepath.Join(dir, "cache")}}
+	digest := testDigest(content)
+
+	_, err = downloader.DownloadFileWithDigest(filepath.Join(dir, "first"), server.URL+"/a/tool.bin", digest, 2)
+	assert.NoError(t, err)
+	server.Close()
+
+	_, err = downloader.DownloadFileWithDigest(filepath.Join(dir, "second"), server.URL+"/b/tool.bin", digest, 2)
+
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "second", "tool.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestDownloadFileWithDigestFailsOnMismatch(t *testing.T) {
+	var gets int32
+	server := newArtifactTestServer(map[string][]byte{"/tool.bin": []byte("tampered")}, &gets)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cache := &lib.Cache{Dir: filepath.Join(dir, "cache")}
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient(), Cache: cache}
+
+	_, err = downloader.DownloadFileWithDigest(filepath.Join(dir, "out"), server.URL+"/tool.bin", testDigest([]byte("original")), 1)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+	hit, err := cache.FetchDigest(testDigest([]byte("tampered")), filepath.Join(dir, "copy"))
+	assert.NoError(t, err)
+	assert.False(t, hit)
+}
+
+func TestCacheIsNotChangedByEditsToDownloadedFiles(t *testing.T) {
+	var gets int32
+	content := []byte("release 1.2.3")
+	server := newArtifactTestServer(map[string][]byte{"/tool.bin": content}, &gets)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cache := &lib.Cache{Dir: filepath.Join(dir, "cache")}
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient(), Cache: cache}
+	digest := testDigest(content)
+
+	_, err = downloader.DownloadFileWithDigest(filepath.Join(dir, "first"), server.URL+"/tool.bin", digest, 1)
+	assert.NoError(t, err)
+	file, err := os.OpenFile(filepath.Join(dir, "first", "tool.bin"), os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	file.WriteAt([]byte("EVIL"), 0)
+	file.Close()
+
+	_, err = downloader.DownloadFileWithDigest(filepath.Join(dir, "second"), server.URL+"/tool.bin", digest, 1)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "second", "tool.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gets))
+}
+
+func TestCacheDropsCorruptedBlobs(t *testing.T) {
+	var gets int32
+	content := []byte("release 1.2.3")
+	server := newArtifactTestServer(map[string][]byte{"/tool.bin": content}, &gets)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cache := &lib.Cache{Dir: filepath.Join(dir, "cache")}
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient(), Cache: cache}
+	digest := testDigest(content)
+	_, err = downloader.DownloadFileWithDigest(filepath.Join(dir, "first"), server.URL+"/tool.bin", digest, 1)
+	assert.NoError(t, err)
+
+	// same size, other bytes
+	blob := filepath.Join(dir, "cache", "blobs", "sha256", digest[len("sha256:"):])
+	assert.NoError(t, ioutil.WriteFile(blob, []byte("EVILase 1.2.3"), 0644))
+
+	hit, err := cache.FetchDigest(digest, filepath.Join(dir, "copy", "tool.bin"))
+	assert.NoError(t, err)
+	assert.False(t, hit)
+	_, err = downloader.DownloadFileWithDigest(filepath.Join(dir, "second"), server.URL+"/tool.bin", digest, 1)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "second", "tool.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&gets))
+}
+
+func TestCacheEvictsLeastRecentlyUsedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cache := &lib.Cache{Dir: filepath.Join(dir, "cache"), MaxSize: 2500}
+	var files [][]byte
+	for i := 0; i < 3; i++ {
+		files = append(files, testContent(1000+i))
+		path := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		assert.NoError(t, ioutil.WriteFile(path, files[i], 0644))
+		assert.NoError(t, cache.Store(path, "", lib.Validators{}))
+		if i == 1 {
+			// touch the first file so the second one becomes the oldest
+			hit, err := cache.FetchDigest(testDigest(files[0]), filepath.Join(dir, "touched"))
+			assert.NoError(t, err)
+			assert.True(t, hit)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hit, err := cache.FetchDigest(testDigest(files[1]), filepath.Join(dir, "evicted"))
+	assert.NoError(t, err)
+	assert.False(t, hit)
+	hit, err = cache.FetchDigest(testDigest(files[0]), filepath.Join(dir, "kept"))
+	assert.NoError(t, err)
+	assert.True(t, hit)
+
+	removed, freed, err := cache.Prune(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, int64(2002), freed)
+	files2, err := ioutil.ReadDir(filepath.Join(dir, "cache", "blobs", "sha256"))
+	assert.NoError(t, err)
+	assert.Empty(t, files2)
+}
+
+func TestCacheFindsFilesByURLAndValidators(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cache := &lib.Cache{Dir: filepath.Join(dir, "cache")}
+	path := filepath.Join(dir, "app.zip")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("v1"), 0644))
+	modified := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, cache.Store(path, "https://example.com/app.zip", lib.Validators{LastModified: modified}))
+
+	hit, err := cache.FetchURL("https://example.com/app.zip", lib.Validators{LastModified: modified}, filepath.Join(dir, "out", "app.zip"))
+	assert.NoError(t, err)
+	assert.True(t, hit)
+	hit, err = cache.FetchURL("https://example.com/app.zip", lib.Validators{LastModified: modified.Add(time.Hour)}, filepath.Join(dir, "other"))
+	assert.NoError(t, err)
+	assert.False(t, hit)
+}
+
+func TestCacheKeysKeepTheCaseOfURLsAndETags(t *testing.T) {
+	fs := &lib.MemFS{}
+	writeMemFile(t, fs, "Tool.zip", []byte("v1"))
+	cache := &lib.Cache{Dir: "cache", FS: fs}
+	assert.NoError(t, cache.Store("Tool.zip", "http://h/Tool.zip", lib.Validators{ETag: `"ABC"`}))
+
+	hit, err := cache.FetchURL("http://h/Tool.zip", lib.Validators{ETag: `"ABC"`}, "out/Tool.zip")
+	assert.NoError(t, err)
+	assert.True(t, hit)
+	hit, err = cache.FetchURL("http://h/tool.zip", lib.Validators{ETag: `"abc"`}, "other/tool.zip")
+	assert.NoError(t, err)
+	assert.False(t, hit)
+	hit, err = cache.FetchDigest(strings.ToUpper(testDigest([]byte("v1"))), "digest/Tool.zip")
+	assert.NoError(t, err)
+	assert.True(t, hit)
+}
+
+// finalFileVerifier turns every signature down, noting whether the file was
+// already in place when it was asked.
+type finalFileVerifier struct {
+	fs       *lib.MemFS
+	path     string
+	verified bool
+	inPlace  bool
+}
+
+func (v *finalFileVerifier) SignatureSuffixes() []string {
+	return []string{".sig"}
+}
+
+func (v *finalFileVerifier) Verify(content io.Reader, signature []byte) (*lib.Signer, error) {
+	v.verified = true
+	_, err := v.fs.Stat(v.path)
+	v.inPlace = err == nil
+	return nil, errors.New("bad signature")
+}
+
+func TestCacheHitIsVerifiedBeforeItIsInPlace(t *testing.T) {
+	content := []byte("release 1.2.3")
+	server := newArtifactTestServer(map[string][]byte{"/tool.bin": content, "/tool.bin.sig": []byte("sig")}, new(int32))
+	defer server.Close()
+	fs := &lib.MemFS{}
+	writeMemFile(t, fs, "seed/tool.bin", content)
+	cache := &lib.Cache{Dir: "cache", FS: fs}
+	assert.NoError(t, cache.Store("seed/tool.bin", "", lib.Validators{}))
+	verifier := &finalFileVerifier{fs: fs, path: "out/tool.bin"}
+	downloader := lib.Downloader{FileUtils: &lib.File{FS: fs}, Client: lib.NewProtocolClient(), Cache: cache, Verifier: verifier}
+
+	_, err := downloader.DownloadFileWithDigest("out", server.URL+"/tool.bin", testDigest(content), 1)
+
+	assert.Error(t, err)
+	assert.True(t, verifier.verified)
+	assert.False(t, verifier.inPlace)
+	_, err = fs.Stat("out/tool.bin")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCacheIsSafeForConcurrentWriters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// a Cache per writer, as separate processes would have
+			cache := &lib.Cache{Dir: filepath.Join(dir, "cache")}
+			path := filepath.Join(dir, fmt.Sprintf("file%d", i))
+			ioutil.WriteFile(path, []byte(fmt.Sprintf("content %d", i)), 0644)
+			assert.NoError(t, cache.Store(path, "", lib.Validators{}))
+		}(i)
+	}
+	wg.Wait()
+
+	cache := &lib.Cache{Dir: filepath.Join(dir, "cache")}
+	for i := 0; i < 8; i++ {
+		hit, err := cache.FetchDigest(testDigest([]byte(fmt.Sprintf("content %d", i))), filepath.Join(dir, "out", fmt.Sprintf("file%d", i)))
+		assert.NoError(t, err)
+		assert.True(t, hit)
+	}
+}
@@ -1,15 +1,49 @@
 package lib
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Client interface {
-	NewHttpClient()
-	ResumeGet(url string, existingFileSize int64) (resp *http.Response, err error)
-	Head(url string) (resp *http.Response, err error)
-	Get(url string, rangeHeader string) (resp *http.Response, err error)
+	ResumeGet(url string, existingFileSize int64) (resp *Response, err error)
+	Head(url string) (resp *Response, err error)
+	Get(url string, rangeHeader string) (resp *Response, err error)
+}
+
+// Response is the protocol neutral result of a Client call. Head responses
+// carry the size of the remote file, Get and ResumeGet responses carry the
+// requested bytes in Body. Digest is the "<algorithm>:<hex>" checksum of the
+// complete file when the server advertises one. ETag and LastModified are
+// the validators of the remote file, if known.
+type Response struct {
+	Body          io.ReadCloser
+	ContentLength int64
+	Digest        string
+	ETag          string
+	LastModified  time.Time
+	// NotModified is set by HeadIfChanged when the validators still match.
+	NotModified bool
+}
+
+// Validators identify the version of a remote file that was downloaded.
+type Validators struct {
+	ETag         string
+	LastModified time.Time
+}
+
+// ConditionalClient is implemented by clients that can ask the server
+// whether a file changed since it was downloaded.
+type ConditionalClient interface {
+	HeadIfChanged(url string, validators Validators) (resp *Response, err error)
 }
 
 type HTTPClient struct {
@@ -20,21 +54,264 @@ func (c *HTTPClient) NewHttpClient() {
 	c.client = &http.Client{}
 }
 
-func (c *HTTPClient) ResumeGet(url string, existingFileSize int64) (resp *http.Response, err error) {
-	req, err := http.NewRequest("GET", url, nil)
+func (c *HTTPClient) ResumeGet(url string, existingFileSize int64) (resp *Response, err error) {
+	req, err := newHTTPRequest("GET", url)
+	if err != nil {
+		return nil, err
+	}
 	addResumeRangeHeader(req, existingFileSize)
-	return c.client.Do(req)
+	httpResp, err := c.client.Do(req)
+	response, err := newResponse(httpResp, err)
+	if err != nil {
+		return nil, err
+	}
+	if httpResp.StatusCode != http.StatusPartialContent && existingFileSize > 0 {
+		err = errRangeIgnored
+	} else {
+		err = checkContentRange(httpResp, existingFileSize, -1)
+	}
+	if err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	return response, nil
 }
 
-func (c *HTTPClient) Head(url string) (resp *http.Response, err error) {
-	req, err := http.NewRequest("HEAD", url, nil)
-	return c.client.Do(req)
+func (c *HTTPClient) Head(url string) (resp *Response, err error) {
+	req, err := newHTTPRequest("HEAD", url)
+	if err != nil {
+		return nil, err
+	}
+	return newResponse(c.client.Do(req))
 }
 
-func (c *HTTPClient) Get(url string, rangeHeader string) (resp *http.Response, err error) {
-	req, err := http.NewRequest("GET", url, nil)
+func (c *HTTPClient) HeadIfChanged(url string, validators Validators) (resp *Response, err error) {
+	req, err := newHTTPRequest("HEAD", url)
+	if err != nil {
+		return nil, err
+	}
+	if validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if !validators.LastModified.IsZero() {
+		req.Header.Set("If-Modified-Since", validators.LastModified.UTC().Format(http.TimeFormat))
+	}
+	httpResp, err := c.client.Do(req)
+	if err == nil && httpResp.StatusCode == http.StatusNotModified {
+		httpResp.Body.Close()
+		return &Response{Body: http.NoBody, ETag: validators.ETag, LastModified: validators.LastModified, NotModified: true}, nil
+	}
+	return newResponse(httpResp, err)
+}
+
+func (c *HTTPClient) Get(url string, rangeHeader string) (resp *Response, err error) {
+	req, err := newHTTPRequest("GET", url)
+	if err != nil {
+		return nil, err
+	}
 	addRangeHeaders(req, rangeHeader)
-	return c.client.Do(req)
+	from, to, err := parseByteRange(rangeHeader)
+	if err != nil {
+		return nil, err
+	}
+	httpResp, err := c.client.Do(req)
+	response, err := newResponse(httpResp, err)
+	if err != nil {
+		return nil, err
+	}
+	if httpResp.StatusCode != http.StatusPartialContent && from > 0 {
+		err = errRangeIgnored
+	} else {
+		err = checkContentRange(httpResp, from, to)
+	}
+	if err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	return response, nil
+}
+
+// checkContentRange makes sure a partial response holds the range from-to
+// that was asked for, to is -1 for the rest of the file. The end may be
+// short of to when the file is.
+func checkContentRange(resp *http.Response, from int64, to int64) error {
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil
+	}
+	contentRange := resp.Header.Get("Content-Range")
+	var start, end int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/", &start, &end); err != nil || start != from || end < start || (to >= 0 && end > to) {
+		return fmt.Errorf("request for range %d-%s of %s was answered with %q", from, rangeEnd(to), resp.Request.URL, contentRange)
+	}
+	return nil
+}
+
+func rangeEnd(to int64) string {
+	if to < 0 {
+		return ""
+	}
+	return strconv.FormatInt(to, 10)
+}
+
+func newResponse(resp *http.Response, err error) (*Response, error) {
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, newStatusError(resp)
+	}
+	response := &Response{Body: resp.Body, ContentLength: resp.ContentLength, ETag: resp.Header.Get("ETag"), Digest: parseDigestHeader(resp.Header)}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		response.LastModified = lastModified
+	}
+	if err := decodeContent(resp, response); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return response, nil
+}
+
+// newHTTPRequest asks for the identity encoding, lengths and ranges are only
+// meaningful for the bytes of the file itself.
+func newHTTPRequest(method string, url string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	return req, nil
+}
+
+var contentEncodings = map[string]string{
+	"gzip":    "gzip",
+	"x-gzip":  "gzip",
+	"br":      "brotli",
+	"zstd":    "zstd",
+	"deflate": "zlib",
+}
+
+var digestAlgorithms = map[string]string{
+	"sha-256": "sha256",
+	"sha-512": "sha512",
+	"md5":     "md5",
+}
+
+// parseDigestHeader reads a Repr-Digest header, or the older Digest one, into
+// an "<algorithm>:<hex>" digest of the whole file. It is empty when neither
+// names an algorithm this side knows.
+func parseDigestHeader(header http.Header) string {
+	for _, name := range []string{"Repr-Digest", "Digest"} {
+		for _, value := range strings.Split(header.Get(name), ",") {
+			tokens := strings.SplitN(strings.TrimSpace(value), "=", 2)
+			if len(tokens) != 2 {
+				continue
+			}
+			algorithm, ok := digestAlgorithms[strings.ToLower(tokens[0])]
+			if !ok {
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(strings.Trim(tokens[1], ":"))
+			if err == nil {
+				return algorithm + ":" + hex.EncodeToString(sum)
+			}
+		}
+	}
+	return ""
+}
+
+// decodeContent handles servers that encode the response anyway. Its length
+// is that of the encoded bytes and so unknown for the file. The whole file is
+// decoded, a range of the encoded bytes can't be.
+func decodeContent(resp *http.Response, response *Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return nil
+	}
+	response.ContentLength = -1
+	// the digest is of the encoded bytes
+	response.Digest = ""
+	if resp.Request.Method == "HEAD" {
+		return nil
+	}
+	url := resp.Request.URL.String()
+	if rangeHeader := resp.Request.Header.Get("Range"); rangeHeader != "" && rangeHeader != "bytes=0-" {
+		return fmt.Errorf("unable to read %s of %s: the server sent it with content encoding %s", rangeHeader, url, encoding)
+	}
+	compression, ok := contentEncodings[encoding]
+	if !ok {
+		return fmt.Errorf("unable to read %s: unsupported content encoding %s", url, encoding)
+	}
+	decoded, err := newDecompressor(resp.Body, compression)
+	if err != nil {
+		return err
+	}
+	response.Body = &decodedBody{ReadCloser: decoded, body: resp.Body}
+	return nil
+}
+
+// decodedBody closes the decoder and the encoded body under it.
+type decodedBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.body.Close()
+}
+
+// headIfChanged makes a conditional Head with clients that support it. For
+// the others the validators of a plain Head are compared.
+func headIfChanged(client Client, url string, validators Validators) (*Response, error) {
+	if conditional, ok := client.(ConditionalClient); ok {
+		return conditional.HeadIfChanged(url, validators)
+	}
+	resp, err := client.Head(url)
+	if err != nil {
+		return nil, err
+	}
+	if validators.ETag != "" {
+		resp.NotModified = resp.ETag == validators.ETag
+	} else if !validators.LastModified.IsZero() {
+		resp.NotModified = !resp.LastModified.IsZero() && !resp.LastModified.After(validators.LastModified)
+	}
+	return resp, nil
+}
+
+// StatusError is returned when a server answers outside the 2xx range.
+// RetryAfter is the delay the server asked for, if any.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request for %s failed with status %s", e.URL, e.Status)
+}
+
+// isNotFound reports whether err means the file asked for doesn't exist,
+// whatever the protocol: a 404 or 410 over HTTP, S3 and registries, or
+// os.ErrNotExist from FTP and SFTP.
+func isNotFound(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusGone
+	}
+	return errors.Is(err, os.ErrNotExist)
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	statusErr := &StatusError{URL: resp.Request.URL.String(), StatusCode: resp.StatusCode, Status: resp.Status}
+	retryAfter := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		statusErr.RetryAfter = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(retryAfter); err == nil {
+		statusErr.RetryAfter = time.Until(date)
+	}
+	return statusErr
 }
 
 func addRangeHeaders(req *http.Request, rangeHeader string) {
@@ -44,3 +321,42 @@ func addRangeHeaders(req *http.Request, rangeHeader string) {
 func addResumeRangeHeader(req *http.Request, rangeFrom int64) {
 	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", rangeFrom))
 }
+
+// parseByteRange parses an inclusive "from-to" range as produced by
+// populateRangeList. An open ended range ("from-") returns to as -1.
+func parseByteRange(rangeHeader string) (from int64, to int64, err error) {
+	bounds := strings.SplitN(rangeHeader, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %q", rangeHeader)
+	}
+	from, err = strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range %q", rangeHeader)
+	}
+	if bounds[1] == "" {
+		return from, -1, nil
+	}
+	to, err = strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil || to < from {
+		return 0, 0, fmt.Errorf("invalid range %q", rangeHeader)
+	}
+	return from, to, nil
+}
+
+// limitedReadCloser reads at most n bytes from the underlying body and closes
+// it when done.
+type limitedReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func newLimitedReadCloser(body io.ReadCloser, from int64, to int64) io.ReadCloser {
+	if to < 0 {
+		return body
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(body, to-from+1), closer: body}
+}
+
+func (l *limitedReadCloser) Close() error {
+	return l.closer.Close()
+}
@@ -0,0 +1,39 @@
+package lib_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	after := time.Date(2024, time.March, 15, 10, 30, 20, 0, time.UTC) // a friday
+	cases := map[string]time.Time{
+		"* * * * *":        time.Date(2024, time.March, 15, 10, 31, 0, 0, time.UTC),
+		"@daily":           time.Date(2024, time.March, 16, 0, 0, 0, 0, time.UTC),
+		"0 3 * * *":        time.Date(2024, time.March, 16, 3, 0, 0, 0, time.UTC),
+		"*/15 * * * *":     time.Date(2024, time.March, 15, 10, 45, 0, 0, time.UTC),
+		"0 9-17/4 * * 1-5": time.Date(2024, time.March, 15, 13, 0, 0, 0, time.UTC),
+		"30 2 * * 7":       time.Date(2024, time.March, 17, 2, 30, 0, 0, time.UTC),
+		"0 0 1,20 * 1":     time.Date(2024, time.March, 18, 0, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":       time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC),
+	}
+	for spec, expected := range cases {
+		schedule, err := lib.ParseCronSchedule(spec)
+		assert.NoError(t, err, spec)
+		assert.Equal(t, expected, schedule.Next(after), spec)
+	}
+
+	schedule, err := lib.ParseCronSchedule("0 0 31 2 *")
+	assert.NoError(t, err)
+	assert.True(t, schedule.Next(after).IsZero())
+}
+
+func TestParseCronScheduleRejectsInvalidExpressions(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *", "x * * * *", "@often"} {
+		_, err := lib.ParseCronSchedule(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Daemon serves a JobQueue over HTTP. JSON-RPC 2.0 calls with named params
+// are posted to /rpc:
+//
+//	add            {"url", "dir", "concurrency", "priority", "startAfter", "schedule"}
+//	pause, resume, cancel, status {"id"}
+//	list
+//	changePriority {"id", "priority"}
+//	globalOptions  {"maxActive", "dir", "concurrency", "bandwidth"}, all optional
+//
+// and GET /events streams JobEvents as server-sent events, optionally only
+// those of ?id=<job>. A subset of the aria2 JSON-RPC interface is served on
+// /jsonrpc for existing aria2 frontends.
+//
+// Every endpoint needs the Token. /rpc and /events also turn down requests
+// from other origins, so web pages can't drive a daemon on localhost, and
+// calls to /rpc must be application/json, which browsers don't send
+// cross-origin without asking first.
+type Daemon struct {
+	Queue *JobQueue
+	// Token is sent as "Authorization: Bearer <Token>", as ?token= to
+	// /events for EventSource clients and as the "token:<Token>" first
+	// param to /jsonrpc, like aria2's --rpc-secret. Everything is refused
+	// while it is empty.
+	Token string
+	once  sync.Once
+	mux   *http.ServeMux
+}
+
+type jobParams struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	JobOptions
+}
+
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.once.Do(func() {
+		d.mux = http.NewServeMux()
+		d.mux.HandleFunc("/rpc", func(w http.ResponseWriter, r *http.Request) {
+			if !d.authorize(w, r) {
+				return
+			}
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); r.Method == "POST" && mediaType != "application/json" {
+				http.Error(w, "expected application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+			serveJSONRPC(w, r, d.methods())
+		})
+		d.mux.HandleFunc("/jsonrpc", func(w http.ResponseWriter, r *http.Request) {
+			serveJSONRPC(w, r, d.aria2Methods())
+		})
+		d.mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+			if d.authorize(w, r) {
+				d.serveEvents(w, r)
+			}
+		})
+	})
+	d.mux.ServeHTTP(w, r)
+}
+
+// authorize answers r with an error unless it carries the Token and comes
+// from the daemon's own origin, if a browser sent it.
+func (d *Daemon) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+			return false
+		}
+	}
+	token := ""
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	} else if r.Method == "GET" {
+		token = r.URL.Query().Get("token")
+	}
+	if d.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(d.Token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// ListenAndServe listens on a "unix" socket path or a "tcp" address. A stale
+// socket file left by an earlier daemon is replaced.
+func (d *Daemon) ListenAndServe(network string, address string) error {
+	if network == "unix" {
+		if conn, err := net.Dial("unix", address); err == nil {
+			conn.Close()
+			return fmt.Errorf("a daemon is already listening on %s", address)
+		}
+		os.Remove(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return http.Serve(listener, d)
+}
+
+func (d *Daemon) methods() map[string]rpcMethod {
+	withID := func(call func(id string) (Job, error)) rpcMethod {
+		return func(raw json.RawMessage) (interface{}, error) {
+			params, err := decodeJobParams(raw)
+			if err != nil {
+				return nil, err
+			}
+			return call(params.ID)
+		}
+	}
+	return map[string]rpcMethod{
+		"add": func(raw json.RawMessage) (interface{}, error) {
+			params, err := decodeJobParams(raw)
+			if err != nil {
+				return nil, err
+			}
+			return d.Queue.Add(params.URL, params.JobOptions)
+		},
+		"pause":  withID(d.Queue.Pause),
+		"resume": withID(d.Queue.Resume),
+		"cancel": withID(d.Queue.Cancel),
+		"status": withID(d.Queue.Status),
+		"list": func(raw json.RawMessage) (interface{}, error) {
+			return d.Queue.List(), nil
+		},
+		"changePriority": func(raw json.RawMessage) (interface{}, error) {
+			params, err := decodeJobParams(raw)
+			if err != nil {
+				return nil, err
+			}
+			return d.Queue.ChangePriority(params.ID, params.Priority)
+		},
+		"globalOptions": func(raw json.RawMessage) (interface{}, error) {
+			var options QueueOptions
+			if len(raw) > 0 && string(raw) != "null" {
+				if err := json.Unmarshal(raw, &options); err != nil {
+					return nil, invalidParams(err)
+				}
+			}
+			return d.Queue.SetOptions(options)
+		},
+	}
+}
+
+func decodeJobParams(raw json.RawMessage) (jobParams, error) {
+	var params jobParams
+	if len(raw) == 0 {
+		return params, invalidParams(errors.New("missing params"))
+	}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return params, invalidParams(err)
+	}
+	return params, nil
+}
+
+func (d *Daemon) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	events, unsubscribe := d.Queue.Subscribe()
+	defer unsubscribe()
+	id := r.URL.Query().Get("id")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if id != "" && event.Job.ID != id {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, strings.TrimSpace(string(data)))
+			flusher.Flush()
+		}
+	}
+}
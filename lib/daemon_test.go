@@ -0,0 +1,198 @@
+package lib_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+type rpcTestResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func callRPC(t *testing.T, client *http.Client, endpoint string, method string, params interface{}) rpcTestResponse {
+	body, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	var response rpcTestResponse
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	return response
+}
+
+// tokenTransport sends the daemon token with every request.
+type tokenTransport struct {
+	token     string
+	transport http.RoundTripper
+}
+
+func (t tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.transport.RoundTrip(req)
+}
+
+func withToken(client *http.Client, token string) *http.Client {
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &http.Client{Transport: tokenTransport{token: token, transport: transport}}
+}
+
+func TestDaemonControlsJobsOverJSONRPCAndStreamsEvents(t *testing.T) {
+	files := newGatedTestServer(map[string][]byte{"/build.tar": testContent(32 * 1024)})
+	defer files.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	queue, err := lib.NewJobQueue(lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}, lib.QueueOptions{Dir: dir})
+	assert.NoError(t, err)
+	defer queue.Close()
+	server := httptest.NewServer(&lib.Daemon{Queue: queue, Token: "t0ken"})
+	defer server.Close()
+	client := withToken(http.DefaultClient, "t0ken")
+
+	resp, err := http.Get(server.URL + "/events?token=t0ken")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	response := callRPC(t, client, server.URL+"/rpc", "add", map[string]interface{}{"url": files.URL + "/build.tar", "concurrency": 3, "priority": 2})
+	assert.Nil(t, response.Error)
+	var job lib.Job
+	assert.NoError(t, json.Unmarshal(response.Result, &job))
+	assert.Len(t, job.ID, 16)
+	assert.Equal(t, int64(3), job.Concurrency)
+	assert.Equal(t, dir, job.Dir)
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event lib.JobEvent
+		assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+		if event.Job.ID == job.ID && event.Job.Status == lib.JobComplete {
+			assert.Equal(t, int64(32*1024), event.Job.DoneBytes)
+			break
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "build.tar"))
+	assert.NoError(t, err)
+	assert.Equal(t, files.files["/build.tar"], data)
+
+	response = callRPC(t, client, server.URL+"/rpc", "changePriority", map[string]interface{}{"id": job.ID, "priority": 9})
+	assert.Nil(t, response.Error)
+	response = callRPC(t, client, server.URL+"/rpc", "list", nil)
+	var jobs []lib.Job
+	assert.NoError(t, json.Unmarshal(response.Result, &jobs))
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, 9, jobs[0].Priority)
+	assert.Equal(t, lib.JobComplete, jobs[0].Status)
+
+	response = callRPC(t, client, server.URL+"/rpc", "globalOptions", map[string]interface{}{"maxActive": 2})
+	var options lib.QueueOptions
+	assert.NoError(t, json.Unmarshal(response.Result, &options))
+	assert.Equal(t, lib.QueueOptions{MaxActive: 2, Dir: dir, Concurrency: 4}, options)
+
+	response = callRPC(t, client, server.URL+"/rpc", "pause", map[string]interface{}{"id": job.ID})
+	assert.Equal(t, 1, response.Error.Code)
+	assert.Equal(t, "job "+job.ID+" is complete and can't be paused", response.Error.Message)
+	response = callRPC(t, client, server.URL+"/rpc", "purge", nil)
+	assert.Equal(t, -32601, response.Error.Code)
+	response = callRPC(t, client, server.URL+"/rpc", "status", "oops")
+	assert.Equal(t, -32602, response.Error.Code)
+}
+
+func TestDaemonListensOnUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	queue, err := lib.NewJobQueue(lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}, lib.QueueOptions{Dir: dir})
+	assert.NoError(t, err)
+	defer queue.Close()
+	socket := filepath.Join(dir, "godownload.sock")
+	assert.NoError(t, ioutil.WriteFile(socket, nil, 0644))
+	go (&lib.Daemon{Queue: queue, Token: "t0ken"}).ListenAndServe("unix", socket)
+	client := withToken(&http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return net.Dial("unix", socket)
+	}}}, "t0ken")
+	waitFor(t, func() bool {
+		conn, err := net.Dial("unix", socket)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+
+	response := callRPC(t, client, "http://godownload/rpc", "list", nil)
+
+	assert.Nil(t, response.Error)
+	assert.Equal(t, "[]", string(response.Result))
+	assert.EqualError(t, (&lib.Daemon{Queue: queue}).ListenAndServe("unix", socket), "a daemon is already listening on "+socket)
+}
+
+func TestDaemonRefusesUnauthorizedAndCrossOriginRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	queue, err := lib.NewJobQueue(lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}, lib.QueueOptions{Dir: dir})
+	assert.NoError(t, err)
+	defer queue.Close()
+	server := httptest.NewServer(&lib.Daemon{Queue: queue, Token: "t0ken"})
+	defer server.Close()
+	add := `{"jsonrpc": "2.0", "id": 1, "method": "add", "params": {"url": "http://127.0.0.1:1/a"}}`
+	post := func(path string, contentType string, header http.Header) int {
+		req, _ := http.NewRequest("POST", server.URL+path, strings.NewReader(add))
+		req.Header = header
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	authorized := http.Header{"Authorization": {"Bearer t0ken"}}
+
+	assert.Equal(t, http.StatusUnauthorized, post("/rpc", "application/json", http.Header{}))
+	assert.Equal(t, http.StatusUnauthorized, post("/rpc", "application/json", http.Header{"Authorization": {"Bearer wrong"}}))
+	assert.Equal(t, http.StatusUnauthorized, post("/rpc?token=t0ken", "application/json", http.Header{}))
+	assert.Equal(t, http.StatusUnsupportedMediaType, post("/rpc", "text/plain", authorized))
+	assert.Equal(t, http.StatusForbidden, post("/rpc", "application/json", http.Header{"Authorization": {"Bearer t0ken"}, "Origin": {"http://evil.example"}}))
+	assert.Empty(t, queue.List())
+	resp, err := http.Get(server.URL + "/events")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	assert.Equal(t, http.StatusOK, post("/rpc", "application/json; charset=utf-8", http.Header{"Authorization": {"Bearer t0ken"}, "Origin": {server.URL}}))
+	assert.Len(t, queue.List(), 1)
+
+	open := httptest.NewServer(&lib.Daemon{Queue: queue})
+	defer open.Close()
+	resp, err = withToken(http.DefaultClient, "").Post(open.URL+"/rpc", "application/json", strings.NewReader(add))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var compressedSuffixes = []struct {
+	suffix      string
+	compression string
+	replacement string
+}{
+	{".tgz", "gzip", ".tar"},
+	{".tbz2", "bzip2", ".tar"},
+	{".txz", "xz", ".tar"},
+	{".tzst", "zstd", ".tar"},
+	{".gz", "gzip", ""},
+	{".bz2", "bzip2", ""},
+	{".xz", "xz", ""},
+	{".zst", "zstd", ""},
+}
+
+// Decompressed is the compression of a file named name, "gzip", "bzip2",
+// "xz" or "zstd", and the name of its content. The compression is empty
+// when the name has no known suffix.
+func Decompressed(name string) (compression string, decompressedName string) {
+	lower := strings.ToLower(name)
+	for _, compressed := range compressedSuffixes {
+		if strings.HasSuffix(lower, compressed.suffix) && len(name) > len(compressed.suffix) {
+			return compressed.compression, name[:len(name)-len(compressed.suffix)] + compressed.replacement
+		}
+	}
+	return "", name
+}
+
+// newDecompressor decodes r, compressed with gzip, bzip2, xz, zstd, brotli
+// or zlib. Closing it doesn't close r.
+func newDecompressor(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "bzip2":
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case "xz":
+		reader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(reader), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case "brotli":
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	case "zlib":
+		return zlib.NewReader(r)
+	}
+	return nil, fmt.Errorf("unsupported compression %q", compression)
+}
+
+// DownloadDecompressed saves the gzip, bzip2, xz or zstd compressed file at
+// url decompressed, under its name without the compression suffix. It is
+// decoded while it downloads, or with a Verifier once it is downloaded and
+// its signature is checked.
+func (d *Downloader) DownloadDecompressed(dirPath string, url string, concurrency int64) error {
+	fileName, err := d.FileUtils.GetFileNameFromURL(url)
+	if err != nil {
+		return err
+	}
+	compression, name := Decompressed(strings.SplitN(fileName, "?", 2)[0])
+	if compression == "" {
+		return fmt.Errorf("unable to decompress %s: unknown compression", fileName)
+	}
+	if err = d.fs().MkdirAll(dirPath, os.ModePerm); err != nil {
+		return err
+	}
+	check, err := d.signatureCheck(url, nil)
+	if err != nil {
+		return err
+	}
+	filePath := fmt.Sprintf("%s/%s", dirPath, name)
+	partPath := filePath + partSuffix
+	out, err := d.fs().Create(partPath)
+	if err != nil {
+		return err
+	}
+
+	decode := func(r io.Reader) error {
+		decompressed, err := newDecompressor(r, compression)
+		if err != nil {
+			return err
+		}
+		defer decompressed.Close()
+		_, err = io.Copy(out, decompressed)
+		return err
+	}
+	if check == nil {
+		err = d.downloadPipe(url, concurrency, decode)
+	} else {
+		err = d.decodeChecked(dirPath, "."+fileName, url, concurrency, check, decode)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		d.FileUtils.DeleteFile(partPath)
+		return err
+	}
+	return d.commitPart(partPath, filePath)
+}
+
+// decodeChecked downloads url as dirPath/name, checks its signature and
+// hands it to decode.
+func (d *Downloader) decodeChecked(dirPath string, name string, url string, concurrency int64, check *signatureCheck, decode func(r io.Reader) error) error {
+	compressedPath, err := d.downloadChecked(dirPath, name, url, concurrency, check.partCheck())
+	if err != nil {
+		return err
+	}
+	defer d.FileUtils.DeleteFile(compressedPath)
+	compressed, err := d.fs().Open(compressedPath)
+	if err != nil {
+		return err
+	}
+	defer compressed.Close()
+	return decode(compressed)
+}
+
+// downloadPipe streams url to consume in order. Whatever consume leaves
+// unread is still downloaded, so errors at the end aren't missed.
+func (d *Downloader) downloadPipe(url string, concurrency int64, consume func(r io.Reader) error) error {
+	reader, writer := io.Pipe()
+	downloadErr := make(chan error, 1)
+	go func() {
+		err := d.DownloadToWriter(writer, url, concurrency, StreamOptions{})
+		writer.CloseWithError(err)
+		downloadErr <- err
+	}()
+
+	err := consume(reader)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, reader)
+	}
+	reader.CloseWithError(err)
+	if downloadErr := <-downloadErr; err == nil {
+		err = downloadErr
+	}
+	return err
+}
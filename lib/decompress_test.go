@@ -0,0 +1,149 @@
+package lib_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+func compress(t *testing.T, compression string, data []byte) []byte {
+	var buf bytes.Buffer
+	var out io.WriteCloser
+	var err error
+	switch compression {
+	case "gzip":
+		out = gzip.NewWriter(&buf)
+	case "br":
+		out = brotli.NewWriter(&buf)
+	case "zstd":
+		out, err = zstd.NewWriter(&buf)
+	case "xz":
+		out, err = xz.NewWriter(&buf)
+	}
+	assert.NoError(t, err)
+	out.Write(data)
+	assert.NoError(t, out.Close())
+	return buf.Bytes()
+}
+
+// encodingServer answers /<encoding>/<name> with content in that
+// Content-Encoding whatever the client accepts, ranges are of the encoded
+// bytes. Plain paths are served as they are.
+type encodingServer struct {
+	*httptest.Server
+	mutex           sync.Mutex
+	acceptEncodings []string
+}
+
+func newEncodingServer(t *testing.T, content []byte) *encodingServer {
+	server := &encodingServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		server.acceptEncodings = append(server.acceptEncodings, r.Header.Get("Accept-Encoding"))
+		server.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		data := content
+		if encoding := strings.Split(r.URL.Path, "/")[1]; encoding != "plain" {
+			w.Header().Set("Content-Encoding", encoding)
+			data = compress(t, encoding, content)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	return server
+}
+
+func TestHTTPClientAsksForIdentityEncoding(t *testing.T) {
+	content := testContent(8192)
+	server := newEncodingServer(t, content)
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+	assert.NoError(t, downloader.DownloadFileConcurrent("dl", server.URL+"/plain/file.bin", 2))
+	assert.NoError(t, downloader.DownloadFile("dl", server.URL+"/plain/other.bin"))
+	assert.Len(t, server.acceptEncodings, 4)
+	for _, acceptEncoding := range server.acceptEncodings {
+		assert.Equal(t, "identity", acceptEncoding)
+	}
+}
+
+func TestHTTPClientDecodesEncodedResponses(t *testing.T) {
+	content := testContent(64 * 1024)
+	server := newEncodingServer(t, content)
+	defer server.Close()
+	client := lib.NewProtocolClient()
+
+	for _, encoding := range []string{"gzip", "br", "zstd"} {
+		url := server.URL + "/" + encoding + "/file.bin"
+		head, err := client.Head(url)
+		assert.NoError(t, err, encoding)
+		assert.Equal(t, int64(-1), head.ContentLength, encoding)
+
+		_, err = client.Get(url, "100-199")
+		assert.Error(t, err, encoding)
+
+		fs := &lib.MemFS{}
+		downloader := lib.Downloader{Client: client, FileUtils: &lib.File{FS: fs}}
+		assert.NoError(t, downloader.DownloadFileConcurrent("dl", url, 4), encoding)
+		data, err := fs.ReadFile("dl/file.bin")
+		assert.NoError(t, err, encoding)
+		assert.Equal(t, content, data, encoding)
+
+		var buf bytes.Buffer
+		assert.NoError(t, downloader.DownloadToWriter(&buf, url, 4, lib.StreamOptions{}), encoding)
+		assert.Equal(t, content, buf.Bytes(), encoding)
+	}
+}
+
+func TestDownloadDecompressed(t *testing.T) {
+	content := testContent(64 * 1024)
+	files := map[string][]byte{
+		"/data.json.gz":  compress(t, "gzip", content),
+		"/data.json.xz":  compress(t, "xz", content),
+		"/data.json.zst": compress(t, "zstd", content),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(files[r.URL.Path]))
+	}))
+	defer server.Close()
+
+	for name := range files {
+		fs := &lib.MemFS{}
+		downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+		assert.NoError(t, downloader.DownloadDecompressed("dl", server.URL+name, 4), name)
+		assert.Equal(t, []string{"dl/data.json"}, fs.Files(), name)
+		data, err := fs.ReadFile("dl/data.json")
+		assert.NoError(t, err, name)
+		assert.Equal(t, content, data, name)
+	}
+}
+
+func TestDecompressedNames(t *testing.T) {
+	for name, expected := range map[string][2]string{
+		"data.json.gz":   {"gzip", "data.json"},
+		"data.BZ2":       {"bzip2", "data"},
+		"image.raw.xz":   {"xz", "image.raw"},
+		"dump.sql.zst":   {"zstd", "dump.sql"},
+		"source.tgz":     {"gzip", "source.tar"},
+		"source.tar.zst": {"zstd", "source.tar"},
+		"notes.txt":      {"", "notes.txt"},
+		".gz":            {"", ".gz"},
+	} {
+		compression, decompressed := lib.Decompressed(name)
+		assert.Equal(t, expected, [2]string{compression, decompressed}, name)
+	}
+}
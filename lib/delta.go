@@ -0,0 +1,437 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DeltaSuffix is appended to the url of a file to find its block index.
+	DeltaSuffix = ".blockindex"
+	// DefaultBlockSize is the block size of GenerateBlockIndex when none is
+	// given.
+	DefaultBlockSize = 4096
+	deltaMagic       = "godownload-blockindex: 1"
+	strongSize       = 16
+	// maxDeltaRange bounds the bytes fetched by a single range request.
+	maxDeltaRange = 4 << 20
+	// maxBlockSize bounds the window findBlocks allocates for an index.
+	maxBlockSize = 1 << 20
+)
+
+// BlockIndex describes a file as the checksums of its blocks, so a client
+// holding an older version can find the blocks it already has. The last
+// block is zero padded to BlockSize.
+type BlockIndex struct {
+	Size      int64
+	BlockSize int
+	// Digest is the sha256 digest of the whole file.
+	Digest string
+	Blocks []BlockChecksum
+}
+
+// BlockChecksum is the rolling checksum of a block and the first bytes of
+// its sha256 sum.
+type BlockChecksum struct {
+	Weak   uint32
+	Strong [strongSize]byte
+}
+
+// DeltaResult tells how much of a file DownloadDelta took from the old
+// version and how much it fetched.
+type DeltaResult struct {
+	Path    string
+	Size    int64
+	Reused  int64
+	Fetched int64
+	Ranges  int
+}
+
+// GenerateBlockIndex reads r in blocks of blockSize, DefaultBlockSize when
+// it is zero. Blocks can't be larger than 1 MiB.
+func GenerateBlockIndex(r io.Reader, blockSize int) (*BlockIndex, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	if blockSize > maxBlockSize {
+		return nil, fmt.Errorf("block size %d is larger than %d", blockSize, maxBlockSize)
+	}
+	index := &BlockIndex{BlockSize: blockSize}
+	digest := sha256.New()
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			digest.Write(block[:n])
+			index.Size += int64(n)
+			for i := n; i < blockSize; i++ {
+				block[i] = 0
+			}
+			index.Blocks = append(index.Blocks, blockChecksum(block))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	index.Digest = "sha256:" + hex.EncodeToString(digest.Sum(nil))
+	return index, nil
+}
+
+func blockChecksum(block []byte) BlockChecksum {
+	checksum := BlockChecksum{Weak: newRollingChecksum(block).sum()}
+	strong := sha256.Sum256(block)
+	copy(checksum.Strong[:], strong[:])
+	return checksum
+}
+
+// WriteTo writes the index as a text header followed by a blank line and
+// the checksums of the blocks.
+func (index *BlockIndex) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\nSize: %d\nBlock-Size: %d\nDigest: %s\n\n", deltaMagic, index.Size, index.BlockSize, index.Digest)
+	for _, block := range index.Blocks {
+		binary.Write(&buf, binary.BigEndian, block.Weak)
+		buf.Write(block.Strong[:])
+	}
+	return buf.WriteTo(w)
+}
+
+// ReadBlockIndex reads an index written by BlockIndex.WriteTo.
+func ReadBlockIndex(r io.Reader) (*BlockIndex, error) {
+	reader := bufio.NewReader(r)
+	magic, err := reader.ReadString('\n')
+	if err != nil || strings.TrimSpace(magic) != deltaMagic {
+		return nil, fmt.Errorf("invalid block index")
+	}
+	index := &BlockIndex{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("invalid block index: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		tokens := strings.SplitN(line, ": ", 2)
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("invalid block index header %q", line)
+		}
+		switch tokens[0] {
+		case "Size":
+			index.Size, err = strconv.ParseInt(tokens[1], 10, 64)
+		case "Block-Size":
+			index.BlockSize, err = strconv.Atoi(tokens[1])
+		case "Digest":
+			index.Digest = tokens[1]
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid block index header %q", line)
+		}
+	}
+	if index.BlockSize <= 0 || index.BlockSize > maxBlockSize || index.Size < 0 {
+		return nil, fmt.Errorf("invalid block index")
+	}
+	count := (index.Size + int64(index.BlockSize) - 1) / int64(index.BlockSize)
+	for i := int64(0); i < count; i++ {
+		var block BlockChecksum
+		if err = binary.Read(reader, binary.BigEndian, &block.Weak); err == nil {
+			_, err = io.ReadFull(reader, block.Strong[:])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid block index: %d of %d blocks", i, count)
+		}
+		index.Blocks = append(index.Blocks, block)
+	}
+	return index, nil
+}
+
+// rollingChecksum is the rsync checksum of a window, which moves a byte at
+// a time without reading the window again.
+type rollingChecksum struct {
+	a, b   uint32
+	length uint32
+}
+
+func newRollingChecksum(window []byte) *rollingChecksum {
+	c := &rollingChecksum{length: uint32(len(window))}
+	for i, value := range window {
+		c.a += uint32(value)
+		c.b += uint32(len(window)-i) * uint32(value)
+	}
+	return c
+}
+
+func (c *rollingChecksum) roll(out byte, in byte) {
+	c.a += uint32(in) - uint32(out)
+	c.b += c.a - c.length*uint32(out)
+}
+
+func (c *rollingChecksum) sum() uint32 {
+	return c.a&0xffff | c.b<<16
+}
+
+// findBlocks scans r for the blocks of index and returns the offset in r of
+// every block found, by block number. The end of r is zero padded like the
+// last block.
+func findBlocks(r io.Reader, index *BlockIndex) (map[int]int64, error) {
+	blockSize := index.BlockSize
+	byWeak := map[uint32][]int{}
+	for number, block := range index.Blocks {
+		byWeak[block.Weak] = append(byWeak[block.Weak], number)
+	}
+	found := map[int]int64{}
+	if len(index.Blocks) == 0 {
+		return found, nil
+	}
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+	// data past the end of r reads as zeros, eof is the offset of the end
+	eof := int64(-1)
+	var offset int64
+	next := func() (byte, error) {
+		value, err := reader.ReadByte()
+		if err == io.EOF {
+			if eof < 0 {
+				eof = offset
+			}
+			return 0, nil
+		}
+		offset++
+		return value, err
+	}
+	window := make([]byte, blockSize)
+	fill := func() error {
+		for i := range window {
+			value, err := next()
+			if err != nil {
+				return err
+			}
+			window[i] = value
+		}
+		return nil
+	}
+
+	if err := fill(); err != nil {
+		return nil, err
+	}
+	checksum := newRollingChecksum(window)
+	start := 0
+	var position int64
+	for eof < 0 || position < eof {
+		if numbers, ok := byWeak[checksum.sum()]; ok && unfound(numbers, found) {
+			hash := sha256.New()
+			hash.Write(window[start:])
+			hash.Write(window[:start])
+			strong := hash.Sum(nil)[:strongSize]
+			matched := false
+			for _, number := range numbers {
+				if _, ok := found[number]; !ok && bytes.Equal(strong, index.Blocks[number].Strong[:]) {
+					found[number] = position
+					matched = true
+				}
+			}
+			if matched {
+				if err := fill(); err != nil {
+					return nil, err
+				}
+				start = 0
+				checksum = newRollingChecksum(window)
+				position += int64(blockSize)
+				continue
+			}
+		}
+		in, err := next()
+		if err != nil {
+			return nil, err
+		}
+		checksum.roll(window[start], in)
+		window[start] = in
+		start = (start + 1) % blockSize
+		position++
+	}
+	return found, nil
+}
+
+func unfound(numbers []int, found map[int]int64) bool {
+	for _, number := range numbers {
+		if _, ok := found[number]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// DownloadDelta updates a file from url by fetching its block index from
+// url+DeltaSuffix, copying the blocks oldPath already has and fetching only
+// the rest in range requests. oldPath defaults to the file being replaced
+// and may be missing, the whole file is fetched then, as it is from servers
+// that ignore ranges. The result is checked against the digest of the index
+// before it replaces the file.
+func (d *Downloader) DownloadDelta(dirPath string, url string, oldPath string, concurrency int64) (*DeltaResult, error) {
+	fileName, err := d.FileUtils.GetFileNameFromURL(url)
+	if err != nil {
+		return nil, err
+	}
+	filePath := fmt.Sprintf("%s/%s", dirPath, fileName)
+	if oldPath == "" {
+		oldPath = filePath
+	}
+	check, err := d.signatureCheck(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := d.Client.ResumeGet(url+DeltaSuffix, 0)
+	if err != nil {
+		return nil, err
+	}
+	index, err := ReadBlockIndex(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s%s: %v", url, DeltaSuffix, err)
+	}
+
+	found := map[int]int64{}
+	old, err := d.fs().Open(oldPath)
+	if err == nil {
+		// closed before the new version replaces it
+		defer func() {
+			if old != nil {
+				old.Close()
+			}
+		}()
+		if found, err = findBlocks(old, index); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err = d.fs().MkdirAll(dirPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	partPath := filePath + partSuffix
+	part, err := d.fs().Create(partPath)
+	if err != nil {
+		return nil, err
+	}
+	result := &DeltaResult{Path: filePath, Size: index.Size}
+	err = d.assembleDelta(part, old, url, index, found, concurrency, result)
+	if err == errRangeIgnored {
+		*result = DeltaResult{Path: filePath, Size: index.Size, Ranges: 1}
+		result.Fetched, err = d.fetchWhole(part, url)
+	}
+	if closeErr := part.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		d.discardPart(partPath)
+		return nil, err
+	}
+	if old != nil {
+		old.Close()
+		old = nil
+	}
+	if err = d.commitPart(partPath, filePath, d.digestCheck(index.Digest), check.partCheck()); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// fetchWhole writes the whole file at url over part.
+func (d *Downloader) fetchWhole(part FSFile, url string) (int64, error) {
+	response, err := d.Client.ResumeGet(url, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if _, err = part.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(part, response.Body)
+}
+
+// assembleDelta writes the file described by index to part, copying the
+// found blocks from old and fetching the others.
+func (d *Downloader) assembleDelta(part FSFile, old FSFile, url string, index *BlockIndex, found map[int]int64, concurrency int64, result *DeltaResult) error {
+	if err := part.Truncate(index.Size); err != nil {
+		return err
+	}
+	blockSize := int64(index.BlockSize)
+	block := make([]byte, blockSize)
+	var missing [][2]int64
+	for number := range index.Blocks {
+		from := int64(number) * blockSize
+		to := from + blockSize - 1
+		if to >= index.Size {
+			to = index.Size - 1
+		}
+		offset, ok := found[number]
+		if !ok {
+			if last := len(missing) - 1; last >= 0 && missing[last][1]+1 == from && missing[last][1]-missing[last][0]+1 < maxDeltaRange {
+				missing[last][1] = to
+			} else {
+				missing = append(missing, [2]int64{from, to})
+			}
+			continue
+		}
+		data := block[:to-from+1]
+		// a match in the zero padding past the end of old
+		for i := range data {
+			data[i] = 0
+		}
+		if _, err := old.ReadAt(data, offset); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := part.WriteAt(data, from); err != nil {
+			return err
+		}
+		result.Reused += int64(len(data))
+	}
+	result.Ranges = len(missing)
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var mutex sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	tokens := make(chan struct{}, concurrency)
+	for _, missingRange := range missing {
+		tokens <- struct{}{}
+		wg.Add(1)
+		go func(from int64, to int64) {
+			defer func() {
+				<-tokens
+				wg.Done()
+			}()
+			// the digest of the index is checked instead of the version
+			data, err := d.fetchChunk(url, from, to, Validators{})
+			if err == nil {
+				_, err = part.WriteAt(data, from)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if err == nil {
+				result.Fetched += int64(len(data))
+			}
+		}(missingRange[0], missingRange[1])
+	}
+	wg.Wait()
+	return firstErr
+}
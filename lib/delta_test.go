@@ -0,0 +1,138 @@
+package lib_test
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func randomContent(seed int64, size int) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(content)
+	return content
+}
+
+func blockIndex(t *testing.T, content []byte, blockSize int) []byte {
+	index, err := lib.GenerateBlockIndex(bytes.NewReader(content), blockSize)
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	_, err = index.WriteTo(&buf)
+	assert.NoError(t, err)
+	return buf.Bytes()
+}
+
+// nightlyBuilds returns yesterday's build and today's, which has bytes
+// inserted, changed and appended.
+func nightlyBuilds() (old []byte, current []byte) {
+	old = randomContent(1, 200000)
+	current = append(current, old[:50000]...)
+	current = append(current, randomContent(2, 100)...)
+	current = append(current, old[50000:150000]...)
+	current = append(current, randomContent(3, 10)...)
+	current = append(current, old[150010:]...)
+	current = append(current, randomContent(4, 3000)...)
+	return old, current
+}
+
+func TestDownloadDeltaFetchesOnlyChangedBlocks(t *testing.T) {
+	old, current := nightlyBuilds()
+	server := newArtifactTestServer(map[string][]byte{"/image.bin": current, "/image.bin" + lib.DeltaSuffix: blockIndex(t, current, 1024)}, new(int32))
+	defer server.Close()
+	fs := &lib.MemFS{}
+	writeMemFile(t, fs, "images/image.bin", old)
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+	result, err := downloader.DownloadDelta("images", server.URL+"/image.bin", "", 4)
+	assert.NoError(t, err)
+	data, err := fs.ReadFile("images/image.bin")
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(current, data))
+	assert.Equal(t, int64(len(current)), result.Reused+result.Fetched)
+	// the blocks around the three changes
+	assert.True(t, result.Fetched <= 3*1024+3000+1024, "fetched %d bytes", result.Fetched)
+	assert.Equal(t, 3, result.Ranges)
+	assert.Equal(t, []string{"images/image.bin"}, fs.Files())
+}
+
+func TestDownloadDeltaWithoutOldVersion(t *testing.T) {
+	content := randomContent(5, 10000)
+	server := newArtifactTestServer(map[string][]byte{"/file.bin": content, "/file.bin" + lib.DeltaSuffix: blockIndex(t, content, 4096)}, new(int32))
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+	result, err := downloader.DownloadDelta("dl", server.URL+"/file.bin", "dl/missing.bin", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, &lib.DeltaResult{Path: "dl/file.bin", Size: 10000, Fetched: 10000, Ranges: 1}, result)
+	data, err := fs.ReadFile("dl/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestDownloadDeltaFetchesTheWholeFileWhenRangesAreIgnored(t *testing.T) {
+	old, current := nightlyBuilds()
+	files := map[string][]byte{"/image.bin": current, "/image.bin" + lib.DeltaSuffix: blockIndex(t, current, 1024)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(files[r.URL.Path])
+	}))
+	defer server.Close()
+	fs := &lib.MemFS{}
+	writeMemFile(t, fs, "images/image.bin", old)
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+	result, err := downloader.DownloadDelta("images", server.URL+"/image.bin", "", 4)
+	assert.NoError(t, err)
+	assert.Equal(t, &lib.DeltaResult{Path: "images/image.bin", Size: int64(len(current)), Fetched: int64(len(current)), Ranges: 1}, result)
+	data, err := fs.ReadFile("images/image.bin")
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(current, data))
+	assert.Equal(t, []string{"images/image.bin"}, fs.Files())
+}
+
+func TestDownloadDeltaKeepsOldVersionOnMismatch(t *testing.T) {
+	old, current := nightlyBuilds()
+	tampered := append([]byte{}, current...)
+	// inside the inserted bytes, which are fetched
+	tampered[50050]++
+	server := newArtifactTestServer(map[string][]byte{"/image.bin": tampered, "/image.bin" + lib.DeltaSuffix: blockIndex(t, current, 1024)}, new(int32))
+	defer server.Close()
+	fs := &lib.MemFS{}
+	writeMemFile(t, fs, "images/image.bin", old)
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+	_, err := downloader.DownloadDelta("images", server.URL+"/image.bin", "", 4)
+	assert.Error(t, err)
+	data, err := fs.ReadFile("images/image.bin")
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(old, data))
+	assert.Equal(t, []string{"images/image.bin"}, fs.Files())
+}
+
+func TestBlockIndexRoundTrip(t *testing.T) {
+	content := randomContent(6, 5000)
+	index, err := lib.GenerateBlockIndex(bytes.NewReader(content), 2048)
+	assert.NoError(t, err)
+	assert.Len(t, index.Blocks, 3)
+	assert.Equal(t, int64(5000), index.Size)
+
+	read, err := lib.ReadBlockIndex(bytes.NewReader(blockIndex(t, content, 2048)))
+	assert.NoError(t, err)
+	assert.Equal(t, index, read)
+
+	_, err = lib.ReadBlockIndex(bytes.NewReader(blockIndex(t, content, 2048)[:100]))
+	assert.Error(t, err)
+}
+
+func TestBlockIndexRefusesBlocksLargerThanOneMiB(t *testing.T) {
+	_, err := lib.GenerateBlockIndex(bytes.NewReader(randomContent(7, 100)), 2<<20)
+	assert.Error(t, err)
+
+	huge := bytes.Replace(blockIndex(t, randomContent(7, 100), 4096), []byte("Block-Size: 4096"), []byte("Block-Size: 2097152"), 1)
+	_, err = lib.ReadBlockIndex(bytes.NewReader(huge))
+	assert.EqualError(t, err, "invalid block index")
+}
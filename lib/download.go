@@ -2,8 +2,7 @@ package lib
 
 import (
 	"fmt"
-	"os"
-	"sort"
+	"strings"
 	"sync"
 )
 
@@ -12,142 +11,393 @@ type Download interface {
 	DownloadFileConcurrent(filepath string, url string, concurrency int64) error
 }
 
+// Downloader fetches files with Client and writes them through FileUtils,
+// on the FS of a File or the local disk for other FileUtils.
 type Downloader struct {
 	Client    Client
 	FileUtils FileUtils
+	// Cache is optional, when set DownloadFileConcurrent takes files from it
+	// and adds the ones it downloads.
+	Cache *Cache
+	// Hooks run on every file downloaded by DownloadFile,
+	// DownloadFileConcurrent, DownloadFileWithDigest and the JobQueue.
+	Hooks []Hook
+	// Verifier is optional, when set the files downloaded by these are only
+	// kept with a valid signature, which is fetched from next to them.
+	Verifier SignatureVerifier
 }
 
+// DownloadFile downloads url into filePath/<name>.part, continuing a part
+// left by an earlier attempt at the same file, and renames it to its name
+// once it is complete.
 func (d *Downloader) DownloadFile(filePath string, url string) error {
+	_, err := d.DownloadFileSingleWithResult(filePath, url)
+	return err
+}
+
+// DownloadFileSingleWithResult is DownloadFile telling where the file ended
+// up, who signed it and what the Hooks did. The result is also returned
+// when a hook failed.
+func (d *Downloader) DownloadFileSingleWithResult(filePath string, url string) (*DownloadResult, error) {
 	fileName, err := d.FileUtils.GetFileNameFromURL(url)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	absoluteFilePath := fmt.Sprintf("%s/%s", filePath, fileName)
+	check, err := d.signatureCheck(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	partName := fileName + partSuffix
+	partPath := fmt.Sprintf("%s/%s", filePath, partName)
 
-	fileSize, err := d.FileUtils.CreateFileIfNotExists(filePath, fileName)
+	fileSize, err := d.FileUtils.CreateFileIfNotExists(filePath, partName)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	meta := readPartMeta(d.fs(), partPath)
+	if fileSize > 0 && (meta == nil || meta.URL != url || (meta.ETag == "" && meta.LastModified.IsZero())) {
+		// left behind by a download we know nothing about, or of a file
+		// whose versions can't be told apart
+		if fileSize, err = d.restartPart(filePath, partName); err != nil {
+			return nil, err
+		}
 	}
 
 	response, err := d.Client.ResumeGet(url, fileSize)
+	restart := fileSize > 0 && err == errRangeIgnored
+	if err == nil && fileSize > 0 && !meta.sameVersion(response, fileSize) {
+		response.Body.Close()
+		restart = true
+	}
+	if restart {
+		if fileSize, err = d.restartPart(filePath, partName); err != nil {
+			return nil, err
+		}
+		response, err = d.Client.ResumeGet(url, fileSize)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer response.Body.Close()
+	if fileSize == 0 {
+		writePartMeta(d.fs(), partPath, newPartMeta(url, response, nil))
+	}
 
-	err = d.FileUtils.WriteToFile(response, absoluteFilePath)
+	err = d.FileUtils.WriteToFile(response, partPath)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err = d.commitPart(partPath, absoluteFilePath, d.digestCheck(response.Digest), check.partCheck()); err != nil {
+		return nil, err
 	}
+	return d.runHooks(url, absoluteFilePath, response.Digest, check.verifiedSigner())
+}
 
-	return nil
+// restartPart empties the part file partName so the download starts over.
+func (d *Downloader) restartPart(dirPath string, partName string) (int64, error) {
+	d.FileUtils.DeleteFile(fmt.Sprintf("%s/%s", dirPath, partName))
+	return d.FileUtils.CreateFileIfNotExists(dirPath, partName)
 }
 
 func (d *Downloader) DownloadFileConcurrent(dirPath string, url string, concurrency int64) error {
+	_, err := d.DownloadFileWithResult(dirPath, url, concurrency)
+	return err
+}
+
+// DownloadFileWithResult is DownloadFileConcurrent telling where the file
+// ended up, who signed it and what the Hooks did. The result is also
+// returned when a hook failed.
+func (d *Downloader) DownloadFileWithResult(dirPath string, url string, concurrency int64) (*DownloadResult, error) {
+	return d.downloadWithResult(dirPath, url, nil, concurrency)
+}
+
+// DownloadFileWithSignature is DownloadFileWithResult for a file whose
+// detached signature is given instead of fetched, it needs a Verifier.
+func (d *Downloader) DownloadFileWithSignature(dirPath string, url string, signature []byte, concurrency int64) (*DownloadResult, error) {
+	if signature == nil {
+		signature = []byte{}
+	}
+	return d.downloadWithResult(dirPath, url, signature, concurrency)
+}
+
+func (d *Downloader) downloadWithResult(dirPath string, url string, signature []byte, concurrency int64) (*DownloadResult, error) {
+	fileName, err := d.targetFileName(dirPath, url)
+	if err != nil {
+		return nil, err
+	}
+	check, err := d.signatureCheck(url, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	headResp, err := d.Client.Head(url)
+	if err != nil {
+		return nil, err
+	}
+	if d.Cache != nil {
+		err = d.downloadCached(dirPath, fileName, url, headResp, "", func() error {
+			return d.downloadParts(dirPath, fileName, url, concurrency, headResp, check.partCheck())
+		}, check.partCheck())
+	} else {
+		err = d.downloadParts(dirPath, fileName, url, concurrency, headResp, check.partCheck())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.runHooks(url, fmt.Sprintf("%s/%s", dirPath, fileName), headResp.Digest, check.verifiedSigner())
+}
+
+// DownloadFileWithDigest is DownloadFileWithResult for a file whose
+// "<algorithm>:<hex>" digest is known up front. A cached copy is used without
+// contacting the server.
+func (d *Downloader) DownloadFileWithDigest(dirPath string, url string, digest string, concurrency int64) (*DownloadResult, error) {
+	fileName, err := d.targetFileName(dirPath, url)
+	if err != nil {
+		return nil, err
+	}
+	filePath := fmt.Sprintf("%s/%s", dirPath, fileName)
+	check, err := d.signatureCheck(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.Cache != nil {
+		hit, err := d.Cache.fetch(d.fs(), filePath, []string{digest}, check.partCheck())
+		if err != nil {
+			return nil, err
+		}
+		if hit {
+			return d.runHooks(url, filePath, digest, check.verifiedSigner())
+		}
+	}
+
+	headResp, err := d.Client.Head(url)
+	if err != nil {
+		return nil, err
+	}
+	if d.Cache != nil {
+		err = d.downloadCached(dirPath, fileName, url, headResp, digest, func() error {
+			return d.downloadParts(dirPath, fileName, url, concurrency, headResp, d.digestCheck(digest), check.partCheck())
+		}, check.partCheck())
+	} else {
+		err = d.downloadParts(dirPath, fileName, url, concurrency, headResp, d.digestCheck(digest), check.partCheck())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.runHooks(url, filePath, digest, check.verifiedSigner())
+}
+
+// targetFileName is the name a download of url is saved under, existing
+// files are not overwritten.
+func (d *Downloader) targetFileName(dirPath string, url string) (string, error) {
 	fileName, err := d.FileUtils.GetFileNameFromURL(url)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	fileLocation := fmt.Sprintf("%s/%s", dirPath, fileName)
 	if d.FileUtils.FileExists(fileLocation) {
 		fileName = fmt.Sprintf("%s-(1)", fileName)
 	}
+	return fileName, nil
+}
 
-	headResp, err := d.Client.Head(url)
-	if err != nil {
+// downloadParts fetches the file described by headResp in concurrent ranges
+// and merges them into dirPath/fileName once it passes checks. Parts of an
+// earlier attempt at the same version of the file are continued.
+func (d *Downloader) downloadParts(dirPath string, fileName string, url string, concurrency int64, headResp *Response, checks ...partCheck) error {
+	rangeList := populateRangeList(headResp.ContentLength, concurrency, 0)
+	partPath := fmt.Sprintf("%s/%s%s", dirPath, fileName, partSuffix)
+	meta := newPartMeta(url, headResp, rangeList)
+	resume := readPartMeta(d.fs(), partPath).resumable(meta)
+	// the segments are merged into the part later, it is created up front so
+	// the directory for its metadata exists
+	if _, err := d.FileUtils.CreateFileIfNotExists(dirPath, fileName+partSuffix); err != nil {
 		return err
 	}
+	writePartMeta(d.fs(), partPath, meta)
+	return d.downloadSegments(dirPath, fileName, url, rangeList, headResp, resume, checks...)
+}
 
-	rangeList := populateRangeList(headResp.ContentLength, concurrency, 0)
-
+// downloadSegments fetches rangeList concurrently into part files and merges
+// them into dirPath/fileName.part, which is renamed to fileName once it
+// matches the digest of headResp and passes checks. With resume the part
+// files of an earlier attempt at the same ranges are continued instead of
+// being downloaded again. A server ignoring the ranges is read in one part.
+func (d *Downloader) downloadSegments(dirPath string, fileName string, url string, rangeList []string, headResp *Response, resume bool, checks ...partCheck) error {
 	//max value is concurrency + 1
 	noOfGoRoutines := len(rangeList)
 
-	filePartChan := make(chan string, noOfGoRoutines)
 	downloadErrChan := make(chan error, noOfGoRoutines)
 
 	var wg sync.WaitGroup
 	wg.Add(noOfGoRoutines)
 	for index, rangeHeader := range rangeList {
-		go download(&wg, downloadErrChan, filePartChan, dirPath, fileName, index, d, url, rangeHeader)
+		go download(&wg, downloadErrChan, dirPath, fileName, index, d, url, rangeHeader, resume)
 	}
 	wg.Wait()
 
 	close(downloadErrChan)
-	close(filePartChan)
 
-	for err = range downloadErrChan {
-		if err != nil {
-			return fmt.Errorf("unable to download filepart %v", err)
+	var firstErr error
+	for err := range downloadErrChan {
+		if err == errRangeIgnored && len(rangeList) > 1 {
+			// one part then, the rest of the segments are useless
+			for index := range rangeList {
+				d.FileUtils.DeleteFile(filePartPath(dirPath, fileName, index))
+			}
+			return d.downloadSegments(dirPath, fileName, url, []string{"0-"}, headResp, false, checks...)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
-
-	var fileParts []string
-	for filePart := range filePartChan {
-		fileParts = append(fileParts, filePart)
+	if firstErr != nil {
+		return fmt.Errorf("unable to download filepart %v", firstErr)
 	}
 
-	sort.Strings(fileParts)
-	err = d.FileUtils.MergeFiles(fileParts, dirPath, fileName)
+	// merged in the order of their ranges, sorting the names would put
+	// "10-" before "2-"
+	fileParts := make([]string, noOfGoRoutines)
+	for index := range rangeList {
+		fileParts[index] = filePartPath(dirPath, fileName, index)
+	}
+	partName := fileName + partSuffix
+	partPath := fmt.Sprintf("%s/%s", dirPath, partName)
+	// MergeFiles appends, drop what an interrupted merge left
+	d.FileUtils.DeleteFile(partPath)
+	err := d.FileUtils.MergeFiles(fileParts, dirPath, partName)
 	if err != nil {
 		return err
 	}
 
 	for _, filePartName := range fileParts {
-		err = os.Remove(filePartName)
+		err = d.FileUtils.DeleteFile(filePartName)
 		if err != nil {
 			println("unable to remove filePart: ", filePartName)
 		}
 	}
 
+	checks = append([]partCheck{d.digestCheck(headResp.Digest)}, checks...)
+	return d.commitPart(partPath, fmt.Sprintf("%s/%s", dirPath, fileName), checks...)
+}
+
+func (d *Downloader) verifyDigest(filePath string, digest string) error {
+	tokens := strings.SplitN(digest, ":", 2)
+	if len(tokens) != 2 {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	checksum, err := d.FileUtils.Checksum(filePath, tokens[0])
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(checksum, tokens[1]) {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s:%s", filePath, digest, tokens[0], checksum)
+	}
 	return nil
 }
 
-func download(wg *sync.WaitGroup, downloadErr chan error, filePart chan string,
+func filePartPath(dirPath string, fileName string, index int) string {
+	return fmt.Sprintf("%s/%d-%s", dirPath, index, fileName)
+}
+
+func download(wg *sync.WaitGroup, downloadErr chan error,
 	dirPath string, fileName string, index int, d *Downloader, url string,
-	rangeHeader string) {
+	rangeHeader string, resume bool) {
 	defer wg.Done()
 
-	absoluteFilePartPath := fmt.Sprintf("%s/%d-%s", dirPath, index, fileName)
-	//delete if filepart exists
-	d.FileUtils.DeleteFile(absoluteFilePartPath)
+	absoluteFilePartPath := filePartPath(dirPath, fileName, index)
+	if !resume {
+		//delete if filepart exists
+		d.FileUtils.DeleteFile(absoluteFilePartPath)
+	}
 	filePartName := fmt.Sprintf("%d-%s", index, fileName)
-	_, err := d.FileUtils.CreateFileIfNotExists(dirPath, filePartName)
+	partSize, err := d.FileUtils.CreateFileIfNotExists(dirPath, filePartName)
 	if err != nil {
 		downloadErr <- err
 		return
 	}
+	if resume && partSize > 0 {
+		remaining, err := remainingRange(rangeHeader, partSize)
+		if err != nil {
+			downloadErr <- err
+			return
+		}
+		if remaining == "" {
+			downloadErr <- nil
+			return
+		}
+		rangeHeader = remaining
+	}
 	response, err := d.Client.Get(url, rangeHeader)
 	if err != nil {
 		downloadErr <- err
 		return
 	}
+	defer response.Body.Close()
+	// the whole file, sent for a range starting at 0
+	if from, to, err := parseByteRange(rangeHeader); err == nil && to >= 0 && response.ContentLength >= 0 && response.ContentLength != to-from+1 {
+		downloadErr <- errRangeIgnored
+		return
+	}
 	err = d.FileUtils.WriteToFile(response, absoluteFilePartPath)
 	if err != nil {
 		downloadErr <- err
 		return
 	}
-	filePart <- absoluteFilePartPath
 	downloadErr <- err
 }
 
+// remainingRange is the part of rangeHeader still missing when done bytes of
+// it are on disk, empty once it is complete.
+func remainingRange(rangeHeader string, done int64) (string, error) {
+	from, to, err := parseByteRange(rangeHeader)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case to < 0:
+		return fmt.Sprintf("%d-", from+done), nil
+	case from+done == to+1:
+		return "", nil
+	case from+done > to+1:
+		return "", fmt.Errorf("part of range %s holds %d bytes", rangeHeader, done)
+	}
+	return fmt.Sprintf("%d-%d", from+done, to), nil
+}
+
 func populateRangeList(contentLength int64, concurrency int64, fileSize int64) []string {
-	rangeLimit := contentLength / concurrency
-	remainder := contentLength % concurrency
+	if contentLength < 0 {
+		// unknown length, a single open ended range
+		return []string{fmt.Sprintf("%d-", fileSize)}
+	}
+	remaining := contentLength - fileSize
+	if remaining <= 0 {
+		// nothing to fetch, the merged part is empty
+		return nil
+	}
+	if concurrency > remaining {
+		concurrency = remaining
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	rangeLimit := remaining / concurrency
+	remainder := remaining % concurrency
 	var rangeList []string
 	var i int64
 	var previousRange = fileSize
 	for i = 0; i < concurrency; i++ {
 		nextRange := previousRange + rangeLimit
 
-		byteRange := fmt.Sprintf("%d-%d", previousRange, nextRange)
+		byteRange := fmt.Sprintf("%d-%d", previousRange, nextRange-1)
 		rangeList = append(rangeList, byteRange)
-		previousRange = previousRange + rangeLimit
+		previousRange = nextRange
 	}
 	if remainder > 0 {
 		finalRange := previousRange + remainder
-		finalByteRange := fmt.Sprintf("%d-%d", previousRange, finalRange)
+		finalByteRange := fmt.Sprintf("%d-%d", previousRange, finalRange-1)
 		rangeList = append(rangeList, finalByteRange)
 	}
 	return rangeList
@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"testing"
 
 	"github.com/amithnair91/godownload/lib"
@@ -15,7 +14,7 @@ import (
 
 const concurrency = 1
 
-func setupConcurrent() (int64, string, string, string, string, string, *mocks.MockClient, *mocks.MockFileUtils, http.Response, string) {
+func setupConcurrent() (int64, string, string, string, string, string, *mocks.MockClient, *mocks.MockFileUtils, lib.Response, string) {
 	fileSize := int64(0)
 	url := "www.someurl.com/file.txt"
 	dirpath := "dirpath"
@@ -26,7 +25,7 @@ func setupConcurrent() (int64, string, string, string, string, string, *mocks.Mo
 	mockHttpClient := &mocks.MockClient{}
 	mockFileUtils := &mocks.MockFileUtils{}
 	content := bytes.NewBufferString("File Contents")
-	httpResponse := http.Response{Body: ioutil.NopCloser(content), ContentLength: int64(content.Len())}
+	httpResponse := lib.Response{Body: ioutil.NopCloser(content), ContentLength: int64(content.Len())}
 	return fileSize, url, dirpath, fileName, filePath, filePartPath, mockHttpClient, mockFileUtils, httpResponse, fileNamePart
 }
 
@@ -54,6 +53,7 @@ func TestDownloadFileConcurrentFailsWhenUnableToCreateFile(t *testing.T) {
 	mockFileUtils.On("GetFileNameFromURL", url).Return(fileName, nil)
 	mockFileUtils.On("FileExists", filePath).Return(false)
 	mockHttpClient.On("Head", url).Return(&httpResponse, nil)
+	mockFileUtils.On("CreateFileIfNotExists", dirPath, fileName+".part").Return(int64(0), nil)
 	mockFileUtils.On("DeleteFile", filePartPath).Return(nil)
 	mockFileUtils.On("CreateFileIfNotExists", dirPath, fileNamePart).Return(fileSize, createFileError)
 
@@ -92,7 +92,8 @@ func TestDownloadFileConcurrentFailsOnClientGetRequestFailure(t *testing.T) {
 	mockFileUtils.On("DeleteFile", filePartPath).Return(nil)
 	mockFileUtils.On("CreateFileIfNotExists", dirPath, fileNamePart).Return(fileSize, nil)
 	mockHttpClient.On("Head", url).Return(&httpResponse, nil)
-	mockHttpClient.On("Get", url, "0-13").Return(nil, clientError)
+	mockFileUtils.On("CreateFileIfNotExists", dirPath, fileName+".part").Return(int64(0), nil)
+	mockHttpClient.On("Get", url, "0-12").Return(nil, clientError)
 	downloader := lib.Downloader{Client: mockHttpClient, FileUtils: mockFileUtils}
 
 	err := downloader.DownloadFileConcurrent(dirPath, url, concurrency)
@@ -112,7 +113,8 @@ func TestDownloadFileConcurrentFailsOnWriteToFileError(t *testing.T) {
 	mockFileUtils.On("DeleteFile", filePartPath).Return(nil)
 	mockFileUtils.On("CreateFileIfNotExists", dirPath, fileNamePart).Return(fileSize, nil)
 	mockHttpClient.On("Head", url).Return(&httpResponse, nil)
-	mockHttpClient.On("Get", url, "0-13").Return(&httpResponse, nil)
+	mockFileUtils.On("CreateFileIfNotExists", dirPath, fileName+".part").Return(int64(0), nil)
+	mockHttpClient.On("Get", url, "0-12").Return(&httpResponse, nil)
 	mockFileUtils.On("WriteToFile", &httpResponse, filePartPath).Return(writeToFileError)
 
 	downloader := lib.Downloader{Client: mockHttpClient, FileUtils: mockFileUtils}
@@ -132,9 +134,11 @@ func TestDownloadFileConcurrentFailsOnMergeFileError(t *testing.T) {
 	mockFileUtils.On("DeleteFile", filePartPath).Return(errors.New("could not delete file as it does not exist"))
 	mockFileUtils.On("CreateFileIfNotExists", dirPath, fileNamePart).Return(fileSize, nil)
 	mockHttpClient.On("Head", url).Return(&httpResponse, nil)
-	mockHttpClient.On("Get", url, "0-13").Return(&httpResponse, nil)
+	mockFileUtils.On("CreateFileIfNotExists", dirPath, fileName+".part").Return(int64(0), nil)
+	mockHttpClient.On("Get", url, "0-12").Return(&httpResponse, nil)
 	mockFileUtils.On("WriteToFile", &httpResponse, filePartPath).Return(nil)
-	mockFileUtils.On("MergeFiles", []string{filePartPath}, dirPath, fileName).Return(errors.New(expectedError))
+	mockFileUtils.On("DeleteFile", filePath+".part").Return(nil)
+	mockFileUtils.On("MergeFiles", []string{filePartPath}, dirPath, fileName+".part").Return(errors.New(expectedError))
 
 	downloader := lib.Downloader{Client: mockHttpClient, FileUtils: mockFileUtils}
 
@@ -152,9 +156,12 @@ func TestDownloadFileConcurrentDoesNotFailOnDeleteFileError(t *testing.T) {
 	mockFileUtils.On("DeleteFile", filePartPath).Return(errors.New("could not delete file as it does not exist"))
 	mockFileUtils.On("CreateFileIfNotExists", dirPath, fileNamePart).Return(fileSize, nil)
 	mockHttpClient.On("Head", url).Return(&httpResponse, nil)
-	mockHttpClient.On("Get", url, "0-13").Return(&httpResponse, nil)
+	mockFileUtils.On("CreateFileIfNotExists", dirPath, fileName+".part").Return(int64(0), nil)
+	mockHttpClient.On("Get", url, "0-12").Return(&httpResponse, nil)
 	mockFileUtils.On("WriteToFile", &httpResponse, filePartPath).Return(nil)
-	mockFileUtils.On("MergeFiles", []string{filePartPath}, dirPath, fileName).Return(nil)
+	mockFileUtils.On("DeleteFile", filePath+".part").Return(nil)
+	mockFileUtils.On("MergeFiles", []string{filePartPath}, dirPath, fileName+".part").Return(nil)
+	mockFileUtils.On("CommitFile", filePath+".part", filePath).Return(nil)
 
 	downloader := lib.Downloader{Client: mockHttpClient, FileUtils: mockFileUtils}
 
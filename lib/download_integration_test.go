@@ -1,62 +1,184 @@
 package lib_test
 
 import (
+	"bytes"
 	"fmt"
-	"os"
-	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/amithnair91/godownload/lib"
+	"github.com/amithnair91/godownload/testserver"
 	"github.com/stretchr/testify/assert"
 )
 
+func newIntegrationDownloader(client lib.Client) (lib.Downloader, *lib.MemFS) {
+	if client == nil {
+		httpClient := &lib.HTTPClient{}
+		httpClient.NewHttpClient()
+		client = httpClient
+	}
+	fs := &lib.MemFS{}
+	return lib.Downloader{Client: client, FileUtils: &lib.File{FS: fs}}, fs
+}
+
+func assertDownloaded(t *testing.T, fs *lib.MemFS, name string, content []byte) {
+	data, err := fs.ReadFile(name)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(content, data), "%s differs from the served file", name)
+	assert.Equal(t, []string{name}, fs.Files())
+}
+
 func TestDownloadSuccess(t *testing.T) {
-	pwd, err := os.Getwd()
+	server := testserver.New(testserver.Options{Redirects: 2, Digest: true})
+	defer server.Close()
+	content := randomContent(10, 100000)
+	url := server.Add("Sample-Spreadsheet-10000-rows.xls", content)
+	downloader, fs := newIntegrationDownloader(nil)
+
+	err := downloader.DownloadFile("dl", url)
 
 	assert.NoError(t, err)
+	assertDownloaded(t, fs, "dl/Sample-Spreadsheet-10000-rows.xls", content)
+	assert.Len(t, server.Requests(), 3)
+}
 
-	fileName := "Sample-Spreadsheet-10000-rows.xls"
-	url := "https://www.sample-videos.com/xls/Sample-Spreadsheet-10000-rows.xls"
-	filePath := filepath.FromSlash(fmt.Sprintf("%s/%s", pwd, fileName))
-	file := lib.File{}
-	client := lib.HTTPClient{}
-	client.NewHttpClient()
-	downloader := lib.Downloader{FileUtils: &file, Client: &client}
+func TestDownloadConcurrentSuccess(t *testing.T) {
+	server := testserver.New(testserver.Options{Digest: true})
+	defer server.Close()
+	content := randomContent(11, 100003)
+	url := server.Add("Sample-Spreadsheet-10000-rows.xls", content)
+	downloader, fs := newIntegrationDownloader(nil)
 
-	err = downloader.DownloadFile(pwd, url)
+	// more than 10 parts, which are merged in the order of their ranges
+	err := downloader.DownloadFileConcurrent("dl", url, 12)
 
 	assert.NoError(t, err)
-	assert.FileExists(t, filePath)
+	assertDownloaded(t, fs, "dl/Sample-Spreadsheet-10000-rows.xls", content)
+}
+
+func TestDownloadConcurrentIgnoredRange(t *testing.T) {
+	server := testserver.New(testserver.Options{IgnoreRange: true})
+	defer server.Close()
+	content := randomContent(12, 50000)
+	url := server.Add("file.bin", content)
+	downloader, fs := newIntegrationDownloader(nil)
 
-	err = os.Remove(filePath)
+	err := downloader.DownloadFileConcurrent("dl", url, 4)
 
 	assert.NoError(t, err)
+	assertDownloaded(t, fs, "dl/file.bin", content)
+	requests := server.Requests()
+	assert.Equal(t, "bytes=0-", requests[len(requests)-1].Range)
 }
 
-func TestDownloadConcurrentSuccess(t *testing.T) {
-	pwd, err := os.Getwd()
+func TestDownloadConcurrentWrongContentRange(t *testing.T) {
+	server := testserver.New(testserver.Options{WrongContentRange: true})
+	defer server.Close()
+	url := server.Add("file.bin", randomContent(13, 50000))
+	downloader, fs := newIntegrationDownloader(nil)
 
+	err := downloader.DownloadFileConcurrent("dl", url, 4)
+
+	assert.Error(t, err)
+	assert.NotContains(t, fs.Files(), "dl/file.bin")
+}
+
+func TestDownloadResumesAfterConnectionReset(t *testing.T) {
+	server := testserver.New(testserver.Options{ResetAfter: 30000, Resets: 1})
+	defer server.Close()
+	content := randomContent(14, 100000)
+	url := server.Add("file.bin", content)
+	downloader, fs := newIntegrationDownloader(nil)
+
+	assert.Error(t, downloader.DownloadFile("dl", url))
+	part, err := fs.ReadFile("dl/file.bin.part")
 	assert.NoError(t, err)
+	assert.True(t, len(part) > 0 && len(part) <= 30000, "part holds %d bytes", len(part))
+
+	assert.NoError(t, downloader.DownloadFile("dl", url))
+	assertDownloaded(t, fs, "dl/file.bin", content)
+	requests := server.Requests()
+	assert.Equal(t, fmt.Sprintf("bytes=%d-", len(part)), requests[len(requests)-1].Range)
+}
 
-	fileName := "Sample-Spreadsheet-10000-rows.xls"
-	url := "https://www.sample-videos.com/xls/Sample-Spreadsheet-10000-rows.xls"
-	filePath := filepath.FromSlash(fmt.Sprintf("%s/%s", pwd, fileName))
-	file := lib.File{}
-	client := lib.HTTPClient{}
-	client.NewHttpClient()
-	downloader := lib.Downloader{FileUtils: &file, Client: &client}
+func TestDownloadRestartsWhenETagChanges(t *testing.T) {
+	server := testserver.New(testserver.Options{ResetAfter: 30000, Resets: 1, ChangeETag: true})
+	defer server.Close()
+	content := randomContent(15, 100000)
+	url := server.Add("file.bin", content)
+	downloader, fs := newIntegrationDownloader(nil)
 
-	var filePartNames []string
-	var i int
-	for i = 0; i < concurrency; i++ {
-		filePartNames = append(filePartNames, fmt.Sprintf("%s-%d", fileName, i))
+	assert.Error(t, downloader.DownloadFile("dl", url))
+	assert.NoError(t, downloader.DownloadFile("dl", url))
+
+	assertDownloaded(t, fs, "dl/file.bin", content)
+	var ranges []string
+	for _, request := range server.Requests() {
+		ranges = append(ranges, request.Range)
 	}
+	assert.Equal(t, "bytes=0-", ranges[0])
+	assert.NotEqual(t, "bytes=0-", ranges[1])
+	assert.Equal(t, "bytes=0-", ranges[2])
+}
+
+func TestDownloadSlowDrip(t *testing.T) {
+	server := testserver.New(testserver.Options{Rate: 500000})
+	defer server.Close()
+	content := randomContent(16, 20000)
+	url := server.Add("file.bin", content)
+	downloader, fs := newIntegrationDownloader(nil)
 
-	err = downloader.DownloadFileConcurrent(pwd, url, 6)
+	start := time.Now()
+	err := downloader.DownloadFileConcurrent("dl", url, 4)
 
 	assert.NoError(t, err)
-	assert.FileExists(t, filePath)
+	assertDownloaded(t, fs, "dl/file.bin", content)
+	assert.True(t, time.Since(start) >= 10*time.Millisecond, "took %v", time.Since(start))
+}
+
+func TestDownloadRetriesTooManyRequests(t *testing.T) {
+	server := testserver.New(testserver.Options{TooManyRequests: 1, RetryAfter: 1})
+	defer server.Close()
+	content := randomContent(17, 10000)
+	url := server.Add("file.bin", content)
+	httpClient := &lib.HTTPClient{}
+	httpClient.NewHttpClient()
+	downloader, fs := newIntegrationDownloader(&lib.RetryClient{Client: httpClient, Backoff: time.Millisecond})
+
+	start := time.Now()
+	err := downloader.DownloadFileConcurrent("dl", url, 2)
 
-	err = os.Remove(filePath)
 	assert.NoError(t, err)
+	assertDownloaded(t, fs, "dl/file.bin", content)
+	assert.True(t, time.Since(start) >= time.Second, "took %v", time.Since(start))
+}
+
+func TestDownloadGzipEncoded(t *testing.T) {
+	server := testserver.New(testserver.Options{Gzip: true})
+	defer server.Close()
+	content := testContent(50000)
+	url := server.Add("file.bin", content)
+	downloader, fs := newIntegrationDownloader(nil)
+
+	err := downloader.DownloadFileConcurrent("dl", url, 4)
+
+	assert.NoError(t, err)
+	assertDownloaded(t, fs, "dl/file.bin", content)
+	requests := server.Requests()
+	assert.Equal(t, "bytes=0-", requests[len(requests)-1].Range)
+}
+
+func TestDownloadConcurrentEmptyFile(t *testing.T) {
+	server := testserver.New(testserver.Options{})
+	defer server.Close()
+	url := server.Add("empty.bin", []byte{})
+	downloader, fs := newIntegrationDownloader(nil)
+
+	err := downloader.DownloadFileConcurrent("dl", url, 4)
+
+	assert.NoError(t, err)
+	assertDownloaded(t, fs, "dl/empty.bin", []byte{})
+	for _, request := range server.Requests() {
+		assert.Equal(t, "HEAD", request.Method)
+	}
 }
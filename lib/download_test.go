@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"testing"
 
 	"github.com/amithnair91/godownload/lib"
@@ -13,7 +12,7 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func setup() (int64, string, string, string, string, *mocks.MockClient, *mocks.MockFileUtils, http.Response) {
+func setup() (int64, string, string, string, string, *mocks.MockClient, *mocks.MockFileUtils, lib.Response) {
 	fileSize := int64(0)
 	url := "www.someurl.com/file.txt"
 	filepath := "filepath"
@@ -22,7 +21,7 @@ func setup() (int64, string, string, string, string, *mocks.MockClient, *mocks.M
 	mockHttpClient := &mocks.MockClient{}
 	mockFileUtils := &mocks.MockFileUtils{}
 	content := bytes.NewBufferString("File Contents")
-	httpResponse := http.Response{Body: ioutil.NopCloser(content), ContentLength: int64(content.Len())}
+	httpResponse := lib.Response{Body: ioutil.NopCloser(content), ContentLength: int64(content.Len())}
 	return fileSize, url, filepath, fileName, absoluteFilePath, mockHttpClient, mockFileUtils, httpResponse
 }
 
@@ -47,7 +46,7 @@ func TestDownloadFileFailsOnClientGetRequestFailure(t *testing.T) {
 	expectedError := "client failure"
 
 	mockFileUtils.On("GetFileNameFromURL", url).Return(fileName, nil)
-	mockFileUtils.On("CreateFileIfNotExists", filepath, fileName).Return(fileSize, nil)
+	mockFileUtils.On("CreateFileIfNotExists", filepath, fileName+".part").Return(fileSize, nil)
 	mockHttpClient.On("ResumeGet", url, fileSize).Return(nil, errors.New(expectedError))
 	downloader := lib.Downloader{Client: mockHttpClient, FileUtils: mockFileUtils}
 
@@ -63,7 +62,7 @@ func TestDownloadFileFailsWhenUnableToCreateFile(t *testing.T) {
 	expectedError := "file activity failure"
 
 	mockFileUtils.On("GetFileNameFromURL", url).Return(fileName, nil)
-	mockFileUtils.On("CreateFileIfNotExists", filepath, fileName).Return(fileSize, errors.New(expectedError))
+	mockFileUtils.On("CreateFileIfNotExists", filepath, fileName+".part").Return(fileSize, errors.New(expectedError))
 
 	downloader := lib.Downloader{Client: mockHttpClient, FileUtils: mockFileUtils}
 
@@ -78,9 +77,9 @@ func TestDownloadFileFailsOnWriteToFileError(t *testing.T) {
 	expectedError := "unable to write to file"
 
 	mockFileUtils.On("GetFileNameFromURL", url).Return(fileName, nil)
-	mockFileUtils.On("CreateFileIfNotExists", filepath, fileName).Return(fileSize, nil)
+	mockFileUtils.On("CreateFileIfNotExists", filepath, fileName+".part").Return(fileSize, nil)
 	mockHttpClient.On("ResumeGet", url, fileSize).Return(&httpResponse, nil)
-	mockFileUtils.On("WriteToFile", &httpResponse, absoluteFilePath).Return(errors.New(expectedError))
+	mockFileUtils.On("WriteToFile", &httpResponse, absoluteFilePath+".part").Return(errors.New(expectedError))
 
 	downloader := lib.Downloader{Client: mockHttpClient, FileUtils: mockFileUtils}
 
@@ -89,3 +88,38 @@ func TestDownloadFileFailsOnWriteToFileError(t *testing.T) {
 	assert.EqualError(t, err, expectedError)
 	mockFileUtils.Mock.AssertExpectations(t)
 }
+
+func TestDownloadFileFailsOnChecksumMismatch(t *testing.T) {
+	fileSize, url, filepath, fileName, absoluteFilePath, mockHttpClient, mockFileUtils, httpResponse := setup()
+	httpResponse.Digest = "sha256:abcd"
+	expectedError := fmt.Sprintf("checksum mismatch for %s: expected sha256:abcd, got sha256:ef01", absoluteFilePath+".part")
+
+	mockFileUtils.On("GetFileNameFromURL", url).Return(fileName, nil)
+	mockFileUtils.On("CreateFileIfNotExists", filepath, fileName+".part").Return(fileSize, nil)
+	mockHttpClient.On("ResumeGet", url, fileSize).Return(&httpResponse, nil)
+	mockFileUtils.On("WriteToFile", &httpResponse, absoluteFilePath+".part").Return(nil)
+	mockFileUtils.On("Checksum", absoluteFilePath+".part", "sha256").Return("ef01", nil)
+	mockFileUtils.On("DeleteFile", absoluteFilePath+".part").Return(nil)
+
+	downloader := lib.Downloader{Client: mockHttpClient, FileUtils: mockFileUtils}
+
+	err := downloader.DownloadFile(filepath, url)
+	assert.EqualError(t, err, expectedError)
+	mockFileUtils.Mock.AssertExpectations(t)
+}
+
+func TestDownloadFileRenamesPartWhenComplete(t *testing.T) {
+	fileSize, url, filepath, fileName, absoluteFilePath, mockHttpClient, mockFileUtils, httpResponse := setup()
+
+	mockFileUtils.On("GetFileNameFromURL", url).Return(fileName, nil)
+	mockFileUtils.On("CreateFileIfNotExists", filepath, fileName+".part").Return(fileSize, nil)
+	mockHttpClient.On("ResumeGet", url, fileSize).Return(&httpResponse, nil)
+	mockFileUtils.On("WriteToFile", &httpResponse, absoluteFilePath+".part").Return(nil)
+	mockFileUtils.On("CommitFile", absoluteFilePath+".part", absoluteFilePath).Return(nil)
+
+	downloader := lib.Downloader{Client: mockHttpClient, FileUtils: mockFileUtils}
+
+	err := downloader.DownloadFile(filepath, url)
+	assert.NoError(t, err)
+	mockFileUtils.Mock.AssertExpectations(t)
+}
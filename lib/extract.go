@@ -0,0 +1,500 @@
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExtractOptions control which entries of an archive are unpacked and where.
+type ExtractOptions struct {
+	// StripComponents leading path elements are removed from every entry
+	// name, entries that have no more are skipped.
+	StripComponents int
+	// Include and Exclude are path.Match patterns for the stripped names. An
+	// entry matches when the pattern matches it or one of its directories.
+	// With Include only matching entries are unpacked, Exclude wins.
+	Include []string
+	Exclude []string
+}
+
+var archiveSuffixes = []struct {
+	suffix string
+	format string
+}{
+	{".tar.gz", "tar.gz"},
+	{".tgz", "tar.gz"},
+	{".tar.xz", "tar.xz"},
+	{".txz", "tar.xz"},
+	{".tar.zst", "tar.zst"},
+	{".tzst", "tar.zst"},
+	{".tar.bz2", "tar.bz2"},
+	{".tbz2", "tar.bz2"},
+	{".tar", "tar"},
+	{".zip", "zip"},
+}
+
+// ArchiveFormat is the format of an archive named name, "zip", "tar",
+// "tar.gz", "tar.bz2", "tar.xz" or "tar.zst", empty when it isn't one of them.
+func ArchiveFormat(name string) string {
+	name = strings.ToLower(strings.SplitN(name, "?", 2)[0])
+	for _, archive := range archiveSuffixes {
+		if strings.HasSuffix(name, archive.suffix) {
+			return archive.format
+		}
+	}
+	return ""
+}
+
+// DownloadAndExtract unpacks the archive at url into destDir. Tar archives
+// are unpacked while they download, zip archives need their directory at the
+// end and are downloaded next to their entries first. With a Verifier tar
+// archives are downloaded first too, nothing is unpacked before their
+// signature is checked.
+func (d *Downloader) DownloadAndExtract(destDir string, url string, concurrency int64, options ExtractOptions) error {
+	fileName, err := d.FileUtils.GetFileNameFromURL(url)
+	if err != nil {
+		return err
+	}
+	format := ArchiveFormat(fileName)
+	if format == "" {
+		return fmt.Errorf("unable to extract %s: unknown archive format", fileName)
+	}
+	if err = d.fs().MkdirAll(destDir, os.ModePerm); err != nil {
+		return err
+	}
+	check, err := d.signatureCheck(url, nil)
+	if err != nil {
+		return err
+	}
+	if format != "zip" && check == nil {
+		return d.streamExtract(destDir, url, format, concurrency, options)
+	}
+
+	archivePath, err := d.downloadChecked(destDir, "."+fileName, url, concurrency, check.partCheck())
+	if err != nil {
+		return err
+	}
+	defer d.FileUtils.DeleteFile(archivePath)
+	return ExtractArchive(d.fs(), archivePath, destDir, options)
+}
+
+// downloadChecked saves url as dirPath/name once it passes checks, through
+// the Cache when there is one, and returns its path.
+func (d *Downloader) downloadChecked(dirPath string, name string, url string, concurrency int64, checks ...partCheck) (string, error) {
+	headResp, err := d.Client.Head(url)
+	if err != nil {
+		return "", err
+	}
+	download := func() error {
+		return d.downloadParts(dirPath, name, url, concurrency, headResp, checks...)
+	}
+	if d.Cache != nil {
+		err = d.downloadCached(dirPath, name, url, headResp, "", download, checks...)
+	} else {
+		err = download()
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s", dirPath, name), nil
+}
+
+func (d *Downloader) streamExtract(destDir string, url string, format string, concurrency int64, options ExtractOptions) error {
+	return d.downloadPipe(url, concurrency, func(r io.Reader) error {
+		return ExtractTar(d.fs(), r, format, destDir, options)
+	})
+}
+
+// ExtractArchive unpacks the archive archivePath on fs into destDir, its
+// format is taken from its name.
+func ExtractArchive(fs FS, archivePath string, destDir string, options ExtractOptions) error {
+	format := ArchiveFormat(archivePath)
+	if format == "" {
+		return fmt.Errorf("unable to extract %s: unknown archive format", archivePath)
+	}
+	file, err := fs.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if format != "zip" {
+		return ExtractTar(fs, file, format, destDir, options)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return extractZip(fs, file, info.Size(), destDir, options)
+}
+
+// ExtractTar unpacks the tar stream r, compressed according to format, into
+// destDir on fs.
+func ExtractTar(fs FS, r io.Reader, format string, destDir string, options ExtractOptions) error {
+	decompressed, err := decompress(r, format)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	e := newExtractor(fs, destDir, options)
+	archive := tar.NewReader(decompressed)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		mode := header.FileInfo().Mode()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.dir(header.Name, mode)
+		case tar.TypeReg:
+			err = e.file(header.Name, mode, header.ModTime, archive)
+		case tar.TypeSymlink:
+			err = e.symlink(header.Name, header.Linkname)
+		case tar.TypeLink:
+			err = e.hardlink(header.Name, header.Linkname, mode, header.ModTime)
+		}
+		// devices, fifos and the like are skipped
+		if err != nil {
+			return err
+		}
+	}
+	return e.finish()
+}
+
+func decompress(r io.Reader, format string) (io.ReadCloser, error) {
+	if format == "tar" {
+		return ioutil.NopCloser(r), nil
+	}
+	compression, _ := Decompressed(format)
+	if compression == "" {
+		return nil, fmt.Errorf("unsupported tar format %q", format)
+	}
+	return newDecompressor(r, compression)
+}
+
+func extractZip(fs FS, r io.ReaderAt, size int64, destDir string, options ExtractOptions) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	e := newExtractor(fs, destDir, options)
+	for _, entry := range archive.File {
+		mode := entry.Mode()
+		switch {
+		case mode.IsDir():
+			err = e.dir(entry.Name, mode)
+		case mode&os.ModeSymlink != 0:
+			err = e.zipSymlink(entry)
+		case mode.IsRegular():
+			err = e.zipFile(entry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return e.finish()
+}
+
+// extractor writes the entries of an archive below destDir and refuses the
+// ones that would end up outside of it.
+type extractor struct {
+	fs      FS
+	destDir string
+	options ExtractOptions
+	// links are the targets of the symlinks written so far by their case
+	// folded names, nothing is written through them
+	links map[string]string
+	// dirModes are applied at the end, a read-only directory would keep its
+	// entries from being written
+	dirModes map[string]os.FileMode
+}
+
+func newExtractor(fs FS, destDir string, options ExtractOptions) *extractor {
+	return &extractor{fs: fs, destDir: filepath.ToSlash(destDir), options: options, links: map[string]string{}, dirModes: map[string]os.FileMode{}}
+}
+
+// entryPath turns an entry name into its stripped name below destDir, empty
+// when the entry is skipped.
+func (e *extractor) entryPath(name string) (string, error) {
+	rel, err := e.relative(name)
+	if err != nil || rel == "" || !e.included(rel) {
+		return "", err
+	}
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		if _, ok := e.links[fold(dir)]; ok {
+			return "", fmt.Errorf("archive entry %s is inside the symlink %s", name, dir)
+		}
+	}
+	if err = e.checkOnDisk(name, path.Dir(rel)); err != nil {
+		return "", err
+	}
+	return rel, nil
+}
+
+// fold is the name a case insensitive filesystem sees, so a link can't be
+// written through by changing the case of its name.
+func fold(rel string) string {
+	return strings.ToLower(rel)
+}
+
+// checkOnDisk refuses the entry name when rel or a directory above it is a
+// symlink on disk, which writing below it would follow: a link left by an
+// earlier extraction, or one whose name differs only in case.
+func (e *extractor) checkOnDisk(name string, rel string) error {
+	if rel == "." {
+		return nil
+	}
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		dir := path.Join(parts[:i+1]...)
+		info, err := e.fs.Lstat(e.target(dir))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("archive entry %s is inside the symlink %s", name, dir)
+		}
+	}
+	return nil
+}
+
+func (e *extractor) relative(name string) (string, error) {
+	cleaned := path.Clean(strings.Replace(name, `\`, "/", -1))
+	if escapes(cleaned) {
+		return "", fmt.Errorf("archive entry %s is outside the destination", name)
+	}
+	parts := strings.Split(cleaned, "/")
+	if cleaned == "." || len(parts) <= e.options.StripComponents {
+		return "", nil
+	}
+	return path.Join(parts[e.options.StripComponents:]...), nil
+}
+
+// escapes reports whether the clean slash separated path name leaves the
+// directory it is relative to.
+func escapes(name string) bool {
+	return name == ".." || strings.HasPrefix(name, "../") || absolute(name)
+}
+
+// absolute reports whether name is absolute here or on Windows.
+func absolute(name string) bool {
+	return path.IsAbs(name) || (len(name) >= 2 && name[1] == ':')
+}
+
+func (e *extractor) included(rel string) bool {
+	if len(e.options.Include) > 0 && !matchesAny(rel, e.options.Include, entryMatch) {
+		return false
+	}
+	return !matchesAny(rel, e.options.Exclude, entryMatch)
+}
+
+// entryMatch reports whether pattern matches rel or one of its directories.
+func entryMatch(rel string, pattern string) bool {
+	for name := rel; name != "."; name = path.Dir(name) {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *extractor) target(rel string) string {
+	return path.Join(e.destDir, rel)
+}
+
+func (e *extractor) dir(name string, mode os.FileMode) error {
+	rel, err := e.entryPath(name)
+	if err != nil || rel == "" {
+		return err
+	}
+	if err = e.checkOnDisk(name, rel); err != nil {
+		return err
+	}
+	if err = e.fs.MkdirAll(e.target(rel), 0755); err != nil {
+		return err
+	}
+	e.dirModes[rel] = mode.Perm()
+	return nil
+}
+
+func (e *extractor) file(name string, mode os.FileMode, modTime time.Time, content io.Reader) error {
+	rel, err := e.entryPath(name)
+	if err != nil || rel == "" {
+		return err
+	}
+	target, err := e.create(rel)
+	if err != nil {
+		return err
+	}
+	out, err := e.fs.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, content); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return e.finishFile(target, mode, modTime)
+}
+
+func (e *extractor) zipFile(entry *zip.File) error {
+	content, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return e.file(entry.Name, entry.Mode(), entry.Modified, content)
+}
+
+func (e *extractor) symlink(name string, linkName string) error {
+	rel, err := e.entryPath(name)
+	if err != nil || rel == "" {
+		return err
+	}
+	linkName = strings.Replace(linkName, `\`, "/", -1)
+	previous, replaced := e.links[fold(rel)]
+	e.links[fold(rel)] = linkName
+	// a new link can also change where the earlier ones lead
+	for link := range e.links {
+		if !e.within(link) {
+			if replaced {
+				e.links[fold(rel)] = previous
+			} else {
+				delete(e.links, fold(rel))
+			}
+			return fmt.Errorf("archive entry %s links to %s outside the destination", name, linkName)
+		}
+	}
+	target, err := e.create(rel)
+	if err != nil {
+		return err
+	}
+	return e.fs.Symlink(linkName, target)
+}
+
+// within reports whether following the symlink with the folded name rel
+// through the links written so far stays below destDir, resolving ".."
+// after a link the way the OS does and not lexically. Other links already on
+// disk aren't followed.
+func (e *extractor) within(rel string) bool {
+	var resolved []string
+	pending := append(strings.Split(path.Dir(rel), "/"), strings.Split(e.links[rel], "/")...)
+	if absolute(e.links[rel]) {
+		return false
+	}
+	for hops := 0; len(pending) > 0; {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+		case "..":
+			if len(resolved) == 0 {
+				return false
+			}
+			resolved = resolved[:len(resolved)-1]
+		default:
+			next := path.Join(path.Join(resolved...), part)
+			linkName, ok := e.links[fold(next)]
+			if !ok {
+				// where a link left on disk leads isn't known
+				if info, err := e.fs.Lstat(e.target(next)); err == nil && info.Mode()&os.ModeSymlink != 0 {
+					return false
+				}
+				resolved = append(resolved, part)
+				continue
+			}
+			// a loop fails on disk too, but is refused right away
+			if hops++; hops > 40 || absolute(linkName) {
+				return false
+			}
+			pending = append(strings.Split(linkName, "/"), pending...)
+		}
+	}
+	return true
+}
+
+func (e *extractor) zipSymlink(entry *zip.File) error {
+	content, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	linkName, err := ioutil.ReadAll(io.LimitReader(content, 4096))
+	if err != nil {
+		return err
+	}
+	return e.symlink(entry.Name, string(linkName))
+}
+
+// hardlink copies the entry linkName was written to, the FS has no hard
+// links.
+func (e *extractor) hardlink(name string, linkName string, mode os.FileMode, modTime time.Time) error {
+	source, err := e.entryPath(linkName)
+	if err != nil || source == "" {
+		return err
+	}
+	if _, ok := e.links[fold(source)]; ok {
+		return fmt.Errorf("archive entry %s links to the symlink %s", name, linkName)
+	}
+	in, err := e.fs.Open(e.target(source))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return e.file(name, mode, modTime, in)
+}
+
+// create makes the directory for rel and removes what is in its place, so
+// an existing symlink isn't written through.
+func (e *extractor) create(rel string) (string, error) {
+	target := e.target(rel)
+	if err := e.fs.MkdirAll(path.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	e.fs.Remove(target)
+	return target, nil
+}
+
+func (e *extractor) finishFile(target string, mode os.FileMode, modTime time.Time) error {
+	if err := e.fs.Chmod(target, mode.Perm()); err != nil {
+		return err
+	}
+	if modTime.IsZero() {
+		return nil
+	}
+	return e.fs.Chtimes(target, modTime, modTime)
+}
+
+// finish applies the directory permissions, deepest first.
+func (e *extractor) finish() error {
+	var dirs []string
+	for rel := range e.dirModes {
+		dirs = append(dirs, rel)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, rel := range dirs {
+		if err := e.fs.Chmod(e.target(rel), e.dirModes[rel]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
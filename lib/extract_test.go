@@ -0,0 +1,252 @@
+package lib_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+type archiveEntry struct {
+	name     string
+	body     string
+	mode     int64
+	linkName string
+	dir      bool
+}
+
+func buildTar(t *testing.T, format string, entries []archiveEntry) []byte {
+	var buf bytes.Buffer
+	var out io.WriteCloser
+	var err error
+	switch format {
+	case "tar":
+		out = nopWriteCloser{&buf}
+	case "tar.gz":
+		out = gzip.NewWriter(&buf)
+	case "tar.xz":
+		out, err = xz.NewWriter(&buf)
+	case "tar.zst":
+		out, err = zstd.NewWriter(&buf)
+	}
+	assert.NoError(t, err)
+	archive := tar.NewWriter(out)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: entry.mode, Size: int64(len(entry.body)), ModTime: time.Unix(1500000000, 0), Typeflag: tar.TypeReg}
+		switch {
+		case entry.dir:
+			header.Typeflag = tar.TypeDir
+		case entry.linkName != "":
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, entry.linkName, 0
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		assert.NoError(t, archive.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			archive.Write([]byte(entry.body))
+		}
+	}
+	assert.NoError(t, archive.Close())
+	assert.NoError(t, out.Close())
+	return buf.Bytes()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func buildZip(t *testing.T, entries []archiveEntry) []byte {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		mode := os.FileMode(entry.mode)
+		if mode == 0 {
+			mode = 0644
+		}
+		body := entry.body
+		switch {
+		case entry.dir:
+			mode |= os.ModeDir
+		case entry.linkName != "":
+			mode, body = os.ModeSymlink|0777, entry.linkName
+		}
+		header.SetMode(mode)
+		w, err := archive.CreateHeader(header)
+		assert.NoError(t, err)
+		w.Write([]byte(body))
+	}
+	assert.NoError(t, archive.Close())
+	return buf.Bytes()
+}
+
+var testArchiveEntries = []archiveEntry{
+	{name: "project-1.0/", dir: true},
+	{name: "project-1.0/README", body: "read me"},
+	{name: "project-1.0/bin/tool", body: "#!/bin/sh", mode: 0755},
+	{name: "project-1.0/docs/guide.txt", body: "guide"},
+	{name: "project-1.0/docs/api/index.txt", body: "api"},
+	{name: "project-1.0/link", linkName: "docs/guide.txt"},
+}
+
+func TestExtractTarFormatsWhileStripping(t *testing.T) {
+	for _, format := range []string{"tar", "tar.gz", "tar.xz", "tar.zst"} {
+		fs := &lib.MemFS{}
+		data := buildTar(t, format, testArchiveEntries)
+
+		err := lib.ExtractTar(fs, bytes.NewReader(data), format, "out", lib.ExtractOptions{StripComponents: 1})
+		assert.NoError(t, err, format)
+		assert.Equal(t, []string{"out/README", "out/bin/tool", "out/docs/api/index.txt", "out/docs/guide.txt", "out/link"}, fs.Files(), format)
+		tool, _ := fs.ReadFile("out/bin/tool")
+		assert.Equal(t, "#!/bin/sh", string(tool), format)
+		info, err := fs.Stat("out/bin/tool")
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm(), format)
+		info, err = fs.Stat("out/link")
+		assert.NoError(t, err)
+		assert.True(t, info.Mode()&os.ModeSymlink != 0, format)
+	}
+}
+
+func TestExtractArchiveIncludeAndExclude(t *testing.T) {
+	fs := &lib.MemFS{}
+	assert.NoError(t, fs.MkdirAll("in", 0755))
+	archive, err := fs.Create("in/project.zip")
+	assert.NoError(t, err)
+	archive.Write(buildZip(t, testArchiveEntries))
+	archive.Close()
+
+	options := lib.ExtractOptions{StripComponents: 1, Include: []string{"docs", "README"}, Exclude: []string{"docs/api"}}
+	assert.NoError(t, lib.ExtractArchive(fs, "in/project.zip", "out", options))
+	assert.Equal(t, []string{"in/project.zip", "out/README", "out/docs/guide.txt"}, fs.Files())
+}
+
+func TestExtractRejectsEntriesOutsideTheDestination(t *testing.T) {
+	cases := map[string][]archiveEntry{
+		"parent":                {{name: "../evil", body: "x"}},
+		"nested parent":         {{name: "a/../../evil", body: "x"}},
+		"absolute":              {{name: "/evil", body: "x"}},
+		"backslashes":           {{name: `..\evil`, body: "x"}},
+		"symlink to parent":     {{name: "a/link", linkName: "../../evil"}},
+		"absolute symlink":      {{name: "link", linkName: "/etc/passwd"}},
+		"write through symlink": {{name: "link", linkName: "."}, {name: "link/../../evil", body: "x"}},
+		"file in symlink":       {{name: "dir", linkName: "a"}, {name: "dir/evil", body: "x"}},
+		"chained symlinks":      {{name: "b", linkName: "."}, {name: "c", linkName: "b/../evil"}},
+		"relinked symlink":      {{name: "a", linkName: "x/y/../../evil"}, {name: "x", linkName: "."}},
+		"case folded symlink":   {{name: "b", linkName: "."}, {name: "a", linkName: "B/../evil"}},
+		"file in folded link":   {{name: "dir", linkName: "a"}, {name: "DIR/evil", body: "x"}},
+	}
+	for name, entries := range cases {
+		for _, format := range []string{"tar.gz", "zip"} {
+			fs := &lib.MemFS{}
+			assert.NoError(t, fs.MkdirAll("in", 0755))
+			var data []byte
+			if format == "zip" {
+				data = buildZip(t, entries)
+			} else {
+				data = buildTar(t, format, entries)
+			}
+			archive, _ := fs.Create("in/evil." + format)
+			archive.Write(data)
+			archive.Close()
+
+			err := lib.ExtractArchive(fs, "in/evil."+format, "in/out", lib.ExtractOptions{})
+			assert.Error(t, err, name+" "+format)
+			for _, file := range fs.Files() {
+				assert.NotEqual(t, "in/evil", file, name+" "+format)
+				assert.NotEqual(t, "evil", file, name+" "+format)
+			}
+		}
+	}
+}
+
+func TestExtractRefusesSymlinksAlreadyOnDisk(t *testing.T) {
+	cases := map[string][]archiveEntry{
+		"file":    {{name: "link/evil", body: "x"}},
+		"dir":     {{name: "link/", dir: true}},
+		"symlink": {{name: "up", linkName: "link/evil"}},
+	}
+	for name, entries := range cases {
+		fs := &lib.MemFS{}
+		assert.NoError(t, fs.MkdirAll("in/out", 0755))
+		assert.NoError(t, fs.Symlink("../..", "in/out/link"))
+
+		err := lib.ExtractTar(fs, bytes.NewReader(buildTar(t, "tar", entries)), "tar", "in/out", lib.ExtractOptions{})
+		assert.Error(t, err, name)
+		assert.Equal(t, []string{"in/out/link"}, fs.Files(), name)
+	}
+}
+
+func TestExtractPreservesPermissionsAndSymlinksOnDisk(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and permissions differ on windows")
+	}
+	dir, err := ioutil.TempDir("", "extract")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	entries := append(testArchiveEntries,
+		archiveEntry{name: "project-1.0/secret", body: "s", mode: 0600},
+		archiveEntry{name: "project-1.0/readonly/", dir: true, mode: 0555},
+		archiveEntry{name: "project-1.0/readonly/file", body: "r"})
+
+	err = lib.ExtractTar(lib.OSFS{}, bytes.NewReader(buildTar(t, "tar.gz", entries)), "tar.gz", dir, lib.ExtractOptions{StripComponents: 1})
+	assert.NoError(t, err)
+	defer os.Chmod(filepath.Join(dir, "readonly"), 0755)
+
+	for name, mode := range map[string]os.FileMode{"bin/tool": 0755, "secret": 0600, "readonly": 0555} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, mode, info.Mode().Perm(), name)
+	}
+	info, err := os.Lstat(filepath.Join(dir, "link"))
+	assert.NoError(t, err)
+	assert.True(t, info.Mode()&os.ModeSymlink != 0)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "link"))
+	assert.NoError(t, err)
+	assert.Equal(t, "guide", string(data))
+	data, err = ioutil.ReadFile(filepath.Join(dir, "readonly/file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "r", string(data))
+}
+
+func TestDownloadAndExtract(t *testing.T) {
+	archives := map[string][]byte{
+		"/project.tar.zst": buildTar(t, "tar.zst", testArchiveEntries),
+		"/project.zip":     buildZip(t, testArchiveEntries),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(archives[r.URL.Path]))
+	}))
+	defer server.Close()
+
+	for archive := range archives {
+		fs := &lib.MemFS{}
+		downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+		err := downloader.DownloadAndExtract("out", server.URL+archive, 4, lib.ExtractOptions{StripComponents: 1, Exclude: []string{"link"}})
+		assert.NoError(t, err, archive)
+		assert.Equal(t, []string{"out/README", "out/bin/tool", "out/docs/api/index.txt", "out/docs/guide.txt"}, fs.Files(), archive)
+		guide, _ := fs.ReadFile("out/docs/guide.txt")
+		assert.Equal(t, "guide", string(guide), archive)
+	}
+}
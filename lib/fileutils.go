@@ -1,10 +1,15 @@
 package lib
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"net/http"
 	"os"
 	"strings"
 
@@ -15,39 +20,58 @@ import (
 type FileUtils interface {
 	CreateFileIfNotExists(filepath string, fileName string) (fileSize int64, err error)
 	GetFileNameFromURL(url string) (fileName string, err error)
-	WriteToFile(response *http.Response, filePath string) error
+	WriteToFile(response *Response, filePath string) error
 	MergeFiles(filePaths []string, destinationFilePath string, fileName string) error
 	DeleteFile(filePath string) error
 	FileExists(path string) bool
+	Checksum(filePath string, algorithm string) (string, error)
+	// CommitFile flushes tempPath to disk and renames it to filePath, which
+	// is replaced atomically.
+	CommitFile(tempPath string, filePath string) error
 }
 
-type File struct{}
+// File implements FileUtils on FS, the local disk when it is nil.
+type File struct {
+	FS FS
+}
+
+// FileSystem is the FS the files are on.
+func (f *File) FileSystem() FS {
+	if f.FS == nil {
+		return OSFS{}
+	}
+	return f.FS
+}
 
 func (f *File) CreateFileIfNotExists(filePath string, fileName string) (fileSize int64, err error) {
-	os.MkdirAll(filePath, os.ModePerm)
+	fs := f.FileSystem()
+	fs.MkdirAll(filePath, os.ModePerm)
 	fileLocation := fmt.Sprintf("%s/%s", filePath, fileName)
-	file, err := os.Stat(fileLocation)
+	file, err := fs.Stat(fileLocation)
 	if os.IsNotExist(err) {
-		newFile, err := os.Create(fileLocation)
-		defer newFile.Close()
+		newFile, err := fs.Create(fileLocation)
 		if err != nil {
 			return 0, err
 		}
+		defer newFile.Close()
 		return 0, nil
 	}
+	if err != nil {
+		return 0, err
+	}
 
 	return file.Size(), nil
 }
 
 func (f *File) FileExists(path string) bool {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+	if _, err := f.FileSystem().Stat(path); os.IsNotExist(err) {
 		return false
 	}
 	return true
 }
 
-func (f *File) WriteToFile(response *http.Response, filePath string) error {
-	fo, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
+func (f *File) WriteToFile(response *Response, filePath string) error {
+	fo, err := f.FileSystem().OpenFile(filePath, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
 	if err != nil {
 		return err
 	}
@@ -61,7 +85,7 @@ func (f *File) WriteToFile(response *http.Response, filePath string) error {
 		// read a chunk
 		n, err := response.Body.Read(buf)
 		if err != nil && err != io.EOF {
-			panic(err)
+			return err
 		}
 		if n == 0 {
 			break
@@ -91,39 +115,92 @@ func (f *File) MergeFiles(filePaths []string, destinationFilePath string, fileNa
 	}
 
 	fileLocation := fmt.Sprintf("%s/%s", destinationFilePath, fileName)
-	fo, err := os.OpenFile(fileLocation, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
+	fo, err := f.FileSystem().OpenFile(fileLocation, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
 	if err != nil {
 		return err
 	}
-	defer fo.Close()
-
-	var count int
 
-	chunkSize := 1024
 	for _, filePath := range filePaths {
-		data, err := os.Open(filePath)
-		if err != nil {
+		if err = f.appendFile(fo, filePath); err != nil {
+			fo.Close()
 			return err
 		}
-		defer data.Close()
+	}
+	return fo.Close()
+}
 
-		reader := bufio.NewReader(data)
-		part := make([]byte, chunkSize)
+func (f *File) appendFile(fo io.Writer, filePath string) error {
+	data, err := f.FileSystem().Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
 
-		for {
-			if count, err = reader.Read(part); err != nil {
-				break
-			}
-			fo.Write(part[:count])
+	reader := bufio.NewReader(data)
+	part := make([]byte, 1024)
+	var count int
+	for {
+		if count, err = reader.Read(part); err != nil {
+			break
 		}
-		if err != io.EOF {
-			return errors.New(fmt.Sprintf("%s %s: %s", "Error Reading", filePath, err.Error()))
+		if _, err := fo.Write(part[:count]); err != nil {
+			return err
 		}
 	}
+	if err != io.EOF {
+		return errors.New(fmt.Sprintf("%s %s: %s", "Error Reading", filePath, err.Error()))
+	}
 	return nil
 }
 
 func (f *File) DeleteFile(filePath string) error {
-	err := os.Remove(filePath)
+	err := f.FileSystem().Remove(filePath)
 	return err
 }
+
+func (f *File) CommitFile(tempPath string, filePath string) error {
+	fs := f.FileSystem()
+	file, err := fs.OpenFile(tempPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return fs.Rename(tempPath, filePath)
+}
+
+func (f *File) Checksum(filePath string, algorithm string) (string, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	file, err := f.FileSystem().Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+}
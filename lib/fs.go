@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FS is the filesystem downloads are written to. Names are slash or
+// OS separated paths.
+type FS interface {
+	Open(name string) (FSFile, error)
+	Create(name string) (FSFile, error)
+	OpenFile(name string, flag int, perm os.FileMode) (FSFile, error)
+	Stat(name string) (os.FileInfo, error)
+	// Lstat is Stat without following a symlink at name.
+	Lstat(name string) (os.FileInfo, error)
+	Rename(oldName string, newName string) error
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+	Chmod(name string, mode os.FileMode) error
+	Symlink(oldName string, newName string) error
+	// ReadDir lists the directory name sorted by file name.
+	ReadDir(name string) ([]os.FileInfo, error)
+	// Lock takes an exclusive lock on name, creating it if needed, and
+	// waits while someone else holds it.
+	Lock(name string) (unlock func(), err error)
+}
+
+// FSFile is an open file of an FS, *os.File for OSFS.
+type FSFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// OSFS is the local disk.
+type OSFS struct{}
+
+func (OSFS) Open(name string) (FSFile, error) {
+	return openOSFile(os.Open(filepath.FromSlash(name)))
+}
+
+func (OSFS) Create(name string) (FSFile, error) {
+	return openOSFile(os.Create(filepath.FromSlash(name)))
+}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (FSFile, error) {
+	return openOSFile(os.OpenFile(filepath.FromSlash(name), flag, perm))
+}
+
+// openOSFile keeps a nil *os.File from turning into a non nil FSFile.
+func openOSFile(file *os.File, err error) (FSFile, error) {
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(filepath.FromSlash(name))
+}
+
+func (OSFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(filepath.FromSlash(name))
+}
+
+func (OSFS) Rename(oldName string, newName string) error {
+	return os.Rename(filepath.FromSlash(oldName), filepath.FromSlash(newName))
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(filepath.FromSlash(name))
+}
+
+func (OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(filepath.FromSlash(path), perm)
+}
+
+func (OSFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(filepath.FromSlash(name), atime, mtime)
+}
+
+func (OSFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(filepath.FromSlash(name), mode)
+}
+
+func (OSFS) Symlink(oldName string, newName string) error {
+	return os.Symlink(filepath.FromSlash(oldName), filepath.FromSlash(newName))
+}
+
+func (OSFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(filepath.FromSlash(name))
+}
+
+func (OSFS) Lock(name string) (unlock func(), err error) {
+	return lockFile(filepath.FromSlash(name))
+}
+
+// fsProvider is implemented by FileUtils that work on an FS, the Downloader
+// uses the same one for the files it handles itself.
+type fsProvider interface {
+	FileSystem() FS
+}
+
+func (d *Downloader) fs() FS {
+	if provider, ok := d.FileUtils.(fsProvider); ok {
+		return provider.FileSystem()
+	}
+	return OSFS{}
+}
+
+func readFile(fs FS, name string) ([]byte, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+func writeFile(fs FS, name string, data []byte) error {
+	file, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
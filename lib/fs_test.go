@@ -0,0 +1,215 @@
+package lib_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+// testFS checks the behaviour downloads rely on against any FS rooted at
+// root.
+func testFS(t *testing.T, fs lib.FS, root string) {
+	dir := filepath.Join(root, "a", "b")
+	_, err := fs.Create(filepath.Join(dir, "file"))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, fs.MkdirAll(dir, os.ModePerm))
+	info, err := fs.Stat(filepath.Join(root, "a"))
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	name := filepath.Join(dir, "file")
+	file, err := fs.Create(name)
+	assert.NoError(t, err)
+	_, err = file.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = file.WriteAt([]byte("world"), 8)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	_, err = fs.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	assert.True(t, os.IsExist(err))
+
+	appender, err := fs.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = appender.Write([]byte("!"))
+	assert.NoError(t, err)
+	assert.NoError(t, appender.Close())
+
+	reader, err := fs.Open(name)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello\x00\x00\x00world!"), data)
+	part := make([]byte, 5)
+	_, err = reader.ReadAt(part, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(part))
+	_, err = reader.Seek(-1, io.SeekEnd)
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "!", string(data))
+	assert.NoError(t, reader.Close())
+
+	modTime := time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, fs.Chtimes(name, modTime, modTime))
+	renamed := filepath.Join(root, "a", "renamed")
+	assert.NoError(t, fs.Rename(name, renamed))
+	_, err = fs.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+	info, err = fs.Stat(renamed)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(14), info.Size())
+	assert.True(t, info.ModTime().Equal(modTime))
+	entries, err := fs.ReadDir(filepath.Join(root, "a"))
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "b", entries[0].Name())
+		assert.True(t, entries[0].IsDir())
+		assert.Equal(t, "renamed", entries[1].Name())
+		assert.Equal(t, int64(14), entries[1].Size())
+	}
+	_, err = fs.ReadDir(filepath.Join(root, "missing"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Error(t, fs.Remove(filepath.Join(root, "a")))
+	assert.NoError(t, fs.Remove(renamed))
+	assert.NoError(t, fs.Remove(dir))
+	assert.True(t, os.IsNotExist(fs.Remove(renamed)))
+
+	unlock, err := fs.Lock(filepath.Join(root, ".lock"))
+	assert.NoError(t, err)
+	locked := make(chan bool)
+	go func() {
+		unlock, err := fs.Lock(filepath.Join(root, ".lock"))
+		assert.NoError(t, err)
+		locked <- true
+		unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock taken twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+}
+
+func TestOSFS(t *testing.T) {
+	root, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	testFS(t, lib.OSFS{}, root)
+}
+
+func TestMemFS(t *testing.T) {
+	testFS(t, &lib.MemFS{}, "/data")
+}
+
+func TestDownloadFileConcurrentIntoMemory(t *testing.T) {
+	content := testContent(32 * 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+	assert.NoError(t, downloader.DownloadFileConcurrent("memory-only", server.URL+"/file.bin", 4))
+	status, err := downloader.SyncFile("memory-only", server.URL+"/file.bin", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, lib.SyncUpdated, status)
+
+	data, err := fs.ReadFile("memory-only/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, []string{"memory-only/.file.bin.sync", "memory-only/file.bin"}, fs.Files())
+	_, err = os.Stat("memory-only")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// fullDiskFS runs out of space once limit bytes are written to the file at
+// full, and keeps track of the most files open for reading at once.
+type fullDiskFS struct {
+	*lib.MemFS
+	full    string
+	limit   int
+	open    int
+	maxOpen int
+}
+
+type fullDiskFile struct {
+	lib.FSFile
+	fs *fullDiskFS
+}
+
+type countedFile struct {
+	lib.FSFile
+	fs *fullDiskFS
+}
+
+func (fs *fullDiskFS) Open(name string) (lib.FSFile, error) {
+	file, err := fs.MemFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.open++
+	if fs.open > fs.maxOpen {
+		fs.maxOpen = fs.open
+	}
+	return &countedFile{FSFile: file, fs: fs}, nil
+}
+
+func (fs *fullDiskFS) OpenFile(name string, flag int, perm os.FileMode) (lib.FSFile, error) {
+	file, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil || name != fs.full {
+		return file, err
+	}
+	return &fullDiskFile{FSFile: file, fs: fs}, nil
+}
+
+func (f *fullDiskFile) Write(p []byte) (int, error) {
+	if len(p) > f.fs.limit {
+		n, _ := f.FSFile.Write(p[:f.fs.limit])
+		f.fs.limit = 0
+		return n, errors.New("no space left on device")
+	}
+	f.fs.limit -= len(p)
+	return f.FSFile.Write(p)
+}
+
+func (f *countedFile) Close() error {
+	f.fs.open--
+	return f.FSFile.Close()
+}
+
+func TestMergeFilesFailsWhenTheDiskIsFull(t *testing.T) {
+	fs := &fullDiskFS{MemFS: &lib.MemFS{}, full: "dl/file.bin.part", limit: 5000}
+	var parts []string
+	for i := 0; i < 3; i++ {
+		parts = append(parts, fmt.Sprintf("dl/%d-file.bin", i))
+		writeMemFile(t, fs.MemFS, parts[i], testContent(2000))
+	}
+	files := &lib.File{FS: fs}
+
+	err := files.MergeFiles(parts[:2], "dl", "file.bin.part")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fs.maxOpen)
+
+	err = files.MergeFiles(parts[2:], "dl", "file.bin.part")
+
+	assert.EqualError(t, err, "no space left on device")
+	assert.Equal(t, 0, fs.open)
+}
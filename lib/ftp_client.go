@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+const defaultFTPTimeout = 30 * time.Second
+
+// FTPClient implements Client over FTP. ftp:// urls use a plain connection,
+// ftpes:// upgrades the control connection with AUTH TLS and ftps:// uses
+// implicit TLS. Data connections are always passive (EPSV, falling back to
+// PASV) and every call uses its own control connection, so the segments of
+// DownloadFileConcurrent are transferred in parallel.
+type FTPClient struct {
+	TLSConfig   *tls.Config
+	Timeout     time.Duration
+	DisableEPSV bool
+}
+
+func (c *FTPClient) ResumeGet(url string, existingFileSize int64) (resp *Response, err error) {
+	return c.retrieve(url, existingFileSize, -1)
+}
+
+func (c *FTPClient) Head(url string) (resp *Response, err error) {
+	conn, path, err := c.connect(url)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Quit()
+
+	size, err := conn.FileSize(path)
+	if err != nil {
+		return nil, ftpError(err)
+	}
+	return &Response{Body: ioutil.NopCloser(bytes.NewReader(nil)), ContentLength: size, LastModified: modTime(conn, path)}, nil
+}
+
+func (c *FTPClient) Get(url string, rangeHeader string) (resp *Response, err error) {
+	from, to, err := parseByteRange(rangeHeader)
+	if err != nil {
+		return nil, err
+	}
+	return c.retrieve(url, from, to)
+}
+
+func (c *FTPClient) retrieve(url string, from int64, to int64) (*Response, error) {
+	conn, path, err := c.connect(url)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := conn.FileSize(path)
+	if err != nil {
+		conn.Quit()
+		return nil, ftpError(err)
+	}
+	if to < 0 || to >= size {
+		to = size - 1
+	}
+	modified := modTime(conn, path)
+
+	data, err := conn.RetrFrom(path, uint64(from))
+	if err != nil {
+		conn.Quit()
+		return nil, ftpError(err)
+	}
+
+	body := &ftpBody{data: data, conn: conn}
+	return &Response{Body: newLimitedReadCloser(body, from, to), ContentLength: to - from + 1, LastModified: modified}, nil
+}
+
+// modTime is the MDTM of path, zero when the server doesn't tell. It is the
+// only validator FTP has, parts are resumed only while it is unchanged.
+func modTime(conn *ftp.ServerConn, path string) time.Time {
+	modified, err := conn.GetTime(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return modified
+}
+
+// ftpError makes the 550 servers answer for a missing file match
+// os.ErrNotExist, like the errors of the other clients for one.
+func ftpError(err error) error {
+	var replyErr *textproto.Error
+	if errors.As(err, &replyErr) && replyErr.Code == ftp.StatusFileUnavailable {
+		return &ftpNotFoundError{err}
+	}
+	return err
+}
+
+// ftpNotFoundError keeps the reply of the server.
+type ftpNotFoundError struct {
+	err error
+}
+
+func (e *ftpNotFoundError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ftpNotFoundError) Is(target error) bool {
+	return target == os.ErrNotExist
+}
+
+func (c *FTPClient) connect(rawURL string) (*ftp.ServerConn, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultFTPTimeout
+	}
+	options := []ftp.DialOption{ftp.DialWithTimeout(timeout), ftp.DialWithShutTimeout(timeout),
+		ftp.DialWithDisabledEPSV(c.DisableEPSV)}
+
+	port := "21"
+	switch u.Scheme {
+	case "ftps":
+		port = "990"
+		options = append(options, ftp.DialWithTLS(c.tlsConfig(u.Hostname())))
+	case "ftpes":
+		options = append(options, ftp.DialWithExplicitTLS(c.tlsConfig(u.Hostname())))
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+
+	conn, err := ftp.Dial(net.JoinHostPort(u.Hostname(), port), options...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	user, password := "anonymous", "anonymous"
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+	if err = conn.Login(user, password); err != nil {
+		conn.Quit()
+		return nil, "", err
+	}
+	return conn, u.Path, nil
+}
+
+func (c *FTPClient) tlsConfig(host string) *tls.Config {
+	if c.TLSConfig != nil {
+		return c.TLSConfig
+	}
+	return &tls.Config{ServerName: host}
+}
+
+// ftpBody closes the control connection together with the data connection.
+// A ranged read stops before the end of the file, so the transfer is aborted
+// by dropping both connections rather than waiting for the server.
+type ftpBody struct {
+	data *ftp.Response
+	conn *ftp.ServerConn
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	n, err := b.data.Read(p)
+	if err == io.EOF {
+		// a transfer the server aborted ends like a complete one, only the
+		// reply after it tells them apart
+		if closeErr := b.data.Close(); closeErr != nil {
+			return n, closeErr
+		}
+	}
+	return n, err
+}
+
+func (b *ftpBody) Close() error {
+	b.data.Close()
+	return b.conn.Quit()
+}
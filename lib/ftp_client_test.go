@@ -0,0 +1,377 @@
+package lib_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+// ftpTestServer is a minimal passive mode FTP server serving files from
+// memory. It supports plain, explicit (AUTH TLS) and implicit TLS sessions.
+// With cut set the first RETR is aborted after cut bytes. It records the
+// offset of every RETR.
+type ftpTestServer struct {
+	listener  net.Listener
+	files     map[string][]byte
+	tlsConfig *tls.Config
+	logins    int32
+	mutex     sync.Mutex
+	cut       int
+	offsets   []int64
+}
+
+func newFTPTestServer(t *testing.T, files map[string][]byte, tlsConfig *tls.Config, implicitTLS bool) *ftpTestServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	if implicitTLS {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	s := &ftpTestServer{listener: listener, files: files, tlsConfig: tlsConfig}
+	go s.serve()
+	return s
+}
+
+func (s *ftpTestServer) Close() {
+	s.listener.Close()
+}
+
+func (s *ftpTestServer) URL(scheme string, path string) string {
+	return fmt.Sprintf("%s://user:secret@%s%s", scheme, s.listener.Addr().String(), path)
+}
+
+func (s *ftpTestServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *ftpTestServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	var dataListener net.Listener
+	var offset int64
+	protected := false
+	defer func() {
+		if dataListener != nil {
+			dataListener.Close()
+		}
+	}()
+
+	reply("220 test server ready")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		command, arg := strings.ToUpper(fields[0]), ""
+		if len(fields) == 2 {
+			arg = fields[1]
+		}
+
+		switch command {
+		case "AUTH":
+			reply("234 AUTH TLS ok")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			conn, reader = tlsConn, bufio.NewReader(tlsConn)
+		case "USER":
+			reply("331 password required")
+		case "PASS":
+			atomic.AddInt32(&s.logins, 1)
+			reply("230 logged in")
+		case "FEAT":
+			reply("211-Features:\r\n SIZE\r\n MDTM\r\n REST STREAM\r\n211 End")
+		case "TYPE", "OPTS", "PBSZ":
+			reply("200 ok")
+		case "PROT":
+			protected = arg == "P"
+			reply("200 ok")
+		case "SIZE":
+			content, ok := s.files[arg]
+			if !ok {
+				reply("550 no such file")
+				continue
+			}
+			reply("213 %d", len(content))
+		case "MDTM":
+			if _, ok := s.files[arg]; !ok {
+				reply("550 no such file")
+				continue
+			}
+			reply("213 20240102030405")
+		case "EPSV", "PASV":
+			dataListener, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				reply("425 cannot open data connection")
+				continue
+			}
+			port := dataListener.Addr().(*net.TCPAddr).Port
+			if command == "EPSV" {
+				reply("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				reply("227 Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256)
+			}
+		case "REST":
+			offset, _ = strconv.ParseInt(arg, 10, 64)
+			reply("350 restarting at %d", offset)
+		case "RETR":
+			content, ok := s.files[arg]
+			if !ok || dataListener == nil {
+				reply("550 no such file")
+				continue
+			}
+			reply("150 opening data connection")
+			dataConn, err := dataListener.Accept()
+			dataListener.Close()
+			dataListener = nil
+			if err != nil {
+				reply("425 cannot open data connection")
+				continue
+			}
+			if protected {
+				dataConn = tls.Server(dataConn, s.tlsConfig)
+			}
+			s.mutex.Lock()
+			s.offsets = append(s.offsets, offset)
+			cut := s.cut
+			s.cut = 0
+			s.mutex.Unlock()
+			end := int64(len(content))
+			if cut > 0 && offset+int64(cut) < end {
+				end = offset + int64(cut)
+			}
+			_, err = dataConn.Write(content[offset:end])
+			dataConn.Close()
+			offset = 0
+			if err != nil || end < int64(len(content)) {
+				reply("426 transfer aborted")
+				continue
+			}
+			reply("226 transfer complete")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 %s not implemented", command)
+		}
+	}
+}
+
+func testTLSConfigs(t *testing.T) (server *tls.Config, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	return server, client
+}
+
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func TestFTPClientHeadReturnsFileSize(t *testing.T) {
+	content := testContent(1000)
+	server := newFTPTestServer(t, map[string][]byte{"/pub/file.bin": content}, nil, false)
+	defer server.Close()
+	client := lib.FTPClient{}
+
+	resp, err := client.Head(server.URL("ftp", "/pub/file.bin"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), resp.ContentLength)
+}
+
+func TestFTPClientHeadFailsWhenFileDoesNotExist(t *testing.T) {
+	server := newFTPTestServer(t, map[string][]byte{}, nil, false)
+	defer server.Close()
+	client := lib.FTPClient{}
+
+	_, err := client.Head(server.URL("ftp", "/pub/missing.bin"))
+
+	assert.EqualError(t, err, `550 "no such file"`)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestFTPClientGetReturnsRequestedRange(t *testing.T) {
+	content := testContent(1000)
+	server := newFTPTestServer(t, map[string][]byte{"/pub/file.bin": content}, nil, false)
+	defer server.Close()
+	client := lib.FTPClient{}
+
+	resp, err := client.Get(server.URL("ftp", "/pub/file.bin"), "100-299")
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), resp.ContentLength)
+	assert.Equal(t, content[100:300], data)
+}
+
+func TestFTPClientGetUsesPASVWhenEPSVIsDisabled(t *testing.T) {
+	content := testContent(1000)
+	server := newFTPTestServer(t, map[string][]byte{"/pub/file.bin": content}, nil, false)
+	defer server.Close()
+	client := lib.FTPClient{DisableEPSV: true}
+
+	resp, err := client.Get(server.URL("ftp", "/pub/file.bin"), "0-99")
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.NoError(t, err)
+	assert.Equal(t, content[:100], data)
+}
+
+func TestFTPClientResumeGetStartsAtOffset(t *testing.T) {
+	content := testContent(1000)
+	server := newFTPTestServer(t, map[string][]byte{"/pub/file.bin": content}, nil, false)
+	defer server.Close()
+	client := lib.FTPClient{}
+
+	resp, err := client.ResumeGet(server.URL("ftp", "/pub/file.bin"), 900)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.NoError(t, err)
+	assert.Equal(t, content[900:], data)
+}
+
+func TestDownloadFileResumesAnInterruptedFTPTransfer(t *testing.T) {
+	content := testContent(64 * 1024)
+	server := newFTPTestServer(t, map[string][]byte{"/pub/file.bin": content}, nil, false)
+	server.cut = 20000
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{FileUtils: &lib.File{FS: fs}, Client: lib.NewProtocolClient()}
+
+	assert.Error(t, downloader.DownloadFile("dl", server.URL("ftp", "/pub/file.bin")))
+	assert.NoError(t, downloader.DownloadFile("dl", server.URL("ftp", "/pub/file.bin")))
+
+	data, err := fs.ReadFile("dl/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	assert.Equal(t, []int64{0, 20000}, server.offsets)
+}
+
+func TestDownloadFileConcurrentOverFTPUsesParallelConnections(t *testing.T) {
+	content := testContent(64 * 1024)
+	server := newFTPTestServer(t, map[string][]byte{"/pub/file.bin": content}, nil, false)
+	defer server.Close()
+	dirPath, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dirPath)
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}
+
+	err = downloader.DownloadFileConcurrent(dirPath, server.URL("ftp", "/pub/file.bin"), 4)
+
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dirPath, "file.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&server.logins))
+}
+
+func TestDownloadFileConcurrentOverFTPS(t *testing.T) {
+	content := testContent(32 * 1024)
+	serverTLS, clientTLS := testTLSConfigs(t)
+	client := &lib.FTPClient{TLSConfig: clientTLS}
+	protocolClient := lib.NewProtocolClient()
+	protocolClient.Register("ftps", client)
+	protocolClient.Register("ftpes", client)
+
+	for _, scheme := range []string{"ftpes", "ftps"} {
+		server := newFTPTestServer(t, map[string][]byte{"/pub/file.bin": content}, serverTLS, scheme == "ftps")
+		dirPath, err := ioutil.TempDir("", "godownload")
+		assert.NoError(t, err)
+		downloader := lib.Downloader{FileUtils: &lib.File{}, Client: protocolClient}
+
+		err = downloader.DownloadFileConcurrent(dirPath, server.URL(scheme, "/pub/file.bin"), 3)
+
+		assert.NoError(t, err, scheme)
+		data, err := ioutil.ReadFile(filepath.Join(dirPath, "file.bin"))
+		assert.NoError(t, err, scheme)
+		assert.Equal(t, content, data, scheme)
+		server.Close()
+		os.RemoveAll(dirPath)
+	}
+}
+
+func TestDownloadOverFTPLooksForTheNextSignatureSuffix(t *testing.T) {
+	content := testContent(1000)
+	entity, keyring := newPGPKey(t, "Release")
+	server := newFTPTestServer(t, map[string][]byte{"/pub/tool.bin": content, "/pub/tool.bin.sig": pgpSign(t, entity, content)}, nil, false)
+	defer server.Close()
+	verifier, err := lib.NewPGPVerifier(bytes.NewReader(keyring))
+	assert.NoError(t, err)
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}, Verifier: verifier}
+
+	result, err := downloader.DownloadFileWithResult("dl", server.URL("ftp", "/pub/tool.bin"), 2)
+
+	assert.NoError(t, err)
+	assert.Equal(t, entity.PrimaryKey.KeyIdString(), result.Signer.KeyID)
+	assert.Equal(t, []string{"dl/tool.bin"}, fs.Files())
+}
+
+func TestProtocolClientFailsOnUnsupportedScheme(t *testing.T) {
+	client := lib.NewProtocolClient()
+
+	_, err := client.Head("gopher://example.com/file.txt")
+
+	assert.EqualError(t, err, `unsupported url scheme "gopher"`)
+}
@@ -0,0 +1,423 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HLSOptions selects the variant of a master playlist. Without options the
+// variant with the highest bandwidth is downloaded.
+type HLSOptions struct {
+	// MaxBandwidth skips variants above this many bits per second.
+	MaxBandwidth int64
+	// Resolution such as "1280x720" picks the variant of that resolution.
+	Resolution string
+}
+
+type hlsVariant struct {
+	uri        string
+	bandwidth  int64
+	resolution string
+}
+
+type hlsKey struct {
+	uri string
+	iv  []byte
+}
+
+type hlsSegment struct {
+	uri         string
+	rangeHeader string
+	sequence    int64
+	key         *hlsKey
+}
+
+type hlsPlaylist struct {
+	variants []hlsVariant
+	segments []hlsSegment
+}
+
+// DownloadHLS downloads the media segments of an HLS playlist, concurrency at
+// a time, decrypts AES-128 segments and concatenates them in playlist order
+// into dirPath under the playlist name with a .ts extension. A master
+// playlist is first resolved to one of its variants according to options.
+// The Hooks run on the joined file. It fails with a Verifier, the joined file
+// has no signature of its own.
+func (d *Downloader) DownloadHLS(dirPath string, playlistURL string, concurrency int64, options HLSOptions) error {
+	if d.Verifier != nil {
+		return fmt.Errorf("unable to verify the signature of %s, its segments are joined", playlistURL)
+	}
+	fileName, err := d.FileUtils.GetFileNameFromURL(playlistURL)
+	if err != nil {
+		return err
+	}
+	fileName = strings.TrimSuffix(fileName, ".m3u8") + ".ts"
+
+	mediaURL := playlistURL
+	playlist, err := d.fetchPlaylist(mediaURL)
+	if err != nil {
+		return err
+	}
+	if len(playlist.variants) > 0 {
+		variant, err := selectVariant(playlist.variants, options)
+		if err != nil {
+			return err
+		}
+		mediaURL = variant.uri
+		if playlist, err = d.fetchPlaylist(mediaURL); err != nil {
+			return err
+		}
+	}
+	if len(playlist.segments) == 0 {
+		return fmt.Errorf("playlist %s has no media segments", mediaURL)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	keys := &hlsKeyCache{client: d.Client, keys: map[string][]byte{}}
+	segmentChan := make(chan int, len(playlist.segments))
+	errChan := make(chan error, len(playlist.segments))
+	filePartPaths := make([]string, len(playlist.segments))
+	for index := range playlist.segments {
+		filePartPaths[index] = fmt.Sprintf("%s/%d-%s", dirPath, index, fileName)
+		segmentChan <- index
+	}
+	close(segmentChan)
+
+	var wg sync.WaitGroup
+	wg.Add(int(concurrency))
+	for i := int64(0); i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for index := range segmentChan {
+				filePartName := fmt.Sprintf("%d-%s", index, fileName)
+				if err := d.downloadSegment(keys, playlist.segments[index], dirPath, filePartName); err != nil {
+					errChan <- fmt.Errorf("unable to download segment %s: %v", playlist.segments[index].uri, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errChan)
+
+	defer func() {
+		for _, filePartPath := range filePartPaths {
+			d.FileUtils.DeleteFile(filePartPath)
+		}
+	}()
+	for err = range errChan {
+		return err
+	}
+
+	partName := fileName + partSuffix
+	partPath := fmt.Sprintf("%s/%s", dirPath, partName)
+	d.FileUtils.DeleteFile(partPath)
+	if err = d.FileUtils.MergeFiles(filePartPaths, dirPath, partName); err != nil {
+		return err
+	}
+	filePath := fmt.Sprintf("%s/%s", dirPath, fileName)
+	if err = d.commitPart(partPath, filePath); err != nil {
+		return err
+	}
+	_, err = d.runHooks(playlistURL, filePath, "", nil)
+	return err
+}
+
+func (d *Downloader) downloadSegment(keys *hlsKeyCache, segment hlsSegment, dirPath string, filePartName string) error {
+	absoluteFilePartPath := fmt.Sprintf("%s/%s", dirPath, filePartName)
+	d.FileUtils.DeleteFile(absoluteFilePartPath)
+	if _, err := d.FileUtils.CreateFileIfNotExists(dirPath, filePartName); err != nil {
+		return err
+	}
+
+	// the key is fetched first, a host limit of one connection would never
+	// let it through while the segment is still open
+	var key []byte
+	if segment.key != nil {
+		var err error
+		if key, err = keys.get(segment.key.uri); err != nil {
+			return err
+		}
+	}
+
+	var response *Response
+	var err error
+	if segment.rangeHeader != "" {
+		response, err = d.Client.Get(segment.uri, segment.rangeHeader)
+	} else {
+		response, err = d.Client.ResumeGet(segment.uri, 0)
+	}
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if segment.rangeHeader != "" {
+		// the whole file, sent for a range starting at 0
+		from, to, err := parseByteRange(segment.rangeHeader)
+		if err != nil {
+			return err
+		}
+		if response.ContentLength >= 0 && response.ContentLength != to-from+1 {
+			return errRangeIgnored
+		}
+		response.Body = newLimitedReadCloser(response.Body, from, to)
+	}
+
+	if key != nil {
+		data, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+		if data, err = decryptSegment(data, key, segment.iv()); err != nil {
+			return err
+		}
+		response = &Response{Body: ioutil.NopCloser(bytes.NewReader(data)), ContentLength: int64(len(data))}
+	}
+	return d.FileUtils.WriteToFile(response, absoluteFilePartPath)
+}
+
+func (d *Downloader) fetchPlaylist(playlistURL string) (*hlsPlaylist, error) {
+	response, err := d.Client.ResumeGet(playlistURL, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	return parsePlaylist(response.Body, playlistURL)
+}
+
+// iv is the explicit IV of the key, or the media sequence number as a 128
+// bit big endian integer.
+func (s hlsSegment) iv() []byte {
+	if s.key.iv != nil {
+		return s.key.iv
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(s.sequence))
+	return iv
+}
+
+func decryptSegment(data []byte, key []byte, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("encrypted segment is not a multiple of the block size")
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("invalid padding in decrypted segment")
+	}
+	return data[:len(data)-padding], nil
+}
+
+type hlsKeyCache struct {
+	client Client
+	mutex  sync.Mutex
+	keys   map[string][]byte
+}
+
+func (c *hlsKeyCache) get(uri string) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if key, ok := c.keys[uri]; ok {
+		return key, nil
+	}
+
+	response, err := c.client.ResumeGet(uri, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	key, err := ioutil.ReadAll(io.LimitReader(response.Body, 64))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 16 {
+		return nil, fmt.Errorf("AES-128 key %s has %d bytes", uri, len(key))
+	}
+	c.keys[uri] = key
+	return key, nil
+}
+
+func selectVariant(variants []hlsVariant, options HLSOptions) (hlsVariant, error) {
+	var candidates []hlsVariant
+	for _, variant := range variants {
+		if options.MaxBandwidth > 0 && variant.bandwidth > options.MaxBandwidth {
+			continue
+		}
+		if options.Resolution != "" && variant.resolution != options.Resolution {
+			continue
+		}
+		candidates = append(candidates, variant)
+	}
+	if len(candidates) == 0 {
+		return hlsVariant{}, errors.New("no variant matches the requested bandwidth and resolution")
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].bandwidth > candidates[j].bandwidth
+	})
+	return candidates[0], nil
+}
+
+// parsePlaylist reads a master or media playlist, resolving every uri against
+// the url of the playlist.
+func parsePlaylist(r io.Reader, playlistURL string) (*hlsPlaylist, error) {
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return nil, err
+	}
+	resolve := func(uri string) (string, error) {
+		ref, err := url.Parse(uri)
+		if err != nil {
+			return "", err
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "#EXTM3U" {
+		return nil, fmt.Errorf("%s is not an m3u8 playlist", playlistURL)
+	}
+
+	playlist := &hlsPlaylist{}
+	var pendingVariant *hlsVariant
+	var key *hlsKey
+	var sequence int64
+	var rangeHeader string
+	var nextOffset = map[string]int64{}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attributes := parseAttributes(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+			bandwidth, _ := strconv.ParseInt(attributes["BANDWIDTH"], 10, 64)
+			pendingVariant = &hlsVariant{bandwidth: bandwidth, resolution: attributes["RESOLUTION"]}
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			sequence, _ = strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64)
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			attributes := parseAttributes(strings.TrimPrefix(line, "#EXT-X-KEY:"))
+			switch attributes["METHOD"] {
+			case "NONE":
+				key = nil
+			case "AES-128":
+				keyURI, err := resolve(attributes["URI"])
+				if err != nil {
+					return nil, err
+				}
+				key = &hlsKey{uri: keyURI}
+				if iv := attributes["IV"]; iv != "" {
+					if key.iv, err = hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X")); err != nil || len(key.iv) != aes.BlockSize {
+						return nil, fmt.Errorf("invalid IV %q", iv)
+					}
+				}
+			default:
+				return nil, fmt.Errorf("unsupported encryption method %q", attributes["METHOD"])
+			}
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			attributes := parseAttributes(strings.TrimPrefix(line, "#EXT-X-MAP:"))
+			mapURI, err := resolve(attributes["URI"])
+			if err != nil {
+				return nil, err
+			}
+			segment := hlsSegment{uri: mapURI, sequence: sequence, key: key}
+			if byteRange := attributes["BYTERANGE"]; byteRange != "" {
+				if segment.rangeHeader, err = parseHLSByteRange(byteRange, mapURI, nextOffset); err != nil {
+					return nil, err
+				}
+			}
+			playlist.segments = append(playlist.segments, segment)
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			rangeHeader = strings.TrimPrefix(line, "#EXT-X-BYTERANGE:")
+		case strings.HasPrefix(line, "#"):
+		default:
+			uri, err := resolve(line)
+			if err != nil {
+				return nil, err
+			}
+			if pendingVariant != nil {
+				pendingVariant.uri = uri
+				playlist.variants = append(playlist.variants, *pendingVariant)
+				pendingVariant = nil
+				continue
+			}
+			segment := hlsSegment{uri: uri, sequence: sequence, key: key}
+			if rangeHeader != "" {
+				if segment.rangeHeader, err = parseHLSByteRange(rangeHeader, uri, nextOffset); err != nil {
+					return nil, err
+				}
+				rangeHeader = ""
+			}
+			playlist.segments = append(playlist.segments, segment)
+			sequence++
+		}
+	}
+	return playlist, scanner.Err()
+}
+
+// parseHLSByteRange turns "<length>[@<offset>]" into an inclusive range. A
+// missing offset continues where the previous range of the same uri ended.
+func parseHLSByteRange(byteRange string, uri string, nextOffset map[string]int64) (string, error) {
+	tokens := strings.SplitN(byteRange, "@", 2)
+	length, err := strconv.ParseInt(tokens[0], 10, 64)
+	if err != nil || length < 1 {
+		return "", fmt.Errorf("invalid byte range %q", byteRange)
+	}
+	offset := nextOffset[uri]
+	if len(tokens) == 2 {
+		if offset, err = strconv.ParseInt(tokens[1], 10, 64); err != nil {
+			return "", fmt.Errorf("invalid byte range %q", byteRange)
+		}
+	}
+	nextOffset[uri] = offset + length
+	return fmt.Sprintf("%d-%d", offset, offset+length-1), nil
+}
+
+// parseAttributes reads an m3u8 attribute list such as
+// BANDWIDTH=1280000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2".
+func parseAttributes(list string) map[string]string {
+	attributes := map[string]string{}
+	for list != "" {
+		eq := strings.Index(list, "=")
+		if eq < 0 {
+			break
+		}
+		name := strings.TrimSpace(list[:eq])
+		list = list[eq+1:]
+		var value string
+		if strings.HasPrefix(list, `"`) {
+			end := strings.Index(list[1:], `"`)
+			if end < 0 {
+				value, list = list[1:], ""
+			} else {
+				value, list = list[1:end+1], list[end+2:]
+			}
+		} else {
+			end := strings.Index(list, ",")
+			if end < 0 {
+				end = len(list)
+			}
+			value, list = list[:end], list[end:]
+		}
+		attributes[name] = value
+		list = strings.TrimPrefix(list, ",")
+	}
+	return attributes
+}
@@ -0,0 +1,267 @@
+package lib_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+var testHLSKey = []byte("0123456789abcdef")
+
+// hlsTestServer serves a master playlist with a plain 360p variant and an
+// AES-128 encrypted 720p variant. Every segment fails once with a 503 when
+// flaky is set.
+type hlsTestServer struct {
+	*httptest.Server
+	files map[string][]byte
+	flaky bool
+	mutex sync.Mutex
+	seen  map[string]bool
+}
+
+func newHLSTestServer(segments [][]byte) *hlsTestServer {
+	s := &hlsTestServer{files: map[string][]byte{}, seen: map[string]bool{}}
+	s.files["/video/master.m3u8"] = []byte("#EXTM3U\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS=\"avc1.4d401f,mp4a.40.2\"\n" +
+		"low/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720\n" +
+		"high/index.m3u8\n")
+
+	low := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n"
+	high := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:7\n#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/key.bin\"\n"
+	explicitIV := []byte("fedcba9876543210")
+	for index, segment := range segments {
+		name := fmt.Sprintf("segment%d.ts", index)
+		low += fmt.Sprintf("#EXTINF:4.0,\n%s\n", name)
+		s.files["/video/low/"+name] = append([]byte("low-"), segment...)
+
+		iv := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], uint64(7+index))
+		if index == len(segments)-1 {
+			iv = explicitIV
+			high += fmt.Sprintf("#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/key.bin\",IV=0x%x\n", explicitIV)
+		}
+		high += fmt.Sprintf("#EXTINF:4.0,\n%s\n", name)
+		s.files["/video/high/"+name] = encryptTestSegment(segment, iv)
+	}
+	s.files["/video/low/index.m3u8"] = []byte(low + "#EXT-X-ENDLIST\n")
+	s.files["/video/high/index.m3u8"] = []byte(high + "#EXT-X-ENDLIST\n")
+	s.files["/keys/key.bin"] = testHLSKey
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *hlsTestServer) handle(w http.ResponseWriter, r *http.Request) {
+	content, ok := s.files[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.mutex.Lock()
+	firstRequest := !s.seen[r.URL.Path]
+	s.seen[r.URL.Path] = true
+	s.mutex.Unlock()
+	if s.flaky && firstRequest && strings.HasSuffix(r.URL.Path, ".ts") {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+func encryptTestSegment(segment []byte, iv []byte) []byte {
+	padding := aes.BlockSize - len(segment)%aes.BlockSize
+	data := append(append([]byte{}, segment...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	block, _ := aes.NewCipher(testHLSKey)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return data
+}
+
+func testSegments(count int) [][]byte {
+	var segments [][]byte
+	for i := 0; i < count; i++ {
+		segments = append(segments, testContent(1000+i*333))
+	}
+	return segments
+}
+
+func hlsDownloader() lib.Downloader {
+	client := &lib.HTTPClient{}
+	client.NewHttpClient()
+	return lib.Downloader{FileUtils: &lib.File{}, Client: &lib.RetryClient{Client: client, Attempts: 3, Backoff: time.Millisecond}}
+}
+
+func TestDownloadHLSDecryptsHighestBandwidthVariantInOrder(t *testing.T) {
+	segments := testSegments(6)
+	server := newHLSTestServer(segments)
+	server.flaky = true
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := hlsDownloader()
+
+	err = downloader.DownloadHLS(dir, server.URL+"/video/master.m3u8", 3, lib.HLSOptions{})
+
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "master.ts"))
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Join(segments, nil), data)
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestDownloadHLSFetchesKeysWithOneConnectionPerHost(t *testing.T) {
+	segments := testSegments(3)
+	server := newHLSTestServer(segments)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	client := &lib.HTTPClient{}
+	client.NewHttpClient()
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: &lib.HostLimitClient{Client: client, MaxConnections: 1}}
+
+	done := make(chan error, 1)
+	go func() { done <- downloader.DownloadHLS(dir, server.URL+"/video/master.m3u8", 2, lib.HLSOptions{}) }()
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("download is stuck")
+	}
+
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "master.ts"))
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Join(segments, nil), data)
+}
+
+func TestDownloadHLSSelectsVariantByBandwidth(t *testing.T) {
+	segments := testSegments(3)
+	server := newHLSTestServer(segments)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := hlsDownloader()
+
+	err = downloader.DownloadHLS(dir, server.URL+"/video/master.m3u8", 2, lib.HLSOptions{MaxBandwidth: 1000000})
+
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "master.ts"))
+	assert.NoError(t, err)
+	var expected []byte
+	for _, segment := range segments {
+		expected = append(append(expected, []byte("low-")...), segment...)
+	}
+	assert.Equal(t, expected, data)
+}
+
+func TestDownloadHLSSelectsVariantByResolution(t *testing.T) {
+	segments := testSegments(2)
+	server := newHLSTestServer(segments)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := hlsDownloader()
+
+	err = downloader.DownloadHLS(dir, server.URL+"/video/master.m3u8", 2, lib.HLSOptions{Resolution: "1280x720"})
+
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "master.ts"))
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Join(segments, nil), data)
+
+	err = downloader.DownloadHLS(dir, server.URL+"/video/master.m3u8", 2, lib.HLSOptions{Resolution: "1920x1080"})
+	assert.EqualError(t, err, "no variant matches the requested bandwidth and resolution")
+}
+
+func TestDownloadHLSDownloadsMediaPlaylistWithByteRanges(t *testing.T) {
+	content := testContent(3000)
+	files := map[string][]byte{
+		"/vod/all.ts": content,
+		"/vod/index.m3u8": []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n" +
+			"#EXTINF:4.0,\n#EXT-X-BYTERANGE:1000@0\nall.ts\n" +
+			"#EXTINF:4.0,\n#EXT-X-BYTERANGE:1500\nall.ts\n" +
+			"#EXTINF:4.0,\n#EXT-X-BYTERANGE:500\nall.ts\n#EXT-X-ENDLIST\n"),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(files[r.URL.Path]))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := hlsDownloader()
+
+	err = downloader.DownloadHLS(dir, server.URL+"/vod/index.m3u8", 3, lib.HLSOptions{})
+
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.ts"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestDownloadHLSFailsWhenTheServerIgnoresAByteRangeAtZero(t *testing.T) {
+	content := testContent(3000)
+	files := map[string][]byte{
+		"/vod/all.ts": content,
+		"/vod/index.m3u8": []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n" +
+			"#EXTINF:4.0,\n#EXT-X-BYTERANGE:1000@0\nall.ts\n#EXT-X-ENDLIST\n"),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(files[r.URL.Path])))
+		w.Write(files[r.URL.Path])
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := hlsDownloader()
+
+	err = downloader.DownloadHLS(dir, server.URL+"/vod/index.m3u8", 1, lib.HLSOptions{})
+
+	assert.EqualError(t, err, "unable to download segment "+server.URL+"/vod/all.ts: server ignored the requested range")
+	_, err = os.Stat(filepath.Join(dir, "index.ts"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadHLSRunsHooksAndRefusesAVerifier(t *testing.T) {
+	server := newHLSTestServer(testSegments(2))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := hlsDownloader()
+	var hooked []string
+	downloader.Hooks = []lib.Hook{lib.HookFunc("notify", func(file *lib.HookFile) (string, error) {
+		hooked = append(hooked, file.URL, file.Path)
+		return "", nil
+	})}
+
+	err = downloader.DownloadHLS(dir, server.URL+"/video/master.m3u8", 2, lib.HLSOptions{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{server.URL + "/video/master.m3u8", dir + "/master.ts"}, hooked)
+
+	downloader.Verifier = &finalFileVerifier{fs: &lib.MemFS{}}
+	err = downloader.DownloadHLS(dir, server.URL+"/video/master.m3u8", 2, lib.HLSOptions{})
+
+	assert.EqualError(t, err, "unable to verify the signature of "+server.URL+"/video/master.m3u8, its segments are joined")
+}
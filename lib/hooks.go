@@ -0,0 +1,285 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Hook is a step run on every file a Downloader finished, in the order of
+// Downloader.Hooks. A failing hook stops the ones after it and fails the
+// download.
+type Hook interface {
+	Name() string
+	// Run returns a short description of what it did.
+	Run(file *HookFile) (output string, err error)
+}
+
+// HookFile is the downloaded file the hooks run on. A hook that moves it
+// updates Path for the hooks after it.
+type HookFile struct {
+	URL  string
+	Path string
+	// Digest is the "<algorithm>:<hex>" digest the file is expected to have,
+	// if one is known.
+	Digest string
+	// Signer made the signature the file was verified with, if any.
+	Signer *Signer
+	FS     FS
+}
+
+// HookResult is what a hook did, Error is empty when it succeeded.
+type HookResult struct {
+	Name   string `json:"name"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// DownloadResult is where a downloaded file ended up, who signed it and
+// what the hooks did with it.
+type DownloadResult struct {
+	URL    string       `json:"url"`
+	Path   string       `json:"path"`
+	Signer *Signer      `json:"signer,omitempty"`
+	Hooks  []HookResult `json:"hooks,omitempty"`
+}
+
+// runHooks runs the Hooks on filePath. The result holds the steps that ran,
+// including the one that failed.
+func (d *Downloader) runHooks(url string, filePath string, digest string, signer *Signer) (*DownloadResult, error) {
+	result := &DownloadResult{URL: url, Path: filePath, Signer: signer}
+	file := &HookFile{URL: url, Path: filePath, Digest: digest, Signer: signer, FS: d.fs()}
+	for _, hook := range d.Hooks {
+		output, err := hook.Run(file)
+		step := HookResult{Name: hook.Name(), Output: output}
+		if err != nil {
+			step.Error = err.Error()
+		}
+		result.Hooks = append(result.Hooks, step)
+		result.Path = file.Path
+		if err != nil {
+			return result, fmt.Errorf("%s hook failed for %s: %v", hook.Name(), url, err)
+		}
+	}
+	return result, nil
+}
+
+type hookFunc struct {
+	name string
+	run  func(file *HookFile) (string, error)
+}
+
+// HookFunc makes a Hook of run.
+func HookFunc(name string, run func(file *HookFile) (string, error)) Hook {
+	return &hookFunc{name: name, run: run}
+}
+
+func (h *hookFunc) Name() string {
+	return h.name
+}
+
+func (h *hookFunc) Run(file *HookFile) (string, error) {
+	return h.run(file)
+}
+
+// VerifyHook checks the file against Digest, or the digest the download
+// knew of when Digest is empty.
+type VerifyHook struct {
+	Digest string
+}
+
+func (h *VerifyHook) Name() string {
+	return "verify"
+}
+
+func (h *VerifyHook) Run(file *HookFile) (string, error) {
+	digest := h.Digest
+	if digest == "" {
+		digest = file.Digest
+	}
+	if digest == "" {
+		return "", fmt.Errorf("no digest known for %s", file.Path)
+	}
+	tokens := strings.SplitN(digest, ":", 2)
+	if len(tokens) != 2 {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	checksum, err := (&File{FS: file.FS}).Checksum(file.Path, tokens[0])
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(checksum, tokens[1]) {
+		return "", fmt.Errorf("checksum mismatch for %s: expected %s, got %s:%s", file.Path, digest, tokens[0], checksum)
+	}
+	return digest, nil
+}
+
+// ExtractHook unpacks the file into Dir, relative to the directory of the
+// file and that directory itself when empty. With Remove the archive is
+// deleted afterwards and Path becomes the directory.
+type ExtractHook struct {
+	Dir     string
+	Options ExtractOptions
+	Remove  bool
+}
+
+func (h *ExtractHook) Name() string {
+	return "extract"
+}
+
+func (h *ExtractHook) Run(file *HookFile) (string, error) {
+	destDir := resolveHookPath(path.Dir(filepath.ToSlash(file.Path)), h.Dir)
+	if err := ExtractArchive(file.FS, file.Path, destDir, h.Options); err != nil {
+		return "", err
+	}
+	if h.Remove {
+		if err := file.FS.Remove(file.Path); err != nil {
+			return "", err
+		}
+		file.Path = destDir
+	}
+	return destDir, nil
+}
+
+// ChmodHook sets the permissions of the file.
+type ChmodHook struct {
+	Mode os.FileMode
+}
+
+func (h *ChmodHook) Name() string {
+	return "chmod"
+}
+
+func (h *ChmodHook) Run(file *HookFile) (string, error) {
+	if err := file.FS.Chmod(file.Path, h.Mode); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%#o", h.Mode.Perm()), nil
+}
+
+// MoveHook renames the file to the result of Template, a text/template
+// given the HookTemplateData of the file. Relative results are taken from
+// the directory of the file and a result ending in / keeps the name, so
+// "{{.Host}}/{{.Date}}/" sorts files by host and day.
+type MoveHook struct {
+	Template string
+}
+
+// HookTemplateData is what a MoveHook template can refer to. Base is the
+// name without its extension Ext.
+type HookTemplateData struct {
+	URL  string
+	Host string
+	Dir  string
+	Name string
+	Base string
+	Ext  string
+	Date string
+}
+
+func (h *MoveHook) Name() string {
+	return "move"
+}
+
+func (h *MoveHook) Run(file *HookFile) (string, error) {
+	tmpl, err := template.New("move").Option("missingkey=error").Parse(h.Template)
+	if err != nil {
+		return "", err
+	}
+	var target bytes.Buffer
+	if err = tmpl.Execute(&target, newHookTemplateData(file)); err != nil {
+		return "", err
+	}
+	dir, name := path.Split(filepath.ToSlash(file.Path))
+	newPath := resolveHookPath(dir, target.String())
+	if strings.HasSuffix(target.String(), "/") {
+		newPath = path.Join(newPath, name)
+	}
+	if err = file.FS.MkdirAll(path.Dir(newPath), os.ModePerm); err != nil {
+		return "", err
+	}
+	if err = file.FS.Rename(file.Path, newPath); err != nil {
+		return "", err
+	}
+	file.Path = newPath
+	return newPath, nil
+}
+
+func newHookTemplateData(file *HookFile) HookTemplateData {
+	dir, name := path.Split(filepath.ToSlash(file.Path))
+	ext := path.Ext(name)
+	data := HookTemplateData{URL: file.URL, Dir: path.Clean(dir), Name: name, Base: strings.TrimSuffix(name, ext), Ext: ext, Date: time.Now().Format("2006-01-02")}
+	if u, err := url.Parse(file.URL); err == nil {
+		data.Host = u.Hostname()
+	}
+	return data
+}
+
+// resolveHookPath takes a relative name from dir.
+func resolveHookPath(dir string, name string) string {
+	name = filepath.ToSlash(name)
+	if absolute(name) {
+		return path.Clean(name)
+	}
+	return path.Join(dir, name)
+}
+
+// CommandHook runs an external command, which finds the file described in
+// GODOWNLOAD_URL, GODOWNLOAD_PATH, GODOWNLOAD_NAME, GODOWNLOAD_DIR,
+// GODOWNLOAD_SIZE and GODOWNLOAD_DIGEST of its environment. Its output is
+// the result of the hook. The file has to be on the local disk.
+type CommandHook struct {
+	Command []string
+	// Timeout kills the command when it runs longer, zero waits forever.
+	Timeout time.Duration
+}
+
+func (h *CommandHook) Name() string {
+	return "exec"
+}
+
+func (h *CommandHook) Run(file *HookFile) (string, error) {
+	if len(h.Command) == 0 {
+		return "", fmt.Errorf("no command given")
+	}
+	if _, ok := file.FS.(OSFS); !ok {
+		return "", fmt.Errorf("%s is not on the local disk", file.Path)
+	}
+	info, err := file.FS.Stat(file.Path)
+	if err != nil {
+		return "", err
+	}
+	localPath := filepath.FromSlash(file.Path)
+	cmd := exec.Command(h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"GODOWNLOAD_URL="+file.URL,
+		"GODOWNLOAD_PATH="+localPath,
+		"GODOWNLOAD_NAME="+filepath.Base(localPath),
+		"GODOWNLOAD_DIR="+filepath.Dir(localPath),
+		"GODOWNLOAD_SIZE="+strconv.FormatInt(info.Size(), 10),
+		"GODOWNLOAD_DIGEST="+file.Digest)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err = cmd.Start(); err != nil {
+		return "", err
+	}
+	if h.Timeout > 0 {
+		timer := time.AfterFunc(h.Timeout, func() { cmd.Process.Kill() })
+		defer timer.Stop()
+	}
+	err = cmd.Wait()
+	result := strings.TrimSpace(output.String())
+	if err != nil {
+		return result, fmt.Errorf("%s: %v", h.Command[0], err)
+	}
+	return result, nil
+}
@@ -0,0 +1,142 @@
+package lib_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func newContentServer(content []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func sha256Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestDownloadFileWithResultRunsHooksInOrder(t *testing.T) {
+	content := testContent(10000)
+	server := newContentServer(content)
+	defer server.Close()
+	fs := &lib.MemFS{}
+	var seen string
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}, Hooks: []lib.Hook{
+		&lib.VerifyHook{Digest: sha256Digest(content)},
+		&lib.ChmodHook{Mode: 0600},
+		&lib.MoveHook{Template: "{{.Host}}/{{.Base}}-v1{{.Ext}}"},
+		lib.HookFunc("notify", func(file *lib.HookFile) (string, error) {
+			seen = file.Path
+			return "sent", nil
+		}),
+	}}
+
+	result, err := downloader.DownloadFileWithResult("dl", server.URL+"/tool.bin", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "dl/127.0.0.1/tool-v1.bin", result.Path)
+	assert.Equal(t, result.Path, seen)
+	assert.Equal(t, []lib.HookResult{
+		{Name: "verify", Output: sha256Digest(content)},
+		{Name: "chmod", Output: "0600"},
+		{Name: "move", Output: "dl/127.0.0.1/tool-v1.bin"},
+		{Name: "notify", Output: "sent"},
+	}, result.Hooks)
+	assert.Equal(t, []string{"dl/127.0.0.1/tool-v1.bin"}, fs.Files())
+	info, err := fs.Stat(result.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestDownloadFileSingleAndWithDigestReturnTheirResult(t *testing.T) {
+	content := testContent(1000)
+	server := newContentServer(content)
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}, Hooks: []lib.Hook{&lib.ChmodHook{Mode: 0640}}}
+
+	result, err := downloader.DownloadFileSingleWithResult("single", server.URL+"/tool.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, &lib.DownloadResult{URL: server.URL + "/tool.bin", Path: "single/tool.bin", Hooks: []lib.HookResult{{Name: "chmod", Output: "0640"}}}, result)
+
+	result, err = downloader.DownloadFileWithDigest("digest", server.URL+"/tool.bin", sha256Digest(content), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, &lib.DownloadResult{URL: server.URL + "/tool.bin", Path: "digest/tool.bin", Hooks: []lib.HookResult{{Name: "chmod", Output: "0640"}}}, result)
+}
+
+func TestFailingHookStopsThePipeline(t *testing.T) {
+	server := newContentServer(testContent(100))
+	defer server.Close()
+	ran := false
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: &lib.MemFS{}}, Hooks: []lib.Hook{
+		lib.HookFunc("scan", func(file *lib.HookFile) (string, error) {
+			return "1 threat", errors.New("infected")
+		}),
+		lib.HookFunc("publish", func(file *lib.HookFile) (string, error) {
+			ran = true
+			return "", nil
+		}),
+	}}
+
+	result, err := downloader.DownloadFileWithResult("dl", server.URL+"/file.bin", 1)
+	assert.EqualError(t, err, "scan hook failed for "+server.URL+"/file.bin: infected")
+	assert.Equal(t, []lib.HookResult{{Name: "scan", Output: "1 threat", Error: "infected"}}, result.Hooks)
+	assert.False(t, ran)
+}
+
+func TestCommandHookDescribesTheFileInItsEnvironment(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	content := testContent(1234)
+	server := newContentServer(content)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "hooks")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{}, Hooks: []lib.Hook{
+		&lib.CommandHook{Command: []string{"sh", "-c", `echo "$GODOWNLOAD_NAME $GODOWNLOAD_SIZE $GODOWNLOAD_PATH"`}},
+		&lib.CommandHook{Command: []string{"sh", "-c", "echo failed >&2; exit 3"}},
+	}}
+
+	result, err := downloader.DownloadFileWithResult(dir, server.URL+"/data.bin", 2)
+	assert.Error(t, err)
+	assert.Len(t, result.Hooks, 2)
+	assert.Equal(t, "data.bin 1234 "+filepath.Join(dir, "data.bin"), result.Hooks[0].Output)
+	assert.Equal(t, "failed", result.Hooks[1].Output)
+	assert.True(t, strings.Contains(result.Hooks[1].Error, "exit status 3"))
+}
+
+func TestJobQueueKeepsHookResults(t *testing.T) {
+	content := testContent(2048)
+	server := newContentServer(content)
+	defer server.Close()
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: &lib.MemFS{}}, Hooks: []lib.Hook{
+		&lib.VerifyHook{Digest: sha256Digest(content)},
+	}}
+	queue, err := lib.NewJobQueue(downloader, lib.QueueOptions{Dir: "jobs"})
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	job, err := queue.Add(server.URL+"/file.bin", lib.JobOptions{})
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return jobStatus(queue, job.ID) == lib.JobComplete })
+	job, err = queue.Status(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []lib.HookResult{{Name: "verify", Output: sha256Digest(content)}}, job.Hooks)
+}
@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const defaultHostBackoff = 10 * time.Second
+
+// HostLimitClient keeps the calls of the wrapped Client polite towards each
+// host. At most MaxConnections requests to a host are open at once, a
+// download holding its connection until its body is closed, new requests to
+// a host start at least Delay apart, and a 429 or 503 from a host pauses all
+// requests to it for its Retry-After or Backoff. Share one HostLimitClient
+// between downloads for the limits to hold across them. Wrap it in a
+// RetryClient so retries wait for the pause too.
+type HostLimitClient struct {
+	Client Client
+	// MaxConnections per host, zero means unlimited.
+	MaxConnections int
+	Delay          time.Duration
+	Backoff        time.Duration
+	mutex          sync.Mutex
+	hosts          map[string]*hostLimit
+}
+
+type hostLimit struct {
+	slots chan struct{}
+	// next is when the following request may start.
+	next time.Time
+}
+
+func (c *HostLimitClient) ResumeGet(url string, existingFileSize int64) (resp *Response, err error) {
+	return c.limit(url, true, func() (*Response, error) {
+		return c.Client.ResumeGet(url, existingFileSize)
+	})
+}
+
+func (c *HostLimitClient) Head(url string) (resp *Response, err error) {
+	return c.limit(url, false, func() (*Response, error) {
+		return c.Client.Head(url)
+	})
+}
+
+func (c *HostLimitClient) HeadIfChanged(url string, validators Validators) (resp *Response, err error) {
+	return c.limit(url, false, func() (*Response, error) {
+		return headIfChanged(c.Client, url, validators)
+	})
+}
+
+func (c *HostLimitClient) Get(url string, rangeHeader string) (resp *Response, err error) {
+	return c.limit(url, true, func() (*Response, error) {
+		return c.Client.Get(url, rangeHeader)
+	})
+}
+
+// limit runs call within the limits of its host. With withBody the
+// connection slot is held until the response body is closed, Head bodies are
+// empty and not always closed.
+func (c *HostLimitClient) limit(rawURL string, withBody bool, call func() (*Response, error)) (*Response, error) {
+	host := c.host(rawURL)
+	if host.slots != nil {
+		host.slots <- struct{}{}
+	}
+	release := func() {
+		if host.slots != nil {
+			<-host.slots
+		}
+	}
+
+	c.mutex.Lock()
+	start := time.Now()
+	if host.next.After(start) {
+		start = host.next
+	}
+	host.next = start.Add(c.Delay)
+	c.mutex.Unlock()
+	time.Sleep(time.Until(start))
+
+	resp, err := call()
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && (statusErr.StatusCode == 429 || statusErr.StatusCode == 503) {
+		pause := statusErr.RetryAfter
+		if pause <= 0 {
+			pause = c.Backoff
+		}
+		if pause <= 0 {
+			pause = defaultHostBackoff
+		}
+		c.mutex.Lock()
+		if until := time.Now().Add(pause); until.After(host.next) {
+			host.next = until
+		}
+		c.mutex.Unlock()
+	}
+	if err != nil || !withBody || resp.Body == nil {
+		release()
+		return resp, err
+	}
+	resp.Body = &hostLimitBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+func (c *HostLimitClient) host(rawURL string) *hostLimit {
+	name := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		name = u.Host
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.hosts == nil {
+		c.hosts = map[string]*hostLimit{}
+	}
+	host, ok := c.hosts[name]
+	if !ok {
+		host = &hostLimit{}
+		if c.MaxConnections > 0 {
+			host.slots = make(chan struct{}, c.MaxConnections)
+		}
+		c.hosts[name] = host
+	}
+	return host
+}
+
+// hostLimitBody gives the connection slot back once the body is closed.
+type hostLimitBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *hostLimitBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,100 @@
+package lib_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/amithnair91/godownload/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostLimitClientLimitsConnectionsAcrossDownloads(t *testing.T) {
+	content := testContent(8 * 1024)
+	var mutex sync.Mutex
+	open, maxOpen := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		open++
+		if open > maxOpen {
+			maxOpen = open
+		}
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			open--
+			mutex.Unlock()
+		}()
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	client := &lib.HostLimitClient{Client: lib.NewProtocolClient(), MaxConnections: 2}
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"a.bin", "b.bin"} {
+		dir, err := ioutil.TempDir("", "godownload")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+		wg.Add(1)
+		go func(dir string, name string) {
+			defer wg.Done()
+			downloader := lib.Downloader{FileUtils: &lib.File{}, Client: client}
+			assert.NoError(t, downloader.DownloadFileConcurrent(dir, server.URL+"/"+name, 4))
+			data, err := ioutil.ReadFile(filepath.Join(dir, name))
+			assert.NoError(t, err)
+			assert.Equal(t, content, data)
+		}(dir, name)
+	}
+	wg.Wait()
+	assert.Equal(t, 2, maxOpen)
+}
+
+func TestHostLimitClientSpacesRequestsToAHost(t *testing.T) {
+	url := "http://example.com/file.txt"
+	mockClient := &mocks.MockClient{}
+	mockClient.On("Head", url).Return(&lib.Response{ContentLength: 10}, nil)
+	client := &lib.HostLimitClient{Client: mockClient, Delay: 40 * time.Millisecond}
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		_, err := client.Head(url)
+		assert.NoError(t, err)
+	}
+	assert.True(t, time.Since(start) >= 120*time.Millisecond, "took %v", time.Since(start))
+}
+
+func TestHostLimitClientBacksOffHostAfterTooManyRequests(t *testing.T) {
+	url := "http://example.com/file.txt"
+	otherURL := "http://example.org/file.txt"
+	unavailable := &lib.StatusError{URL: url, StatusCode: 503, Status: "503 Service Unavailable"}
+	tooMany := &lib.StatusError{URL: url, StatusCode: 429, Status: "429 Too Many Requests", RetryAfter: 150 * time.Millisecond}
+	mockClient := &mocks.MockClient{}
+	mockClient.On("Head", url).Return(nil, unavailable).Once()
+	mockClient.On("Head", url).Return(nil, tooMany).Once()
+	mockClient.On("Head", url).Return(&lib.Response{ContentLength: 10}, nil)
+	mockClient.On("Head", otherURL).Return(&lib.Response{ContentLength: 20}, nil)
+	hostLimit := &lib.HostLimitClient{Client: mockClient, Backoff: 100 * time.Millisecond}
+	client := &lib.RetryClient{Client: hostLimit, Attempts: 3, Backoff: time.Millisecond}
+
+	start := time.Now()
+	_, err := hostLimit.Head(url)
+	assert.Equal(t, unavailable, err)
+	_, err = hostLimit.Head(otherURL)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "took %v", time.Since(start))
+
+	resp, err := client.Head(url)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), resp.ContentLength)
+	assert.True(t, time.Since(start) >= 250*time.Millisecond, "took %v", time.Since(start))
+	mockClient.AssertNumberOfCalls(t, "Head", 4)
+}
@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// JobStore keeps the jobs of a JobQueue across restarts.
+type JobStore interface {
+	Load() ([]Job, error)
+	Save(jobs []Job) error
+}
+
+// FileJobStore keeps jobs in a JSON file that is rewritten atomically, so a
+// crash leaves either the old or the new state behind.
+type FileJobStore struct {
+	Path string
+}
+
+type jobJournal struct {
+	Jobs []Job `json:"jobs"`
+}
+
+func (s *FileJobStore) Load() ([]Job, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var journal jobJournal
+	if err = json.Unmarshal(data, &journal); err != nil {
+		return nil, fmt.Errorf("unable to read job store %s: %v", s.Path, err)
+	}
+	return journal.Jobs, nil
+}
+
+func (s *FileJobStore) Save(jobs []Job) error {
+	data, err := json.MarshalIndent(jobJournal{Jobs: jobs}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(s.Path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tempPath := s.Path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, s.Path)
+}
@@ -0,0 +1,173 @@
+package lib_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobQueueResumesJobsAfterRestart(t *testing.T) {
+	content := testContent(16 * 1024)
+	server := newGatedTestServer(map[string][]byte{"/big.bin": content}, "/big.bin")
+	server.etag = `"v1"`
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := &lib.FileJobStore{Path: filepath.Join(dir, "state", "jobs.json")}
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}
+
+	queue, err := lib.NewJobQueue(downloader, lib.QueueOptions{Dir: dir, Concurrency: 2, Store: store})
+	assert.NoError(t, err)
+	job, err := queue.Add(server.URL+"/big.bin", lib.JobOptions{})
+	assert.NoError(t, err)
+	waitFor(t, func() bool {
+		job, _ := queue.Status(job.ID)
+		return job.DoneBytes == 2048
+	})
+	queue.Close()
+
+	jobs, err := store.Load()
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, lib.JobQueued, jobs[0].Status)
+	assert.Equal(t, "big.bin", jobs[0].FileName)
+	assert.Equal(t, []lib.JobSegment{{Range: "0-8191", Done: 1024}, {Range: "8192-16383", Done: 1024}}, jobs[0].Segments)
+
+	server.open("/big.bin")
+	queue, err = lib.NewJobQueue(downloader, lib.QueueOptions{Dir: dir, Concurrency: 2, Store: store})
+	assert.NoError(t, err)
+	defer queue.Close()
+	waitFor(t, func() bool { return jobStatus(queue, job.ID) == lib.JobComplete })
+
+	downloaded, err := ioutil.ReadFile(filepath.Join(dir, "big.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+	assert.ElementsMatch(t, []string{"bytes=0-8191", "bytes=8192-16383", "bytes=1024-8191", "bytes=9216-16383"}, server.requestedRanges())
+	jobs, err = store.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, lib.JobComplete, jobs[0].Status)
+	assert.Empty(t, jobs[0].Segments)
+}
+
+func TestJobQueueRestartsJobsWithoutValidatorsAfterRestart(t *testing.T) {
+	content := testContent(16 * 1024)
+	server := newGatedTestServer(map[string][]byte{"/big.bin": content}, "/big.bin")
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := &lib.FileJobStore{Path: filepath.Join(dir, "jobs.json")}
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}
+
+	queue, err := lib.NewJobQueue(downloader, lib.QueueOptions{Dir: dir, Concurrency: 2, Store: store})
+	assert.NoError(t, err)
+	job, err := queue.Add(server.URL+"/big.bin", lib.JobOptions{})
+	assert.NoError(t, err)
+	waitFor(t, func() bool {
+		job, _ := queue.Status(job.ID)
+		return job.DoneBytes == 2048
+	})
+	queue.Close()
+
+	server.open("/big.bin")
+	queue, err = lib.NewJobQueue(downloader, lib.QueueOptions{Dir: dir, Concurrency: 2, Store: store})
+	assert.NoError(t, err)
+	defer queue.Close()
+	waitFor(t, func() bool { return jobStatus(queue, job.ID) == lib.JobComplete })
+
+	downloaded, err := ioutil.ReadFile(filepath.Join(dir, "big.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+	assert.ElementsMatch(t, []string{"bytes=0-8191", "bytes=8192-16383", "bytes=0-8191", "bytes=8192-16383"}, server.requestedRanges())
+}
+
+func TestJobQueueDropsFinishedJobsAfterRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := &lib.FileJobStore{Path: filepath.Join(dir, "jobs.json")}
+	assert.NoError(t, store.Save([]lib.Job{
+		{ID: "old", URL: "http://localhost/old", Status: lib.JobComplete, Finished: time.Now().Add(-48 * time.Hour)},
+		{ID: "recent", URL: "http://localhost/recent", Status: lib.JobError, Finished: time.Now().Add(-time.Hour)},
+		{ID: "paused", URL: "http://localhost/paused", Status: lib.JobPaused},
+	}))
+
+	queue, err := lib.NewJobQueue(lib.Downloader{}, lib.QueueOptions{Dir: dir, Store: store, Retention: 24 * time.Hour})
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	var ids []string
+	for _, job := range queue.List() {
+		ids = append(ids, job.ID)
+	}
+	assert.ElementsMatch(t, []string{"recent", "paused"}, ids)
+	jobs, err := store.Load()
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 2)
+}
+
+func TestJobQueueDropsFinishedJobsAfterRetentionWithoutStore(t *testing.T) {
+	server := newGatedTestServer(map[string][]byte{"/file.bin": testContent(100)})
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	queue, err := lib.NewJobQueue(lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}, lib.QueueOptions{Dir: dir, Retention: time.Nanosecond})
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	_, err = queue.Add(server.URL+"/file.bin", lib.JobOptions{})
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return len(queue.List()) == 0 })
+	_, err = os.Stat(filepath.Join(dir, "file.bin"))
+	assert.NoError(t, err)
+}
+
+type failingJobStore struct{}
+
+func (failingJobStore) Load() ([]lib.Job, error) {
+	return nil, nil
+}
+
+func (failingJobStore) Save(jobs []lib.Job) error {
+	return errors.New("disk full")
+}
+
+func TestJobQueuePublishesStoreErrors(t *testing.T) {
+	queue, err := lib.NewJobQueue(lib.Downloader{}, lib.QueueOptions{Store: failingJobStore{}})
+	assert.NoError(t, err)
+	defer queue.Close()
+	events, unsubscribe := queue.Subscribe()
+	defer unsubscribe()
+
+	_, err = queue.Add("http://localhost/later.bin", lib.JobOptions{StartAfter: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type != "error" {
+				continue
+			}
+			assert.Equal(t, "unable to save jobs: disk full", event.Error)
+			assert.Empty(t, event.Job.ID)
+			return
+		case <-timeout:
+			t.Fatal("no error event")
+		}
+	}
+}
+
+func TestFileJobStoreLoadsNothingWhenMissing(t *testing.T) {
+	store := &lib.FileJobStore{Path: filepath.Join(os.TempDir(), "godownload-missing", "jobs.json")}
+	jobs, err := store.Load()
+	assert.NoError(t, err)
+	assert.Empty(t, jobs)
+}
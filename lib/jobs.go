@@ -0,0 +1,796 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobQueued   JobStatus = "queued"
+	JobActive   JobStatus = "active"
+	JobPaused   JobStatus = "paused"
+	JobComplete JobStatus = "complete"
+	JobError    JobStatus = "error"
+	JobRemoved  JobStatus = "removed"
+)
+
+const (
+	defaultMaxActiveJobs = 5
+	defaultJobSegments   = 4
+	jobProgressInterval  = 500 * time.Millisecond
+	jobSaveInterval      = 5 * time.Second
+)
+
+var errJobStopped = errors.New("job stopped")
+
+// Job is a snapshot of a download submitted to a JobQueue.
+type Job struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Dir         string    `json:"dir"`
+	Concurrency int64     `json:"concurrency"`
+	Priority    int       `json:"priority"`
+	Status      JobStatus `json:"status"`
+	TotalBytes  int64     `json:"totalBytes"`
+	DoneBytes   int64     `json:"doneBytes"`
+	// Speed in bytes per second and Connections are kept while active.
+	Speed       int64     `json:"speed"`
+	Connections int       `json:"connections"`
+	Error       string    `json:"error,omitempty"`
+	Created     time.Time `json:"created"`
+	Finished    time.Time `json:"finished,omitempty"`
+	// StartAfter holds a queued job back until then. Jobs with a Schedule
+	// are queued again for its next time once they finish.
+	StartAfter time.Time `json:"startAfter,omitempty"`
+	Schedule   string    `json:"schedule,omitempty"`
+	// FileName, the validators of the remote file and the Segments being
+	// downloaded let an interrupted job continue its part files.
+	FileName     string       `json:"fileName,omitempty"`
+	ETag         string       `json:"etag,omitempty"`
+	LastModified time.Time    `json:"lastModified,omitempty"`
+	Segments     []JobSegment `json:"segments,omitempty"`
+	// Hooks are the results of the downloader hooks of the last run.
+	Hooks []HookResult `json:"hooks,omitempty"`
+	// Signer made the signature the file of the last run was verified with.
+	Signer *Signer `json:"signer,omitempty"`
+}
+
+// JobSegment is a byte range of a job and how much of it is on disk.
+type JobSegment struct {
+	Range string `json:"range"`
+	Done  int64  `json:"done"`
+}
+
+// JobOptions are given when a job is added, zero values fall back to the
+// QueueOptions. Schedule is a cron expression such as "0 3 * * *" or
+// "@daily", a scheduled job first runs at StartAfter or right away.
+type JobOptions struct {
+	Dir         string    `json:"dir,omitempty"`
+	Concurrency int64     `json:"concurrency,omitempty"`
+	Priority    int       `json:"priority,omitempty"`
+	StartAfter  time.Time `json:"startAfter,omitempty"`
+	Schedule    string    `json:"schedule,omitempty"`
+}
+
+type QueueOptions struct {
+	// MaxActive is the number of jobs downloading at once.
+	MaxActive   int    `json:"maxActive,omitempty"`
+	Dir         string `json:"dir,omitempty"`
+	Concurrency int64  `json:"concurrency,omitempty"`
+	// Bandwidth limits the combined speed of all jobs by time of day, the
+	// first matching rule applies.
+	Bandwidth []BandwidthRule `json:"bandwidth,omitempty"`
+	// Store keeps the jobs across restarts when set. Finished jobs are
+	// dropped from the queue and the Store after Retention, or kept forever
+	// when it is zero.
+	Store     JobStore      `json:"-"`
+	Retention time.Duration `json:"-"`
+}
+
+// JobEvent is published when a job changes status and periodically while it
+// is active. Type is "status" or "progress", or "error" without a Job when
+// the jobs couldn't be saved to the Store, as told by Error.
+type JobEvent struct {
+	Type  string `json:"type"`
+	Job   Job    `json:"job"`
+	Error string `json:"error,omitempty"`
+}
+
+// JobQueue runs downloads in the background with the Downloader it was
+// created with. Jobs with a higher priority start first, jobs of equal
+// priority in the order they were added. Jobs don't start before their
+// StartAfter time. With a Store, jobs that were queued
+// or active when the queue was closed are started again by the next queue,
+// continuing the segments they had downloaded.
+type JobQueue struct {
+	downloader  Downloader
+	mutex       sync.Mutex
+	options     QueueOptions
+	jobs        map[string]*queuedJob
+	seq         int64
+	subscribers map[chan JobEvent]bool
+	closed      chan struct{}
+	running     sync.WaitGroup
+	saved       time.Time
+	limiter     rateLimiter
+}
+
+type queuedJob struct {
+	job Job
+	seq int64
+	run *jobRun
+}
+
+func NewJobQueue(downloader Downloader, options QueueOptions) (*JobQueue, error) {
+	for _, rule := range options.Bandwidth {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if options.MaxActive < 1 {
+		options.MaxActive = defaultMaxActiveJobs
+	}
+	if options.Dir == "" {
+		options.Dir = "."
+	}
+	if options.Concurrency < 1 {
+		options.Concurrency = defaultJobSegments
+	}
+	q := &JobQueue{
+		downloader:  downloader,
+		options:     options,
+		jobs:        map[string]*queuedJob{},
+		subscribers: map[chan JobEvent]bool{},
+		closed:      make(chan struct{}),
+	}
+
+	if options.Store != nil {
+		jobs, err := options.Store.Load()
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(jobs, func(i, j int) bool {
+			return jobs[i].Created.Before(jobs[j].Created)
+		})
+		for _, job := range jobs {
+			if job.Status == JobActive {
+				job.Status = JobQueued
+			}
+			q.seq++
+			q.jobs[job.ID] = &queuedJob{job: job, seq: q.seq}
+		}
+	}
+
+	q.limiter.setLimit(bandwidthLimit(options.Bandwidth, time.Now()))
+	q.mutex.Lock()
+	q.schedule()
+	q.persist()
+	q.mutex.Unlock()
+	go q.reportProgress()
+	return q, nil
+}
+
+func (q *JobQueue) Add(rawURL string, options JobOptions) (Job, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Job{}, err
+	}
+	if u.Scheme == "" || u.Path == "" {
+		return Job{}, fmt.Errorf("invalid url %q", rawURL)
+	}
+	if options.Schedule != "" {
+		if _, err = ParseCronSchedule(options.Schedule); err != nil {
+			return Job{}, err
+		}
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if options.Dir == "" {
+		options.Dir = q.options.Dir
+	}
+	if options.Concurrency < 1 {
+		options.Concurrency = q.options.Concurrency
+	}
+	q.seq++
+	entry := &queuedJob{seq: q.seq, job: Job{
+		ID:          newJobID(),
+		URL:         rawURL,
+		Dir:         options.Dir,
+		Concurrency: options.Concurrency,
+		Priority:    options.Priority,
+		Status:      JobQueued,
+		Created:     time.Now(),
+		StartAfter:  options.StartAfter,
+		Schedule:    options.Schedule,
+	}}
+	q.jobs[entry.job.ID] = entry
+	q.publish("status", entry)
+	q.schedule()
+	q.persist()
+	return q.snapshot(entry), nil
+}
+
+// Pause holds a queued job back or stops an active one, Resume queues it
+// again. A resumed download continues its segments if the remote file is
+// unchanged.
+func (q *JobQueue) Pause(id string) (Job, error) {
+	return q.transition(id, func(entry *queuedJob) error {
+		switch entry.job.Status {
+		case JobQueued:
+			q.setStatus(entry, JobPaused, nil)
+		case JobActive:
+			entry.run.stop(JobPaused)
+		default:
+			return fmt.Errorf("job %s is %s and can't be paused", id, entry.job.Status)
+		}
+		return nil
+	})
+}
+
+func (q *JobQueue) Resume(id string) (Job, error) {
+	return q.transition(id, func(entry *queuedJob) error {
+		if entry.job.Status != JobPaused {
+			return fmt.Errorf("job %s is %s and can't be resumed", id, entry.job.Status)
+		}
+		q.setStatus(entry, JobQueued, nil)
+		return nil
+	})
+}
+
+func (q *JobQueue) Cancel(id string) (Job, error) {
+	return q.transition(id, func(entry *queuedJob) error {
+		switch entry.job.Status {
+		case JobQueued, JobPaused:
+			q.setStatus(entry, JobRemoved, nil)
+		case JobActive:
+			entry.run.stop(JobRemoved)
+		default:
+			return fmt.Errorf("job %s is %s and can't be cancelled", id, entry.job.Status)
+		}
+		return nil
+	})
+}
+
+func (q *JobQueue) ChangePriority(id string, priority int) (Job, error) {
+	return q.transition(id, func(entry *queuedJob) error {
+		entry.job.Priority = priority
+		return nil
+	})
+}
+
+// SetJobOptions changes the directory, number of segments, start time and
+// schedule of a job that hasn't finished. An active job picks them up when it
+// is next started.
+func (q *JobQueue) SetJobOptions(id string, options JobOptions) (Job, error) {
+	if options.Schedule != "" {
+		if _, err := ParseCronSchedule(options.Schedule); err != nil {
+			return Job{}, err
+		}
+	}
+	return q.transition(id, func(entry *queuedJob) error {
+		switch entry.job.Status {
+		case JobComplete, JobError, JobRemoved:
+			return fmt.Errorf("job %s is %s and can't be changed", id, entry.job.Status)
+		}
+		if !options.StartAfter.IsZero() {
+			entry.job.StartAfter = options.StartAfter
+		}
+		if options.Schedule != "" {
+			entry.job.Schedule = options.Schedule
+		}
+		if options.Dir != "" {
+			entry.job.Dir = options.Dir
+		}
+		if options.Concurrency > 0 {
+			entry.job.Concurrency = options.Concurrency
+		}
+		return nil
+	})
+}
+
+func (q *JobQueue) Status(id string) (Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	entry, ok := q.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("job %s not found", id)
+	}
+	return q.snapshot(entry), nil
+}
+
+// List returns every job in the order they were added.
+func (q *JobQueue) List() []Job {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var entries []*queuedJob
+	for _, entry := range q.jobs {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	jobs := []Job{}
+	for _, entry := range entries {
+		jobs = append(jobs, q.snapshot(entry))
+	}
+	return jobs
+}
+
+func (q *JobQueue) Options() QueueOptions {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.options
+}
+
+// SetOptions changes the non zero fields of options and returns the options
+// in effect. New defaults apply to jobs added afterwards, bandwidth rules to
+// every job at once.
+func (q *JobQueue) SetOptions(options QueueOptions) (QueueOptions, error) {
+	for _, rule := range options.Bandwidth {
+		if err := rule.validate(); err != nil {
+			return QueueOptions{}, err
+		}
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if options.Bandwidth != nil {
+		q.options.Bandwidth = options.Bandwidth
+		q.limiter.setLimit(bandwidthLimit(options.Bandwidth, time.Now()))
+	}
+	if options.MaxActive > 0 {
+		q.options.MaxActive = options.MaxActive
+	}
+	if options.Dir != "" {
+		q.options.Dir = options.Dir
+	}
+	if options.Concurrency > 0 {
+		q.options.Concurrency = options.Concurrency
+	}
+	q.schedule()
+	return q.options, nil
+}
+
+// Subscribe returns a channel of job events and a function that stops them.
+// Events are dropped for subscribers that don't keep up.
+func (q *JobQueue) Subscribe() (<-chan JobEvent, func()) {
+	events := make(chan JobEvent, 64)
+	q.mutex.Lock()
+	q.subscribers[events] = true
+	q.mutex.Unlock()
+	return events, func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		if q.subscribers[events] {
+			delete(q.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// Close stops the active jobs and the queue from starting new ones. The
+// stopped jobs are queued again, so a queue sharing the Store picks them up.
+// It returns once they have been saved.
+func (q *JobQueue) Close() {
+	q.mutex.Lock()
+	select {
+	case <-q.closed:
+		q.mutex.Unlock()
+		return
+	default:
+	}
+	close(q.closed)
+	for _, entry := range q.jobs {
+		if entry.job.Status == JobActive {
+			entry.run.stop(JobQueued)
+		}
+	}
+	q.mutex.Unlock()
+	q.running.Wait()
+}
+
+func (q *JobQueue) transition(id string, change func(entry *queuedJob) error) (Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	entry, ok := q.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("job %s not found", id)
+	}
+	if err := change(entry); err != nil {
+		return Job{}, err
+	}
+	q.schedule()
+	q.persist()
+	return q.snapshot(entry), nil
+}
+
+// schedule starts the queued jobs with the highest priority while there are
+// free slots. It must be called with the mutex held.
+func (q *JobQueue) schedule() {
+	select {
+	case <-q.closed:
+		return
+	default:
+	}
+	now := time.Now()
+	active := 0
+	var queued []*queuedJob
+	for _, entry := range q.jobs {
+		switch entry.job.Status {
+		case JobActive:
+			active++
+		case JobQueued:
+			if !entry.job.StartAfter.After(now) {
+				queued = append(queued, entry)
+			}
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		if queued[i].job.Priority != queued[j].job.Priority {
+			return queued[i].job.Priority > queued[j].job.Priority
+		}
+		return queued[i].seq < queued[j].seq
+	})
+	for _, entry := range queued {
+		if active >= q.options.MaxActive {
+			return
+		}
+		active++
+		entry.run = &jobRun{done: make(chan struct{}), bodies: map[io.Closer]bool{}}
+		q.setStatus(entry, JobActive, nil)
+		q.running.Add(1)
+		go q.download(entry, entry.run)
+	}
+}
+
+func (q *JobQueue) download(entry *queuedJob, run *jobRun) {
+	defer q.running.Done()
+	q.mutex.Lock()
+	job := entry.job
+	q.mutex.Unlock()
+
+	downloader := q.downloader
+	downloader.Client = &jobClient{client: q.downloader.Client, run: run, url: job.URL, limiter: &q.limiter}
+	result, err := q.fetch(entry, &downloader, job, run)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	entry.job.DoneBytes = atomic.LoadInt64(&run.bytes)
+	entry.job.TotalBytes = atomic.LoadInt64(&run.total)
+	entry.run = nil
+	select {
+	case <-run.done:
+		if run.reason == JobRemoved {
+			removeSegments(q.downloader.fs(), entry.job)
+			entry.job.Segments = nil
+		}
+		q.setStatus(entry, run.reason, nil)
+	default:
+		if result != nil {
+			entry.job.Hooks = result.Hooks
+			entry.job.Signer = result.Signer
+		}
+		if err != nil {
+			q.setStatus(entry, JobError, err)
+		} else {
+			entry.job.Segments = nil
+			q.setStatus(entry, JobComplete, nil)
+		}
+		if entry.job.Schedule != "" {
+			if schedule, err := ParseCronSchedule(entry.job.Schedule); err == nil {
+				entry.job.StartAfter = schedule.Next(time.Now())
+				q.setStatus(entry, JobQueued, nil)
+			}
+		}
+	}
+	q.schedule()
+}
+
+// fetch splits a job into segments, or takes over those of an earlier
+// attempt when the remote file is unchanged, downloads them and runs the
+// hooks of the downloader on the result.
+func (q *JobQueue) fetch(entry *queuedJob, downloader *Downloader, job Job, run *jobRun) (*DownloadResult, error) {
+	check, err := downloader.signatureCheck(job.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	headResp, err := downloader.Client.Head(job.URL)
+	if err != nil {
+		return nil, err
+	}
+	rangeList := populateRangeList(headResp.ContentLength, job.Concurrency, 0)
+	resume := job.FileName != "" && unchanged(job, headResp) && len(job.Segments) == len(rangeList)
+	for index := 0; resume && index < len(rangeList); index++ {
+		resume = job.Segments[index].Range == rangeList[index]
+	}
+
+	filePath := fmt.Sprintf("%s/%s", job.Dir, job.FileName)
+	if job.FileName != "" && len(job.Segments) == 0 && unchanged(job, headResp) {
+		// a scheduled job whose file hasn't changed since the last run
+		if info, err := downloader.fs().Stat(filePath); err == nil && info.Size() == headResp.ContentLength {
+			atomic.StoreInt64(&run.bytes, headResp.ContentLength)
+			return nil, nil
+		}
+	}
+
+	if resume {
+		job.Segments = segmentProgress(downloader.fs(), job)
+		for _, segment := range job.Segments {
+			atomic.AddInt64(&run.bytes, segment.Done)
+		}
+	} else {
+		// an earlier version of the file stays until the new one replaces it
+		if job.FileName == "" {
+			if job.FileName, err = downloader.targetFileName(job.Dir, job.URL); err != nil {
+				return nil, err
+			}
+		}
+		job.Segments = nil
+		for _, rangeHeader := range rangeList {
+			job.Segments = append(job.Segments, JobSegment{Range: rangeHeader})
+		}
+	}
+	q.mutex.Lock()
+	entry.job.FileName = job.FileName
+	entry.job.ETag = headResp.ETag
+	entry.job.LastModified = headResp.LastModified
+	entry.job.Segments = job.Segments
+	q.persist()
+	q.mutex.Unlock()
+
+	download := func() error {
+		return downloader.downloadSegments(job.Dir, job.FileName, job.URL, rangeList, headResp, resume, check.partCheck())
+	}
+	if downloader.Cache != nil {
+		err = downloader.downloadCached(job.Dir, job.FileName, job.URL, headResp, "", download, check.partCheck())
+	} else {
+		err = download()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return downloader.runHooks(job.URL, fmt.Sprintf("%s/%s", job.Dir, job.FileName), headResp.Digest, check.verifiedSigner())
+}
+
+func (q *JobQueue) setStatus(entry *queuedJob, status JobStatus, err error) {
+	entry.job.Status = status
+	entry.job.Speed = 0
+	entry.job.Error = ""
+	if err != nil {
+		entry.job.Error = err.Error()
+	}
+	if status == JobComplete || status == JobError || status == JobRemoved {
+		entry.job.Finished = time.Now()
+	}
+	q.publish("status", entry)
+	q.persist()
+}
+
+// unchanged reports whether the remote file still has the validators it had
+// when the job last fetched it.
+func unchanged(job Job, headResp *Response) bool {
+	if job.ETag == "" && job.LastModified.IsZero() {
+		return false
+	}
+	return job.ETag == headResp.ETag && job.LastModified.Equal(headResp.LastModified)
+}
+
+// persist drops finished jobs older than the retention and saves the others
+// to the store, if any. It must be called with the mutex held.
+func (q *JobQueue) persist() {
+	var entries []*queuedJob
+	for id, entry := range q.jobs {
+		finished := entry.job.Status == JobComplete || entry.job.Status == JobError || entry.job.Status == JobRemoved
+		if finished && q.options.Retention > 0 && time.Since(entry.job.Finished) > q.options.Retention {
+			delete(q.jobs, id)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if q.options.Store == nil {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	jobs := []Job{}
+	for _, entry := range entries {
+		job := q.snapshot(entry)
+		job.Segments = segmentProgress(q.downloader.fs(), job)
+		jobs = append(jobs, job)
+	}
+	if err := q.options.Store.Save(jobs); err != nil {
+		q.broadcast(JobEvent{Type: "error", Error: fmt.Sprintf("unable to save jobs: %v", err)})
+	}
+	q.saved = time.Now()
+}
+
+// segmentProgress returns the segments of a job with the bytes on disk for
+// each of them.
+func segmentProgress(fs FS, job Job) []JobSegment {
+	var segments []JobSegment
+	for index, segment := range job.Segments {
+		segment.Done = 0
+		if info, err := fs.Stat(fmt.Sprintf("%s/%d-%s", job.Dir, index, job.FileName)); err == nil {
+			segment.Done = info.Size()
+		}
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+func removeSegments(fs FS, job Job) {
+	for index := range job.Segments {
+		fs.Remove(fmt.Sprintf("%s/%d-%s", job.Dir, index, job.FileName))
+	}
+}
+
+func (q *JobQueue) snapshot(entry *queuedJob) Job {
+	job := entry.job
+	if entry.run != nil {
+		job.DoneBytes = atomic.LoadInt64(&entry.run.bytes)
+		job.TotalBytes = atomic.LoadInt64(&entry.run.total)
+		entry.run.mutex.Lock()
+		job.Connections = len(entry.run.bodies)
+		entry.run.mutex.Unlock()
+	}
+	return job
+}
+
+func (q *JobQueue) publish(eventType string, entry *queuedJob) {
+	q.broadcast(JobEvent{Type: eventType, Job: q.snapshot(entry)})
+}
+
+func (q *JobQueue) broadcast(event JobEvent) {
+	for subscriber := range q.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+func (q *JobQueue) reportProgress() {
+	ticker := time.NewTicker(jobProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.closed:
+			return
+		case <-ticker.C:
+			q.mutex.Lock()
+			for _, entry := range q.jobs {
+				if entry.job.Status == JobActive && entry.run != nil {
+					bytes := atomic.LoadInt64(&entry.run.bytes)
+					entry.job.Speed = (bytes - entry.run.reported) * int64(time.Second) / int64(jobProgressInterval)
+					entry.run.reported = bytes
+					q.publish("progress", entry)
+				}
+			}
+			if time.Since(q.saved) >= jobSaveInterval {
+				q.persist()
+			}
+			q.limiter.setLimit(bandwidthLimit(q.options.Bandwidth, time.Now()))
+			// start jobs whose time has come
+			q.schedule()
+			q.mutex.Unlock()
+		}
+	}
+}
+
+// newJobID returns 16 hex digits, the format aria2 uses for its GIDs.
+func newJobID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// jobRun tracks one attempt at a job. Stopping it closes the response bodies
+// in flight so blocked reads return at once.
+type jobRun struct {
+	bytes    int64
+	total    int64
+	reported int64
+	done     chan struct{}
+	once     sync.Once
+	reason   JobStatus
+	mutex    sync.Mutex
+	bodies   map[io.Closer]bool
+}
+
+func (r *jobRun) stop(reason JobStatus) {
+	r.once.Do(func() {
+		r.reason = reason
+		close(r.done)
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		for body := range r.bodies {
+			body.Close()
+		}
+	})
+}
+
+func (r *jobRun) stopped() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// jobClient counts the bytes a job reads and aborts its requests once the
+// job is stopped.
+type jobClient struct {
+	client  Client
+	run     *jobRun
+	url     string
+	limiter *rateLimiter
+}
+
+func (c *jobClient) ResumeGet(url string, existingFileSize int64) (resp *Response, err error) {
+	return c.track(c.client.ResumeGet(url, existingFileSize))
+}
+
+func (c *jobClient) Head(url string) (resp *Response, err error) {
+	if c.run.stopped() {
+		return nil, errJobStopped
+	}
+	resp, err = c.client.Head(url)
+	if err == nil && url == c.url {
+		atomic.StoreInt64(&c.run.total, resp.ContentLength)
+	}
+	return resp, err
+}
+
+func (c *jobClient) Get(url string, rangeHeader string) (resp *Response, err error) {
+	return c.track(c.client.Get(url, rangeHeader))
+}
+
+func (c *jobClient) track(resp *Response, err error) (*Response, error) {
+	if err != nil {
+		return nil, err
+	}
+	c.run.mutex.Lock()
+	defer c.run.mutex.Unlock()
+	if c.run.stopped() {
+		resp.Body.Close()
+		return nil, errJobStopped
+	}
+	c.run.bodies[resp.Body] = true
+	resp.Body = &jobBody{ReadCloser: resp.Body, run: c.run, limiter: c.limiter}
+	return resp, nil
+}
+
+type jobBody struct {
+	io.ReadCloser
+	run     *jobRun
+	limiter *rateLimiter
+}
+
+func (b *jobBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p[:b.limiter.chunk(len(p))])
+	atomic.AddInt64(&b.run.bytes, int64(n))
+	b.limiter.wait(n, b.run.done)
+	if err != nil && b.run.stopped() {
+		return n, errJobStopped
+	}
+	return n, err
+}
+
+func (b *jobBody) Close() error {
+	b.run.mutex.Lock()
+	delete(b.run.bodies, b.ReadCloser)
+	b.run.mutex.Unlock()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,343 @@
+package lib_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedTestServer serves files but stalls every transfer of a gated path
+// after its first kilobyte until the gate is opened. It records the ranges
+// requested by GETs, and sends etag when it isn't empty.
+type gatedTestServer struct {
+	*httptest.Server
+	files  map[string][]byte
+	gates  map[string]chan struct{}
+	ranges []string
+	etag   string
+	mutex  sync.Mutex
+}
+
+func newGatedTestServer(files map[string][]byte, gated ...string) *gatedTestServer {
+	s := &gatedTestServer{files: files, gates: map[string]chan struct{}{}}
+	for _, path := range gated {
+		s.gates[path] = make(chan struct{})
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := s.files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.mutex.Lock()
+		gate := s.gates[r.URL.Path]
+		if r.Method == http.MethodGet {
+			s.ranges = append(s.ranges, r.Header.Get("Range"))
+		}
+		if s.etag != "" {
+			w.Header().Set("ETag", s.etag)
+		}
+		s.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(flushingWriter{w}, r, "", time.Time{}, &gatedReader{Reader: bytes.NewReader(content), gate: gate, ctx: r.Context()})
+	}))
+	return s
+}
+
+func (s *gatedTestServer) requestedRanges() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+func (s *gatedTestServer) open(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if gate, ok := s.gates[path]; ok {
+		close(gate)
+		delete(s.gates, path)
+	}
+}
+
+type flushingWriter struct {
+	http.ResponseWriter
+}
+
+func (w flushingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.ResponseWriter.(http.Flusher).Flush()
+	return n, err
+}
+
+type gatedReader struct {
+	*bytes.Reader
+	gate   chan struct{}
+	ctx    context.Context
+	served int
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	if g.gate != nil && g.served >= 1024 {
+		select {
+		case <-g.gate:
+			g.gate = nil
+		case <-g.ctx.Done():
+			return 0, g.ctx.Err()
+		}
+	}
+	if g.gate != nil && len(p) > 1024-g.served {
+		p = p[:1024-g.served]
+	}
+	n, err := g.Reader.Read(p)
+	g.served += n
+	return n, err
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func jobStatus(queue *lib.JobQueue, id string) lib.JobStatus {
+	job, _ := queue.Status(id)
+	return job.Status
+}
+
+func TestJobQueueStartsHigherPriorityJobsFirst(t *testing.T) {
+	server := newGatedTestServer(map[string][]byte{
+		"/first.bin": testContent(4096), "/low.bin": testContent(10), "/high.bin": testContent(20),
+	}, "/first.bin")
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	queue, err := lib.NewJobQueue(lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}, lib.QueueOptions{MaxActive: 1, Dir: dir, Concurrency: 2})
+	assert.NoError(t, err)
+	defer queue.Close()
+	events, unsubscribe := queue.Subscribe()
+	defer unsubscribe()
+
+	first, err := queue.Add(server.URL+"/first.bin", lib.JobOptions{})
+	assert.NoError(t, err)
+	low, err := queue.Add(server.URL+"/low.bin", lib.JobOptions{})
+	assert.NoError(t, err)
+	high, err := queue.Add(server.URL+"/high.bin", lib.JobOptions{Priority: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, lib.JobQueued, jobStatus(queue, low.ID))
+	server.open("/first.bin")
+
+	var started []string
+	for len(started) < 3 {
+		event := <-events
+		if event.Type == "status" && event.Job.Status == lib.JobActive {
+			started = append(started, event.Job.ID)
+		}
+	}
+	assert.Equal(t, []string{first.ID, high.ID, low.ID}, started)
+	waitFor(t, func() bool { return jobStatus(queue, low.ID) == lib.JobComplete })
+	data, err := ioutil.ReadFile(filepath.Join(dir, "high.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, server.files["/high.bin"], data)
+	assert.Len(t, queue.List(), 3)
+}
+
+func TestJobQueuePausesResumesAndCancelsActiveJobs(t *testing.T) {
+	server := newGatedTestServer(map[string][]byte{"/big.bin": testContent(64 * 1024), "/other.bin": testContent(8192)}, "/big.bin", "/other.bin")
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	queue, err := lib.NewJobQueue(lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}, lib.QueueOptions{Dir: dir})
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	big, err := queue.Add(server.URL+"/big.bin", lib.JobOptions{Concurrency: 2})
+	assert.NoError(t, err)
+	other, err := queue.Add(server.URL+"/other.bin", lib.JobOptions{})
+	assert.NoError(t, err)
+	waitFor(t, func() bool {
+		job, _ := queue.Status(big.ID)
+		return job.DoneBytes >= 2048 && job.TotalBytes == 64*1024
+	})
+
+	_, err = queue.Pause(big.ID)
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return jobStatus(queue, big.ID) == lib.JobPaused })
+	_, err = queue.Pause(big.ID)
+	assert.EqualError(t, err, "job "+big.ID+" is paused and can't be paused")
+
+	_, err = queue.Cancel(other.ID)
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return jobStatus(queue, other.ID) == lib.JobRemoved })
+
+	server.open("/big.bin")
+	_, err = queue.Resume(big.ID)
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return jobStatus(queue, big.ID) == lib.JobComplete })
+	data, err := ioutil.ReadFile(filepath.Join(dir, "big.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, server.files["/big.bin"], data)
+
+	_, err = queue.Status("missing")
+	assert.EqualError(t, err, "job missing not found")
+}
+
+func TestJobQueueReportsFailedJobs(t *testing.T) {
+	server := newGatedTestServer(map[string][]byte{})
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	queue, err := lib.NewJobQueue(lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}, lib.QueueOptions{Dir: dir})
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	job, err := queue.Add(server.URL+"/missing.bin", lib.JobOptions{})
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return jobStatus(queue, job.ID) == lib.JobError })
+
+	job, err = queue.Status(job.ID)
+	assert.NoError(t, err)
+	assert.Contains(t, job.Error, "404")
+	_, err = queue.Add("not a url", lib.JobOptions{})
+	assert.EqualError(t, err, `invalid url "not a url"`)
+}
+
+func TestJobQueueStartsJobsAtTheirStartTimeAndSchedule(t *testing.T) {
+	server := newGatedTestServer(map[string][]byte{"/later.bin": testContent(100), "/daily.bin": testContent(2048)})
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	queue, err := lib.NewJobQueue(lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}, lib.QueueOptions{Dir: dir, Concurrency: 1})
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	startAfter := time.Now().Add(700 * time.Millisecond)
+	later, err := queue.Add(server.URL+"/later.bin", lib.JobOptions{StartAfter: startAfter})
+	assert.NoError(t, err)
+	_, err = queue.Add(server.URL+"/daily.bin", lib.JobOptions{Schedule: "every day"})
+	assert.Error(t, err)
+	daily, err := queue.Add(server.URL+"/daily.bin", lib.JobOptions{Schedule: "@daily"})
+	assert.NoError(t, err)
+
+	waitFor(t, func() bool {
+		job, _ := queue.Status(daily.ID)
+		return job.Status == lib.JobQueued && !job.Finished.IsZero()
+	})
+	job, _ := queue.Status(daily.ID)
+	schedule, _ := lib.ParseCronSchedule("@daily")
+	assert.Equal(t, schedule.Next(time.Now()), job.StartAfter)
+	assert.Equal(t, lib.JobQueued, jobStatus(queue, later.ID))
+
+	waitFor(t, func() bool { return jobStatus(queue, later.ID) == lib.JobComplete })
+	assert.False(t, time.Now().Before(startAfter))
+
+	// run the scheduled job again now, it replaces the file
+	_, err = queue.SetJobOptions(daily.ID, lib.JobOptions{StartAfter: time.Now()})
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return len(server.requestedRanges()) == 3 })
+	waitFor(t, func() bool {
+		job, _ := queue.Status(daily.ID)
+		return job.Status == lib.JobQueued && job.StartAfter.After(time.Now())
+	})
+	data, err := ioutil.ReadFile(filepath.Join(dir, "daily.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, server.files["/daily.bin"], data)
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestJobQueueKeepsTheFileWhenARerunFails(t *testing.T) {
+	content := testContent(2048)
+	var changed, failedGets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&changed) == 0 {
+			w.Header().Set("ETag", `"v1"`)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		w.Header().Set("ETag", `"v2"`)
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&failedGets, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	queue, err := lib.NewJobQueue(lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}, lib.QueueOptions{Dir: dir, Concurrency: 1})
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	daily, err := queue.Add(server.URL+"/daily.bin", lib.JobOptions{Schedule: "@daily"})
+	assert.NoError(t, err)
+	waitFor(t, func() bool {
+		job, _ := queue.Status(daily.ID)
+		return job.Status == lib.JobQueued && !job.Finished.IsZero()
+	})
+
+	atomic.StoreInt32(&changed, 1)
+	_, err = queue.SetJobOptions(daily.ID, lib.JobOptions{StartAfter: time.Now()})
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return atomic.LoadInt32(&failedGets) > 0 })
+	waitFor(t, func() bool {
+		job, _ := queue.Status(daily.ID)
+		return job.Status == lib.JobQueued && job.StartAfter.After(time.Now())
+	})
+	data, err := ioutil.ReadFile(filepath.Join(dir, "daily.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestJobQueueLimitsBandwidthByTimeOfDay(t *testing.T) {
+	server := newGatedTestServer(map[string][]byte{"/file.bin": testContent(8 * 1024)})
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = lib.NewJobQueue(lib.Downloader{}, lib.QueueOptions{Bandwidth: []lib.BandwidthRule{{From: "9am", To: "17:00"}}})
+	assert.Error(t, err)
+	queue, err := lib.NewJobQueue(lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}, lib.QueueOptions{
+		Dir:       dir,
+		Bandwidth: []lib.BandwidthRule{{From: "00:00", To: "00:00", Limit: 16 * 1024}},
+	})
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	start := time.Now()
+	job, err := queue.Add(server.URL+"/file.bin", lib.JobOptions{})
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return jobStatus(queue, job.ID) == lib.JobComplete })
+	assert.True(t, time.Since(start) >= 300*time.Millisecond, "took %v", time.Since(start))
+
+	options, err := queue.SetOptions(lib.QueueOptions{Bandwidth: []lib.BandwidthRule{}})
+	assert.NoError(t, err)
+	assert.Empty(t, options.Bandwidth)
+	start = time.Now()
+	job, err = queue.Add(server.URL+"/file.bin", lib.JobOptions{})
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return jobStatus(queue, job.ID) == lib.JobComplete })
+	assert.True(t, time.Since(start) < 300*time.Millisecond, "took %v", time.Since(start))
+}
@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = 1
+)
+
+// rpcMethod handles the params of one JSON-RPC 2.0 call.
+type rpcMethod func(params json.RawMessage) (interface{}, error)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+func invalidParams(err error) error {
+	return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+}
+
+// serveJSONRPC answers a single or batched JSON-RPC 2.0 request posted to r.
+func serveJSONRPC(w http.ResponseWriter, r *http.Request, methods map[string]rpcMethod) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, rpcResponse(nil, nil, &rpcError{Code: rpcParseError, Message: err.Error()}))
+		return
+	}
+
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil || len(batch) == 0 {
+			writeJSON(w, rpcResponse(nil, nil, &rpcError{Code: rpcInvalidRequest, Message: "invalid batch"}))
+			return
+		}
+		responses := []interface{}{}
+		for _, call := range batch {
+			responses = append(responses, callJSONRPC(call, methods))
+		}
+		writeJSON(w, responses)
+		return
+	}
+	writeJSON(w, callJSONRPC(body, methods))
+}
+
+func callJSONRPC(body json.RawMessage, methods map[string]rpcMethod) interface{} {
+	var request rpcRequest
+	if err := json.Unmarshal(body, &request); err != nil || request.Method == "" {
+		return rpcResponse(nil, nil, &rpcError{Code: rpcInvalidRequest, Message: "invalid request"})
+	}
+	method, ok := methods[request.Method]
+	if !ok {
+		return rpcResponse(request.ID, nil, &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + request.Method})
+	}
+	result, err := method(request.Params)
+	if err != nil {
+		callErr, ok := err.(*rpcError)
+		if !ok {
+			callErr = &rpcError{Code: rpcServerError, Message: err.Error()}
+		}
+		return rpcResponse(request.ID, nil, callErr)
+	}
+	return rpcResponse(request.ID, result, nil)
+}
+
+func rpcResponse(id json.RawMessage, result interface{}, err *rpcError) map[string]interface{} {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if err != nil {
+		response["error"] = err
+	} else {
+		response["result"] = result
+	}
+	return response
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
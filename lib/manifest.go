@@ -0,0 +1,395 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest lists the artifacts a directory should hold. It is read from
+// YAML or JSON by ParseManifest.
+type Manifest struct {
+	// Dir is the directory the artifacts are kept in, relative to the
+	// manifest file and below it.
+	Dir       string             `yaml:"dir,omitempty"`
+	Artifacts []ManifestArtifact `yaml:"artifacts"`
+}
+
+// ManifestArtifact is a file of a Manifest. It is fetched from URL, or
+// from URLs in order when one fails, and saved at Path relative to the
+// directory, which defaults to the name in the first url. An artifact with
+// Extract is unpacked after it is downloaded.
+type ManifestArtifact struct {
+	URL     string           `yaml:"url,omitempty"`
+	URLs    []string         `yaml:"urls,omitempty"`
+	Path    string           `yaml:"path,omitempty"`
+	Digest  string           `yaml:"digest,omitempty"`
+	Extract *ManifestExtract `yaml:"extract,omitempty"`
+}
+
+// ManifestExtract unpacks an artifact into Dir, relative to the directory
+// and the directory of the artifact when empty.
+type ManifestExtract struct {
+	Dir             string   `yaml:"dir,omitempty"`
+	StripComponents int      `yaml:"strip-components,omitempty"`
+	Include         []string `yaml:"include,omitempty"`
+	Exclude         []string `yaml:"exclude,omitempty"`
+}
+
+// Lockfile records what SyncManifest resolved every artifact to, sorted by
+// Path.
+type Lockfile struct {
+	Artifacts []LockedArtifact `yaml:"artifacts"`
+}
+
+// LockedArtifact is an artifact as it was downloaded. URL is the one it came
+// from and Digest its sha256 digest.
+type LockedArtifact struct {
+	Path      string `yaml:"path"`
+	URL       string `yaml:"url"`
+	Size      int64  `yaml:"size"`
+	Digest    string `yaml:"digest"`
+	Extracted string `yaml:"extracted,omitempty"`
+}
+
+// ManifestSyncOptions tunes SyncManifest.
+type ManifestSyncOptions struct {
+	// Parallel is the number of artifacts downloaded at once, each with
+	// Concurrency segments.
+	Parallel    int
+	Concurrency int64
+	// Lockfile is read to find unchanged artifacts and rewritten after a
+	// successful sync, nothing is written when it is empty.
+	Lockfile string
+	// Prune removes the files of the directory that no artifact accounts
+	// for, except for the Lockfile and the paths in Keep. Everything below
+	// the directory an artifact is extracted to belongs to that artifact.
+	Prune bool
+	Keep  []string
+}
+
+// ManifestResult is what SyncManifest did with every artifact, by path.
+type ManifestResult struct {
+	Files    map[string]SyncStatus
+	Failed   map[string]error
+	Removed  []string
+	Lockfile *Lockfile
+}
+
+// ParseManifest reads a manifest and checks that its dir stays within the
+// directory of the manifest and that every artifact has a url and stays
+// within the dir.
+func ParseManifest(r io.Reader) (*Manifest, error) {
+	var manifest Manifest
+	if err := yaml.NewDecoder(r).Decode(&manifest); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if manifest.Dir != "" && escapes(path.Clean(filepath.ToSlash(manifest.Dir))) {
+		return nil, fmt.Errorf("invalid manifest: dir %q is outside the directory of the manifest", manifest.Dir)
+	}
+	seen := map[string]bool{}
+	for index := range manifest.Artifacts {
+		artifact := &manifest.Artifacts[index]
+		urls := artifact.sources()
+		if len(urls) == 0 {
+			return nil, fmt.Errorf("invalid manifest: artifact %d has no url", index+1)
+		}
+		if artifact.Path == "" {
+			artifact.Path = path.Base(strings.SplitN(urls[0], "?", 2)[0])
+		}
+		artifact.Path = path.Clean(filepath.ToSlash(artifact.Path))
+		if escapes(artifact.Path) || artifact.Path == "." {
+			return nil, fmt.Errorf("invalid manifest: path %q is outside the directory", artifact.Path)
+		}
+		if seen[artifact.Path] {
+			return nil, fmt.Errorf("invalid manifest: %s is listed twice", artifact.Path)
+		}
+		seen[artifact.Path] = true
+		if artifact.Digest != "" && len(strings.SplitN(artifact.Digest, ":", 2)) != 2 {
+			return nil, fmt.Errorf("invalid manifest: invalid digest %q", artifact.Digest)
+		}
+		if artifact.Extract != nil && escapes(artifact.extractDir()) {
+			return nil, fmt.Errorf("invalid manifest: extract dir %q is outside the directory", artifact.Extract.Dir)
+		}
+	}
+	return &manifest, nil
+}
+
+// sources are the urls of the artifact in the order they are tried.
+func (a *ManifestArtifact) sources() []string {
+	if a.URL == "" {
+		return a.URLs
+	}
+	return append([]string{a.URL}, a.URLs...)
+}
+
+func (a *ManifestArtifact) extractDir() string {
+	if a.Extract.Dir == "" {
+		return path.Dir(a.Path)
+	}
+	return path.Clean(filepath.ToSlash(a.Extract.Dir))
+}
+
+// ReadLockfile reads a lockfile written by SyncManifest, a missing one is
+// empty.
+func ReadLockfile(fs FS, lockPath string) (*Lockfile, error) {
+	data, err := readFile(fs, lockPath)
+	if os.IsNotExist(err) {
+		return &Lockfile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lockfile Lockfile
+	if err = yaml.Unmarshal(data, &lockfile); err != nil {
+		return nil, fmt.Errorf("invalid lockfile %s: %v", lockPath, err)
+	}
+	return &lockfile, nil
+}
+
+func writeLockfile(fs FS, lockPath string, lockfile *Lockfile) error {
+	data, err := yaml.Marshal(lockfile)
+	if err != nil {
+		return err
+	}
+	partPath := lockPath + partSuffix
+	if err = writeFile(fs, partPath, data); err != nil {
+		return err
+	}
+	return fs.Rename(partPath, lockPath)
+}
+
+// SyncManifest makes dirPath hold the artifacts of manifest. Artifacts whose
+// file still has the digest of the manifest, or of the lockfile for the same
+// url, are kept, the others are downloaded concurrently and verified. When
+// every artifact is in place the lockfile is written and orphans are pruned.
+func (d *Downloader) SyncManifest(manifest *Manifest, dirPath string, options ManifestSyncOptions) (*ManifestResult, error) {
+	parallel := options.Parallel
+	if parallel < 1 {
+		parallel = 4
+	}
+	concurrency := options.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	previous := &Lockfile{}
+	if options.Lockfile != "" {
+		var err error
+		if previous, err = ReadLockfile(d.fs(), options.Lockfile); err != nil {
+			return nil, err
+		}
+	}
+	locked := map[string]LockedArtifact{}
+	for _, artifact := range previous.Artifacts {
+		locked[artifact.Path] = artifact
+	}
+
+	result := &ManifestResult{Files: map[string]SyncStatus{}, Failed: map[string]error{}, Lockfile: &Lockfile{}}
+	var mutex sync.Mutex
+	artifactChan := make(chan ManifestArtifact, len(manifest.Artifacts))
+	for _, artifact := range manifest.Artifacts {
+		artifactChan <- artifact
+	}
+	close(artifactChan)
+
+	var wg sync.WaitGroup
+	wg.Add(parallel)
+	for i := 0; i < parallel; i++ {
+		go func() {
+			defer wg.Done()
+			for artifact := range artifactChan {
+				entry, status, err := d.syncArtifact(dirPath, artifact, locked[artifact.Path], concurrency)
+				mutex.Lock()
+				if err != nil {
+					result.Failed[artifact.Path] = err
+				} else {
+					result.Files[artifact.Path] = status
+					result.Lockfile.Artifacts = append(result.Lockfile.Artifacts, entry)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Slice(result.Lockfile.Artifacts, func(i, j int) bool {
+		return result.Lockfile.Artifacts[i].Path < result.Lockfile.Artifacts[j].Path
+	})
+
+	if len(result.Failed) > 0 {
+		return result, fmt.Errorf("unable to sync %d of %d artifacts", len(result.Failed), len(manifest.Artifacts))
+	}
+	if options.Lockfile != "" {
+		if err := writeLockfile(d.fs(), options.Lockfile, result.Lockfile); err != nil {
+			return result, err
+		}
+	}
+	if options.Prune {
+		removed, err := d.pruneOrphans(dirPath, manifest, append([]string{options.Lockfile}, options.Keep...))
+		result.Removed = removed
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// syncArtifact brings a single artifact up to date, previous is its entry
+// in the old lockfile.
+func (d *Downloader) syncArtifact(dirPath string, artifact ManifestArtifact, previous LockedArtifact, concurrency int64) (LockedArtifact, SyncStatus, error) {
+	filePath := path.Join(filepath.ToSlash(dirPath), artifact.Path)
+	urls := artifact.sources()
+	entry := LockedArtifact{Path: artifact.Path}
+
+	status := SyncNew
+	if d.FileUtils.FileExists(filePath) {
+		status = SyncUpdated
+		expected := artifact.Digest
+		if expected == "" && previous.Digest != "" && containsString(urls, previous.URL) {
+			expected = previous.Digest
+		}
+		if expected != "" && d.verifyDigest(filePath, expected) == nil {
+			status = SyncUnchanged
+			entry.URL = previous.URL
+			if !containsString(urls, entry.URL) {
+				entry.URL = urls[0]
+			}
+		}
+	}
+
+	if status != SyncUnchanged {
+		var err error
+		for _, url := range urls {
+			if err = d.downloadArtifact(filePath, url, artifact.Digest, concurrency); err == nil {
+				entry.URL = url
+				break
+			}
+		}
+		if err != nil {
+			return entry, "", err
+		}
+	}
+
+	info, err := d.fs().Stat(filePath)
+	if err != nil {
+		return entry, "", err
+	}
+	entry.Size = info.Size()
+	checksum, err := d.FileUtils.Checksum(filePath, "sha256")
+	if err != nil {
+		return entry, "", err
+	}
+	entry.Digest = "sha256:" + checksum
+
+	if artifact.Extract != nil {
+		entry.Extracted = artifact.extractDir()
+		destDir := path.Join(filepath.ToSlash(dirPath), entry.Extracted)
+		if _, statErr := d.fs().Stat(destDir); status != SyncUnchanged || previous.Extracted != entry.Extracted || statErr != nil {
+			options := ExtractOptions{StripComponents: artifact.Extract.StripComponents, Include: artifact.Extract.Include, Exclude: artifact.Extract.Exclude}
+			if err = ExtractArchive(d.fs(), filePath, destDir, options); err != nil {
+				return entry, "", err
+			}
+		}
+	}
+	return entry, status, nil
+}
+
+// downloadArtifact saves url at filePath once it matches digest, replacing
+// the file there.
+func (d *Downloader) downloadArtifact(filePath string, url string, digest string, concurrency int64) error {
+	dirPath, fileName := path.Split(filePath)
+	dirPath = strings.TrimSuffix(dirPath, "/")
+	if dirPath == "" {
+		dirPath = "."
+	}
+	check, err := d.signatureCheck(url, nil)
+	if err != nil {
+		return err
+	}
+	headResp, err := d.Client.Head(url)
+	if err != nil {
+		return err
+	}
+	download := func() error {
+		return d.downloadParts(dirPath, fileName, url, concurrency, headResp, d.digestCheck(digest), check.partCheck())
+	}
+	if d.Cache != nil {
+		return d.downloadCached(dirPath, fileName, url, headResp, digest, download, check.partCheck())
+	}
+	return download()
+}
+
+// pruneOrphans removes the files below dirPath that belong to no artifact
+// and aren't in keep.
+func (d *Downloader) pruneOrphans(dirPath string, manifest *Manifest, keep []string) ([]string, error) {
+	root := path.Clean(filepath.ToSlash(dirPath))
+	owned := map[string]bool{}
+	var extracted []string
+	for _, artifact := range manifest.Artifacts {
+		owned[artifact.Path] = true
+		if artifact.Extract != nil {
+			extracted = append(extracted, artifact.extractDir())
+		}
+	}
+	for _, name := range keep {
+		if name != "" {
+			owned[relativeTo(root, path.Clean(filepath.ToSlash(name)))] = true
+		}
+	}
+
+	var removed []string
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		for _, dir := range extracted {
+			if dir == "." || rel == dir || strings.HasPrefix(rel, dir+"/") {
+				return nil
+			}
+		}
+		infos, err := d.fs().ReadDir(path.Join(root, rel))
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			child := path.Join(rel, info.Name())
+			if info.IsDir() {
+				err = walk(child)
+			} else if !owned[child] {
+				if err = d.fs().Remove(path.Join(root, child)); err == nil {
+					removed = append(removed, child)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return removed, walk(".")
+}
+
+// relativeTo is name relative to root, or name itself when it is outside of
+// it.
+func relativeTo(root string, name string) string {
+	if root == "." && !escapes(name) {
+		return name
+	}
+	if strings.HasPrefix(name, root+"/") {
+		return strings.TrimPrefix(name, root+"/")
+	}
+	return name
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
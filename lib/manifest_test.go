@@ -0,0 +1,129 @@
+package lib_test
+
+import (
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseManifest(t *testing.T, text string) *lib.Manifest {
+	manifest, err := lib.ParseManifest(strings.NewReader(text))
+	assert.NoError(t, err)
+	return manifest
+}
+
+func writeMemFile(t *testing.T, fs *lib.MemFS, name string, data []byte) {
+	assert.NoError(t, fs.MkdirAll(path.Dir(name), 0755))
+	file, err := fs.Create(name)
+	assert.NoError(t, err)
+	file.Write(data)
+	assert.NoError(t, file.Close())
+}
+
+func TestSyncManifest(t *testing.T) {
+	tool := testContent(30000)
+	archive := buildTar(t, "tar.gz", []archiveEntry{
+		{name: "sdk-1.0/", dir: true},
+		{name: "sdk-1.0/bin/sdk", body: "#!/bin/sh\n", mode: 0755},
+	})
+	var gets int32
+	server := newArtifactTestServer(map[string][]byte{"/tool.bin": tool, "/mirror/sdk.tar.gz": archive, "/data.json": []byte(`{}`)}, &gets)
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+	manifest := parseManifest(t, `
+artifacts:
+  - url: `+server.URL+`/tool.bin
+    path: bin/tool
+    digest: `+sha256Digest(tool)+`
+  - urls: [`+server.URL+`/missing/sdk.tar.gz, `+server.URL+`/mirror/sdk.tar.gz]
+    extract:
+      dir: sdk
+      strip-components: 1
+  - url: `+server.URL+`/data.json
+`)
+	options := lib.ManifestSyncOptions{Concurrency: 3, Lockfile: "deps.lock"}
+
+	result, err := downloader.SyncManifest(manifest, "deps", options)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]lib.SyncStatus{"bin/tool": lib.SyncNew, "sdk.tar.gz": lib.SyncNew, "data.json": lib.SyncNew}, result.Files)
+	assert.Equal(t, []lib.LockedArtifact{
+		{Path: "bin/tool", URL: server.URL + "/tool.bin", Size: 30000, Digest: sha256Digest(tool)},
+		{Path: "data.json", URL: server.URL + "/data.json", Size: 2, Digest: sha256Digest([]byte(`{}`))},
+		{Path: "sdk.tar.gz", URL: server.URL + "/mirror/sdk.tar.gz", Size: int64(len(archive)), Digest: sha256Digest(archive), Extracted: "sdk"},
+	}, result.Lockfile.Artifacts)
+	assert.Equal(t, []string{"deps.lock", "deps/bin/tool", "deps/data.json", "deps/sdk.tar.gz", "deps/sdk/bin/sdk"}, fs.Files())
+	lockfile, err := lib.ReadLockfile(fs, "deps.lock")
+	assert.NoError(t, err)
+	assert.Equal(t, result.Lockfile, lockfile)
+
+	// the lockfile vouches for data.json, which has no digest in the manifest
+	atomic.StoreInt32(&gets, 0)
+	result, err = downloader.SyncManifest(manifest, "deps", options)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]lib.SyncStatus{"bin/tool": lib.SyncUnchanged, "sdk.tar.gz": lib.SyncUnchanged, "data.json": lib.SyncUnchanged}, result.Files)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&gets))
+
+	for _, name := range []string{"deps/sdk/bin/sdk", "deps/sdk/bin", "deps/sdk"} {
+		assert.NoError(t, fs.Remove(name))
+	}
+	data, _ := fs.ReadFile("deps/data.json")
+	writeMemFile(t, fs, "deps/data.json", append(data, '\n'))
+	result, err = downloader.SyncManifest(manifest, "deps", options)
+	assert.NoError(t, err)
+	assert.Equal(t, lib.SyncUpdated, result.Files["data.json"])
+	assert.Equal(t, lib.SyncUnchanged, result.Files["sdk.tar.gz"])
+	data, err = fs.ReadFile("deps/data.json")
+	assert.NoError(t, err)
+	assert.Equal(t, `{}`, string(data))
+	assert.Contains(t, fs.Files(), "deps/sdk/bin/sdk")
+}
+
+func TestSyncManifestPrunesOrphans(t *testing.T) {
+	server := newArtifactTestServer(map[string][]byte{"/a.bin": testContent(100), "/b.tar": buildTar(t, "tar", []archiveEntry{{name: "b.txt", body: "b"}})}, new(int32))
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+	for _, name := range []string{"deps/manifest.yaml", "deps/old/a.bin", "deps/stale.bin", "deps/b/extra.txt"} {
+		writeMemFile(t, fs, name, []byte("x"))
+	}
+	manifest := parseManifest(t, "artifacts:\n  - url: "+server.URL+"/a.bin\n  - url: "+server.URL+"/b.tar\n    extract: {dir: b}\n")
+
+	result, err := downloader.SyncManifest(manifest, "deps", lib.ManifestSyncOptions{Lockfile: "deps/deps.lock", Prune: true, Keep: []string{"deps/manifest.yaml"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"old/a.bin", "stale.bin"}, result.Removed)
+	assert.Equal(t, []string{"deps/a.bin", "deps/b.tar", "deps/b/b.txt", "deps/b/extra.txt", "deps/deps.lock", "deps/manifest.yaml"}, fs.Files())
+}
+
+func TestSyncManifestKeepsLockfileOnFailure(t *testing.T) {
+	server := newArtifactTestServer(map[string][]byte{"/a.bin": testContent(100)}, new(int32))
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+	manifest := parseManifest(t, "artifacts:\n  - url: "+server.URL+"/a.bin\n    digest: "+sha256Digest([]byte("other"))+"\n")
+
+	result, err := downloader.SyncManifest(manifest, "deps", lib.ManifestSyncOptions{Lockfile: "deps.lock"})
+	assert.EqualError(t, err, "unable to sync 1 of 1 artifacts")
+	assert.Contains(t, result.Failed["a.bin"].Error(), "checksum mismatch")
+	assert.Empty(t, fs.Files())
+}
+
+func TestParseManifestRejectsInvalidArtifacts(t *testing.T) {
+	for text, message := range map[string]string{
+		"artifacts:\n  - path: a\n":                                "invalid manifest: artifact 1 has no url",
+		"artifacts:\n  - url: http://h/a\n    path: ../a\n":        `invalid manifest: path "../a" is outside the directory`,
+		"artifacts:\n  - url: http://h/a\n  - url: http://g/a\n":   "invalid manifest: a is listed twice",
+		"artifacts:\n  - url: http://h/a\n    digest: abc\n":       `invalid manifest: invalid digest "abc"`,
+		"artifacts:\n  - url: http://h/a\n    extract: {dir: /}\n": `invalid manifest: extract dir "/" is outside the directory`,
+		"dir: ..\nartifacts:\n  - url: http://h/a\n":               `invalid manifest: dir ".." is outside the directory of the manifest`,
+		"dir: a/../../x\nartifacts:\n  - url: http://h/a\n":        `invalid manifest: dir "a/../../x" is outside the directory of the manifest`,
+		"dir: /srv\nartifacts:\n  - url: http://h/a\n":             `invalid manifest: dir "/srv" is outside the directory of the manifest`,
+	} {
+		_, err := lib.ParseManifest(strings.NewReader(text))
+		assert.EqualError(t, err, message)
+	}
+}
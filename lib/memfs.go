@@ -0,0 +1,477 @@
+package lib
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errIsDir       = errors.New("is a directory")
+	errNotDir      = errors.New("not a directory")
+	errDirNotEmpty = errors.New("directory not empty")
+	errBadMode     = errors.New("bad file descriptor")
+)
+
+// MemFS is an FS that keeps everything in memory, for tests and for
+// downloading into memory. The zero value is an empty filesystem.
+type MemFS struct {
+	mutex sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]bool
+	locks map[string]chan struct{}
+}
+
+type memNode struct {
+	mutex   sync.RWMutex
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// ReadFile returns the content of a file, a copy that later writes don't
+// change.
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	node, err := m.node(name, "read")
+	if err != nil {
+		return nil, err
+	}
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	return append([]byte(nil), node.data...), nil
+}
+
+// Files lists the names of all files in lexical order.
+func (m *MemFS) Files() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var names []string
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *MemFS) Open(name string) (FSFile, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemFS) Create(name string) (FSFile, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (FSFile, error) {
+	name = cleanMemPath(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.init()
+	node, ok := m.files[name]
+	switch {
+	case m.dirs[name]:
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if !m.dirs[path.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		node = &memNode{mode: perm, modTime: time.Now()}
+		m.files[name] = node
+	}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		node.mutex.Lock()
+		node.data = nil
+		node.modTime = time.Now()
+		node.mutex.Unlock()
+	}
+	return &memFile{name: name, node: node, flag: flag}, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = cleanMemPath(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.init()
+	if m.dirs[name] {
+		return &memFileInfo{name: path.Base(name), mode: os.ModeDir | 0777}, nil
+	}
+	node, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return node.info(name), nil
+}
+
+// Lstat is Stat, links are never followed.
+func (m *MemFS) Lstat(name string) (os.FileInfo, error) {
+	return m.Stat(name)
+}
+
+func (m *MemFS) Rename(oldName string, newName string) error {
+	oldName, newName = cleanMemPath(oldName), cleanMemPath(newName)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.init()
+	node, ok := m.files[oldName]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	if !m.dirs[path.Dir(newName)] || m.dirs[newName] {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	delete(m.files, oldName)
+	m.files[newName] = node
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	name = cleanMemPath(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.init()
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.dirs[name] || name == "." || name == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for other := range m.files {
+		if strings.HasPrefix(other, prefix) {
+			return &os.PathError{Op: "remove", Path: name, Err: errDirNotEmpty}
+		}
+	}
+	for other := range m.dirs {
+		if strings.HasPrefix(other, prefix) {
+			return &os.PathError{Op: "remove", Path: name, Err: errDirNotEmpty}
+		}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFS) MkdirAll(dirPath string, perm os.FileMode) error {
+	dirPath = cleanMemPath(dirPath)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.init()
+	for dir := dirPath; !m.dirs[dir]; dir = path.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errNotDir}
+		}
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *MemFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	node, err := m.node(name, "chtimes")
+	if err != nil {
+		return err
+	}
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.modTime = mtime
+	return nil
+}
+
+// Chmod changes the permissions of a file, directories have none.
+func (m *MemFS) Chmod(name string, mode os.FileMode) error {
+	m.mutex.Lock()
+	isDir := m.dirs[cleanMemPath(name)]
+	m.mutex.Unlock()
+	if isDir {
+		return nil
+	}
+	node, err := m.node(name, "chmod")
+	if err != nil {
+		return err
+	}
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.mode = node.mode&^os.ModePerm | mode.Perm()
+	return nil
+}
+
+// Symlink records a link to oldName as a file holding the target, links are
+// not followed.
+func (m *MemFS) Symlink(oldName string, newName string) error {
+	newName = cleanMemPath(newName)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.init()
+	if _, ok := m.files[newName]; ok || m.dirs[newName] {
+		return &os.LinkError{Op: "symlink", Old: oldName, New: newName, Err: os.ErrExist}
+	}
+	if !m.dirs[path.Dir(newName)] {
+		return &os.LinkError{Op: "symlink", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	m.files[newName] = &memNode{data: []byte(oldName), mode: os.ModeSymlink | 0777, modTime: time.Now()}
+	return nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+	name = cleanMemPath(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.init()
+	if !m.dirs[name] {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	var infos []os.FileInfo
+	for dir := range m.dirs {
+		if dir != name && path.Dir(dir) == name {
+			infos = append(infos, &memFileInfo{name: path.Base(dir), mode: os.ModeDir | 0777})
+		}
+	}
+	for fileName, node := range m.files {
+		if path.Dir(fileName) == name {
+			infos = append(infos, node.info(fileName))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// Lock creates name like the OS implementation does and holds a lock that
+// only this MemFS knows about.
+func (m *MemFS) Lock(name string) (unlock func(), err error) {
+	file, err := m.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	name = cleanMemPath(name)
+	m.mutex.Lock()
+	if m.locks == nil {
+		m.locks = map[string]chan struct{}{}
+	}
+	lock, ok := m.locks[name]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		m.locks[name] = lock
+	}
+	m.mutex.Unlock()
+
+	lock <- struct{}{}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-lock })
+	}, nil
+}
+
+func (m *MemFS) node(name string, op string) (*memNode, error) {
+	name = cleanMemPath(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.init()
+	node, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return node, nil
+}
+
+func (m *MemFS) init() {
+	if m.files == nil {
+		m.files = map[string]*memNode{}
+		m.dirs = map[string]bool{".": true, "/": true}
+	}
+}
+
+// cleanMemPath turns name into a clean slash separated path, so "a/b" and
+// "a\b" on Windows are the same file.
+func cleanMemPath(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return &memFileInfo{name: path.Base(name), size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+// memFile is an open MemFS file. Files opened several times share their
+// content like on disk.
+type memFile struct {
+	name   string
+	node   *memNode
+	flag   int
+	offset int64
+	closed bool
+	mutex  sync.Mutex
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, offset int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n, err := f.readAt(p, offset)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *memFile) readAt(p []byte, offset int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errBadMode}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.node.mutex.RLock()
+	defer f.node.mutex.RUnlock()
+	if offset >= int64(len(f.node.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(p, f.node.data[offset:]), nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	offset := f.offset
+	if f.flag&os.O_APPEND != 0 {
+		f.node.mutex.RLock()
+		offset = int64(len(f.node.data))
+		f.node.mutex.RUnlock()
+	}
+	n, err := f.writeAt(p, offset)
+	f.offset = offset + int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, offset int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: errBadMode}
+	}
+	return f.writeAt(p, offset)
+}
+
+func (f *memFile) writeAt(p []byte, offset int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: errBadMode}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.node.mutex.Lock()
+	defer f.node.mutex.Unlock()
+	if end := offset + int64(len(p)); end > int64(len(f.node.data)) {
+		if end <= int64(cap(f.node.data)) {
+			size := len(f.node.data)
+			f.node.data = f.node.data[:end]
+			// clear what an earlier truncate left behind
+			for i := size; i < int(offset); i++ {
+				f.node.data[i] = 0
+			}
+		} else {
+			grown := make([]byte, end, end*2)
+			copy(grown, f.node.data)
+			f.node.data = grown
+		}
+	}
+	copy(f.node.data[offset:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.node.mutex.RLock()
+		offset += int64(len(f.node.data))
+		f.node.mutex.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return f.node.info(f.name), nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.node.mutex.Lock()
+	defer f.node.mutex.Unlock()
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}   { return nil }
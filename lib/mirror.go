@@ -0,0 +1,404 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	defaultMirrorDepth = 5
+	maxPageSize        = 10 << 20
+	mirrorUserAgent    = "godownload"
+)
+
+// MirrorOptions restricts what Mirror follows and downloads. Hosts default
+// to the host of the start url and, unless AllowParent is set, nothing above
+// the start directory is visited.
+type MirrorOptions struct {
+	// MaxDepth is the number of links followed from the start page,
+	// defaulting to 5.
+	MaxDepth     int
+	IncludeHosts []string
+	ExcludeHosts []string
+	// IncludePaths and ExcludePaths are url path prefixes.
+	IncludePaths []string
+	ExcludePaths []string
+	// Accept and Reject are globs matched against file names, pages are
+	// always followed.
+	Accept       []string
+	Reject       []string
+	AllowParent  bool
+	IgnoreRobots bool
+	// Parallel is the number of files downloaded at once, each with
+	// Concurrency segments.
+	Parallel    int
+	Concurrency int64
+}
+
+type MirrorResult struct {
+	Files  []string
+	Failed map[string]error
+}
+
+type mirrorPage struct {
+	url   *url.URL
+	depth int
+}
+
+// Mirror walks html index pages and the documents they link to, starting at
+// startURL, and saves every file it finds under dirPath/<host>/<path>. Files
+// that already exist with the remote size are skipped, others are fetched
+// again. A shorter file is replaced only once the new copy is complete.
+func (d *Downloader) Mirror(dirPath string, startURL string, options MirrorOptions) (*MirrorResult, error) {
+	start, err := url.Parse(startURL)
+	if err != nil {
+		return nil, err
+	}
+	if options.MaxDepth <= 0 {
+		options.MaxDepth = defaultMirrorDepth
+	}
+	if len(options.IncludeHosts) == 0 {
+		options.IncludeHosts = []string{start.Host}
+	}
+	rules := &mirrorRules{options: options, root: start, robots: map[string]*robotsRules{}, client: d.Client}
+
+	visited := map[string]bool{start.String(): true}
+	queued := map[string]bool{}
+	var files []*url.URL
+	queue := []mirrorPage{{url: start}}
+	for len(queue) > 0 {
+		page := queue[0]
+		queue = queue[1:]
+
+		links, err := d.fetchLinks(dirPath, page.url)
+		if err != nil {
+			if page.depth == 0 {
+				return nil, err
+			}
+			continue
+		}
+		for _, link := range links {
+			if visited[link.String()] || queued[link.String()] || !rules.allowed(link) {
+				continue
+			}
+			if isPage(link) {
+				visited[link.String()] = true
+				if page.depth+1 < options.MaxDepth {
+					queue = append(queue, mirrorPage{url: link, depth: page.depth + 1})
+				}
+				continue
+			}
+			if rules.accepted(link) {
+				queued[link.String()] = true
+				files = append(files, link)
+			}
+		}
+	}
+
+	return d.mirrorFiles(dirPath, files, options)
+}
+
+func (d *Downloader) mirrorFiles(dirPath string, files []*url.URL, options MirrorOptions) (*MirrorResult, error) {
+	parallel := options.Parallel
+	if parallel < 1 {
+		parallel = 4
+	}
+	concurrency := options.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	result := &MirrorResult{Failed: map[string]error{}}
+	var mutex sync.Mutex
+	fileChan := make(chan *url.URL, len(files))
+	for _, file := range files {
+		fileChan <- file
+	}
+	close(fileChan)
+
+	var wg sync.WaitGroup
+	wg.Add(parallel)
+	for i := 0; i < parallel; i++ {
+		go func() {
+			defer wg.Done()
+			for file := range fileChan {
+				localPath, err := d.mirrorFile(localDir(dirPath, file), file.String(), concurrency)
+				mutex.Lock()
+				if err != nil {
+					result.Failed[file.String()] = err
+				} else {
+					result.Files = append(result.Files, localPath)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(result.Failed) > 0 {
+		return result, fmt.Errorf("unable to mirror %d of %d files", len(result.Failed), len(files))
+	}
+	return result, nil
+}
+
+func (d *Downloader) mirrorFile(dirPath string, fileURL string, concurrency int64) (string, error) {
+	fileName, err := d.FileUtils.GetFileNameFromURL(fileURL)
+	if err != nil {
+		return "", err
+	}
+	localPath := fmt.Sprintf("%s/%s", dirPath, fileName)
+	if !d.FileUtils.FileExists(localPath) {
+		return localPath, d.DownloadFileConcurrent(dirPath, fileURL, concurrency)
+	}
+
+	headResp, err := d.Client.Head(fileURL)
+	if err != nil {
+		return "", err
+	}
+	info, err := d.fs().Stat(localPath)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case info.Size() == headResp.ContentLength:
+		return localPath, nil
+	case info.Size() < headResp.ContentLength:
+		// nothing tells whether the short file is of the remote version, it
+		// isn't continued
+		return localPath, d.DownloadFile(dirPath, fileURL)
+	}
+	if err = d.FileUtils.DeleteFile(localPath); err != nil {
+		return "", err
+	}
+	return localPath, d.DownloadFileConcurrent(dirPath, fileURL, concurrency)
+}
+
+// fetchLinks returns the absolute urls linked from a page. Linked documents
+// other than directory indexes are saved alongside the files.
+func (d *Downloader) fetchLinks(dirPath string, page *url.URL) ([]*url.URL, error) {
+	response, err := d.Client.ResumeGet(page.String(), 0)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxPageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(page.Path, "/") && page.Path != "" {
+		dir := localDir(dirPath, page)
+		if err = d.fs().MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+		if err = writeFile(d.fs(), filepath.Join(dir, path.Base(page.Path)), body); err != nil {
+			return nil, err
+		}
+	}
+	return extractLinks(page, bytes.NewReader(body)), nil
+}
+
+func extractLinks(page *url.URL, r io.Reader) []*url.URL {
+	base := page
+	var links []*url.URL
+	tokenizer := html.NewTokenizer(r)
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			return links
+		}
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		attribute := map[string]string{"a": "href", "area": "href", "link": "href", "base": "href", "frame": "src", "iframe": "src"}[token.Data]
+		if attribute == "" {
+			continue
+		}
+		for _, attr := range token.Attr {
+			if attr.Key != attribute {
+				continue
+			}
+			ref, err := url.Parse(strings.TrimSpace(attr.Val))
+			if err != nil {
+				continue
+			}
+			link := base.ResolveReference(ref)
+			if token.Data == "base" {
+				base = link
+				continue
+			}
+			if link.Scheme != "http" && link.Scheme != "https" && link.Scheme != page.Scheme {
+				continue
+			}
+			link.Fragment = ""
+			// sort links of autoindex pages only reorder the same listing
+			if link.RawQuery != "" && link.Path == page.Path {
+				continue
+			}
+			links = append(links, link)
+		}
+	}
+}
+
+func isPage(u *url.URL) bool {
+	if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return true
+	}
+	switch strings.ToLower(path.Ext(u.Path)) {
+	case ".html", ".htm", ".xhtml":
+		return true
+	}
+	return false
+}
+
+// localDir maps the directory of a url onto dirPath/<host>/<path>.
+func localDir(dirPath string, u *url.URL) string {
+	dir := path.Dir(path.Clean("/" + u.Path))
+	if strings.HasSuffix(u.Path, "/") {
+		dir = path.Clean("/" + u.Path)
+	}
+	host := strings.Replace(u.Host, ":", "_", -1)
+	return filepath.Join(dirPath, host, filepath.FromSlash(strings.TrimPrefix(dir, "/")))
+}
+
+type mirrorRules struct {
+	options MirrorOptions
+	root    *url.URL
+	client  Client
+	mutex   sync.Mutex
+	robots  map[string]*robotsRules
+}
+
+func (r *mirrorRules) allowed(u *url.URL) bool {
+	if !matchesAny(u.Host, r.options.IncludeHosts, hostMatch) || matchesAny(u.Host, r.options.ExcludeHosts, hostMatch) {
+		return false
+	}
+	if len(r.options.IncludePaths) > 0 && !matchesAny(u.Path, r.options.IncludePaths, strings.HasPrefix) {
+		return false
+	}
+	if matchesAny(u.Path, r.options.ExcludePaths, strings.HasPrefix) {
+		return false
+	}
+	if !r.options.AllowParent && u.Host == r.root.Host {
+		rootDir := r.root.Path
+		if !strings.HasSuffix(rootDir, "/") {
+			rootDir = path.Dir(rootDir) + "/"
+		}
+		if !strings.HasPrefix(u.Path, rootDir) {
+			return false
+		}
+	}
+	return r.options.IgnoreRobots || r.robotsFor(u).allowed(u.EscapedPath())
+}
+
+func (r *mirrorRules) accepted(u *url.URL) bool {
+	name := path.Base(u.Path)
+	if len(r.options.Accept) > 0 && !matchesAny(name, r.options.Accept, globMatch) {
+		return false
+	}
+	return !matchesAny(name, r.options.Reject, globMatch)
+}
+
+func (r *mirrorRules) robotsFor(u *url.URL) *robotsRules {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := u.Scheme + "://" + u.Host
+	if rules, ok := r.robots[key]; ok {
+		return rules
+	}
+	rules := &robotsRules{}
+	if response, err := r.client.ResumeGet(key+"/robots.txt", 0); err == nil {
+		rules = parseRobots(io.LimitReader(response.Body, maxPageSize), mirrorUserAgent)
+		response.Body.Close()
+	}
+	r.robots[key] = rules
+	return rules
+}
+
+func matchesAny(value string, patterns []string, match func(string, string) bool) bool {
+	for _, pattern := range patterns {
+		if match(value, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostMatch(host string, pattern string) bool {
+	return strings.EqualFold(host, pattern)
+}
+
+func globMatch(name string, pattern string) bool {
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+type robotsRule struct {
+	prefix string
+	allow  bool
+}
+
+// robotsRules holds the rules of the robots.txt group that applies to us, the
+// longest matching prefix decides.
+type robotsRules struct {
+	rules []robotsRule
+}
+
+func (r *robotsRules) allowed(urlPath string) bool {
+	allow, longest := true, -1
+	for _, rule := range r.rules {
+		if strings.HasPrefix(urlPath, rule.prefix) && len(rule.prefix) > longest {
+			allow, longest = rule.allow, len(rule.prefix)
+		}
+	}
+	return allow
+}
+
+func parseRobots(r io.Reader, userAgent string) *robotsRules {
+	groups := map[string][]robotsRule{}
+	var agents []string
+	inRules := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if hash := strings.Index(line, "#"); hash >= 0 {
+			line = line[:hash]
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		switch key {
+		case "user-agent":
+			if inRules {
+				agents, inRules = nil, false
+			}
+			agents = append(agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inRules = true
+			if value == "" {
+				continue
+			}
+			for _, agent := range agents {
+				groups[agent] = append(groups[agent], robotsRule{prefix: value, allow: key == "allow"})
+			}
+		}
+	}
+	if rules, ok := groups[strings.ToLower(userAgent)]; ok {
+		return &robotsRules{rules: rules}
+	}
+	return &robotsRules{rules: groups["*"]}
+}
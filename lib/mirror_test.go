@@ -0,0 +1,165 @@
+package lib_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+// autoindexTestServer serves a release tree with nginx style directory
+// listings and records every path requested.
+type autoindexTestServer struct {
+	*httptest.Server
+	files     map[string][]byte
+	mutex     sync.Mutex
+	requested map[string]int
+}
+
+func newAutoindexTestServer() *autoindexTestServer {
+	s := &autoindexTestServer{requested: map[string]int{}}
+	s.files = map[string][]byte{
+		"/robots.txt": []byte("User-agent: *\nDisallow: /pub/private/\n"),
+		"/pub/": []byte(`<html><body><h1>Index of /pub/</h1>
+<a href="?C=N;O=D">Name</a> <a href="?C=M;O=A">Last modified</a>
+<a href="../">../</a>
+<a href="v1/">v1/</a>
+<a href="private/">private/</a>
+<a href="README.txt">README.txt</a>
+<a href="notes.html#top">notes.html</a>
+<a href="http://mirror.invalid/pub/other.tar.gz">other.tar.gz</a>
+</body></html>`),
+		"/pub/README.txt": []byte("release notes"),
+		"/pub/notes.html": []byte(`<html><body><a href="/pub/extra/tool.bin">tool</a> <a href="/outside.bin">outside</a></body></html>`),
+		"/pub/v1/": []byte(`<html><body><a href="../">../</a> <a href="app.tar.gz">app.tar.gz</a>
+<a href="app.tar.gz.sha256">app.tar.gz.sha256</a> <a href="build.log">build.log</a> <a href="deep/">deep/</a></body></html>`),
+		"/pub/v1/app.tar.gz":              testContent(64 * 1024),
+		"/pub/v1/app.tar.gz.sha256":       []byte("abc  app.tar.gz"),
+		"/pub/v1/build.log":               []byte("log"),
+		"/pub/v1/deep/":                   []byte(`<html><body><a href="deeper/">deeper/</a> <a href="deep.bin">deep.bin</a></body></html>`),
+		"/pub/v1/deep/deep.bin":           []byte("deep"),
+		"/pub/v1/deep/deeper/":            []byte(`<html><body><a href="deepest.bin">deepest.bin</a></body></html>`),
+		"/pub/v1/deep/deeper/deepest.bin": []byte("deepest"),
+		"/pub/private/":                   []byte(`<html><body><a href="secret.bin">secret.bin</a></body></html>`),
+		"/pub/private/secret.bin":         []byte("secret"),
+		"/pub/extra/tool.bin":             []byte("tool"),
+		"/outside.bin":                    []byte("outside"),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.requested[r.URL.Path]++
+		s.mutex.Unlock()
+		content, ok := s.files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	return s
+}
+
+func (s *autoindexTestServer) requests(path string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requested[path]
+}
+
+func mirrorDownloader() lib.Downloader {
+	client := &lib.HTTPClient{}
+	client.NewHttpClient()
+	return lib.Downloader{FileUtils: &lib.File{}, Client: client}
+}
+
+func TestMirrorSavesAutoindexTreeHonouringRobotsAndNoParent(t *testing.T) {
+	server := newAutoindexTestServer()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := mirrorDownloader()
+
+	result, err := downloader.Mirror(dir, server.URL+"/pub/", lib.MirrorOptions{Concurrency: 3})
+
+	assert.NoError(t, err)
+	root := filepath.Join(dir, strings.Replace(strings.TrimPrefix(server.URL, "http://"), ":", "_", -1))
+	for _, path := range []string{"/pub/README.txt", "/pub/notes.html", "/pub/extra/tool.bin", "/pub/v1/app.tar.gz", "/pub/v1/build.log", "/pub/v1/deep/deeper/deepest.bin"} {
+		data, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(path)))
+		assert.NoError(t, err, path)
+		assert.Equal(t, server.files[path], data, path)
+	}
+	assert.NoFileExists(t, filepath.Join(root, "pub", "private", "secret.bin"))
+	assert.NoFileExists(t, filepath.Join(root, "outside.bin"))
+	assert.NoFileExists(t, filepath.Join(root, "pub", "index.html"))
+	assert.Equal(t, 0, server.requests("/pub/private/"))
+	assert.Equal(t, 1, server.requests("/pub/"))
+	assert.Len(t, result.Files, 7)
+}
+
+func TestMirrorAppliesDepthGlobsAndPathRules(t *testing.T) {
+	server := newAutoindexTestServer()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := mirrorDownloader()
+
+	result, err := downloader.Mirror(dir, server.URL+"/pub/", lib.MirrorOptions{
+		MaxDepth:     3,
+		Accept:       []string{"*.tar.gz", "*.sha256", "*.bin"},
+		Reject:       []string{"tool.*"},
+		ExcludePaths: []string{"/pub/v1/deep/deeper/"},
+	})
+
+	assert.NoError(t, err)
+	root := filepath.Join(dir, strings.Replace(strings.TrimPrefix(server.URL, "http://"), ":", "_", -1))
+	assert.FileExists(t, filepath.Join(root, "pub", "v1", "app.tar.gz"))
+	assert.FileExists(t, filepath.Join(root, "pub", "v1", "app.tar.gz.sha256"))
+	assert.FileExists(t, filepath.Join(root, "pub", "v1", "deep", "deep.bin"))
+	assert.NoFileExists(t, filepath.Join(root, "pub", "v1", "build.log"))
+	assert.NoFileExists(t, filepath.Join(root, "pub", "README.txt"))
+	assert.NoFileExists(t, filepath.Join(root, "pub", "extra", "tool.bin"))
+	assert.Equal(t, 0, server.requests("/pub/v1/deep/deeper/"))
+	assert.Len(t, result.Files, 3)
+}
+
+func TestMirrorSkipsCompleteFilesAndRefetchesPartialOnes(t *testing.T) {
+	server := newAutoindexTestServer()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := mirrorDownloader()
+	options := lib.MirrorOptions{Accept: []string{"*.tar.gz", "README.txt"}, IgnoreRobots: true}
+
+	_, err = downloader.Mirror(dir, server.URL+"/pub/", options)
+	assert.NoError(t, err)
+	root := filepath.Join(dir, strings.Replace(strings.TrimPrefix(server.URL, "http://"), ":", "_", -1))
+	archive := filepath.Join(root, "pub", "v1", "app.tar.gz")
+	assert.NoError(t, os.Truncate(archive, 1000))
+
+	_, err = downloader.Mirror(dir, server.URL+"/pub/", options)
+
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(archive)
+	assert.NoError(t, err)
+	assert.Equal(t, server.files["/pub/v1/app.tar.gz"], data)
+	assert.Equal(t, 2, server.requests("/pub/private/"))
+	assert.Equal(t, 0, server.requests("/robots.txt"))
+	files, err := ioutil.ReadDir(filepath.Join(root, "pub"))
+	assert.NoError(t, err)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	assert.NotContains(t, names, "README.txt-(1)")
+}
@@ -0,0 +1,272 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+type OCIPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type OCIDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *OCIPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        OCIDescriptor   `json:"config"`
+	Layers        []OCIDescriptor `json:"layers"`
+	Manifests     []OCIDescriptor `json:"manifests"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []OCIDescriptor `json:"manifests"`
+}
+
+// OCIPullResult describes the image manifest that was pulled and the blobs it
+// references.
+type OCIPullResult struct {
+	Manifest OCIDescriptor
+	Config   OCIDescriptor
+	Layers   []OCIDescriptor
+}
+
+// OCIPuller pulls images and artifacts from oci://registry/repository:tag or
+// oci://registry/repository@sha256:... references. Indexes are resolved for
+// Platform, then the config and layer blobs are downloaded in parallel, each
+// with DownloadFileConcurrent, into dirPath/blobs/sha256 and verified against
+// their digests. With WriteLayout the directory also becomes an OCI image
+// layout.
+type OCIPuller struct {
+	Registry  *OCIClient
+	FileUtils FileUtils
+	// Platform is "os/arch[/variant]" and defaults to linux on the current
+	// architecture.
+	Platform    string
+	Concurrency int64
+	WriteLayout bool
+}
+
+func (p *OCIPuller) Pull(dirPath string, reference string) (*OCIPullResult, error) {
+	registry, repository, tag, err := parseOCIReference(reference)
+	if err != nil {
+		return nil, err
+	}
+
+	body, mediaType, err := p.Registry.fetchManifest(registry, repository, tag)
+	if err != nil {
+		return nil, err
+	}
+	manifestDescriptor, err := describe(body, mediaType, tag)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ociManifest
+	if err = json.Unmarshal(body, &manifest); err != nil {
+		return nil, err
+	}
+
+	if isIndex(manifestDescriptor.MediaType, manifest) {
+		platformDescriptor, err := p.selectPlatform(manifest.Manifests)
+		if err != nil {
+			return nil, err
+		}
+		body, mediaType, err = p.Registry.fetchManifest(registry, repository, platformDescriptor.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if manifestDescriptor, err = describe(body, mediaType, platformDescriptor.Digest); err != nil {
+			return nil, err
+		}
+		manifestDescriptor.Platform = platformDescriptor.Platform
+		manifest = ociManifest{}
+		if err = json.Unmarshal(body, &manifest); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &OCIPullResult{Manifest: manifestDescriptor, Config: manifest.Config, Layers: manifest.Layers}
+	blobs := append([]OCIDescriptor{manifest.Config}, manifest.Layers...)
+	if err = p.pullBlobs(dirPath, registry, repository, blobs); err != nil {
+		return nil, err
+	}
+
+	if p.WriteLayout {
+		if !strings.HasPrefix(tag, "sha256:") {
+			manifestDescriptor.Annotations = map[string]string{ociRefNameAnnotation: tag}
+		}
+		if err = writeOCILayout((&Downloader{FileUtils: p.FileUtils}).fs(), dirPath, manifestDescriptor, body); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (p *OCIPuller) pullBlobs(dirPath string, registry string, repository string, blobs []OCIDescriptor) error {
+	blobDir := filepath.Join(dirPath, "blobs", "sha256")
+	downloader := Downloader{Client: p.Registry, FileUtils: p.FileUtils}
+	concurrency := p.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(blobs))
+	wg.Add(len(blobs))
+	for _, blob := range blobs {
+		go func(blob OCIDescriptor) {
+			defer wg.Done()
+			if !strings.HasPrefix(blob.Digest, "sha256:") {
+				errChan <- fmt.Errorf("unsupported blob digest %q", blob.Digest)
+				return
+			}
+			blobPath := fmt.Sprintf("%s/%s", blobDir, strings.TrimPrefix(blob.Digest, "sha256:"))
+			if p.FileUtils.FileExists(blobPath) {
+				if downloader.verifyDigest(blobPath, blob.Digest) == nil {
+					return
+				}
+				p.FileUtils.DeleteFile(blobPath)
+			}
+			if err := downloader.DownloadFileConcurrent(blobDir, BlobURL(registry, repository, blob.Digest), concurrency); err != nil {
+				errChan <- fmt.Errorf("unable to pull blob %s: %v", blob.Digest, err)
+			}
+		}(blob)
+	}
+	wg.Wait()
+	close(errChan)
+
+	for err := range errChan {
+		return err
+	}
+	return nil
+}
+
+func (p *OCIPuller) selectPlatform(manifests []OCIDescriptor) (OCIDescriptor, error) {
+	platform := p.Platform
+	if platform == "" {
+		platform = "linux/" + runtime.GOARCH
+	}
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 {
+		return OCIDescriptor{}, fmt.Errorf("invalid platform %q", platform)
+	}
+	variant := ""
+	if len(parts) > 2 {
+		variant = parts[2]
+	}
+
+	for _, descriptor := range manifests {
+		if descriptor.Platform == nil || descriptor.Platform.OS != parts[0] || descriptor.Platform.Architecture != parts[1] {
+			continue
+		}
+		if variant == "" || descriptor.Platform.Variant == variant {
+			return descriptor, nil
+		}
+	}
+	return OCIDescriptor{}, fmt.Errorf("no manifest for platform %s", platform)
+}
+
+// describe verifies a manifest against the digest it was requested by and
+// returns its descriptor.
+func describe(body []byte, mediaType string, reference string) (OCIDescriptor, error) {
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if strings.HasPrefix(reference, "sha256:") && reference != digest {
+		return OCIDescriptor{}, fmt.Errorf("checksum mismatch for manifest: expected %s, got %s", reference, digest)
+	}
+	if mediaType == "" {
+		var manifest ociManifest
+		json.Unmarshal(body, &manifest)
+		mediaType = manifest.MediaType
+	}
+	return OCIDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(body))}, nil
+}
+
+func isIndex(mediaType string, manifest ociManifest) bool {
+	return mediaType == mediaTypeOCIIndex || mediaType == mediaTypeDockerManifestList ||
+		(len(manifest.Manifests) > 0 && len(manifest.Layers) == 0)
+}
+
+// parseOCIReference splits oci://registry/repository:tag. The tag defaults to
+// latest and may be a digest introduced by '@'.
+func parseOCIReference(reference string) (registry string, repository string, tag string, err error) {
+	trimmed := strings.TrimPrefix(reference, "oci://")
+	slash := strings.Index(trimmed, "/")
+	if trimmed == reference || slash < 1 {
+		return "", "", "", fmt.Errorf("invalid oci reference %q, expected oci://registry/repository:tag", reference)
+	}
+	registry, repository = trimmed[:slash], trimmed[slash+1:]
+
+	if at := strings.Index(repository, "@"); at >= 0 {
+		repository, tag = repository[:at], repository[at+1:]
+	} else if colon := strings.LastIndex(repository, ":"); colon > strings.LastIndex(repository, "/") {
+		repository, tag = repository[:colon], repository[colon+1:]
+	} else {
+		tag = "latest"
+	}
+	if repository == "" || tag == "" {
+		return "", "", "", fmt.Errorf("invalid oci reference %q, expected oci://registry/repository:tag", reference)
+	}
+	return registry, repository, tag, nil
+}
+
+// writeOCILayout stores the manifest as a blob and records it in index.json,
+// replacing an earlier entry for the same tag.
+func writeOCILayout(fs FS, dirPath string, manifest OCIDescriptor, body []byte) error {
+	blobDir := filepath.Join(dirPath, "blobs", "sha256")
+	if err := fs.MkdirAll(blobDir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := writeFile(fs, filepath.Join(blobDir, strings.TrimPrefix(manifest.Digest, "sha256:")), body); err != nil {
+		return err
+	}
+	if err := writeFile(fs, filepath.Join(dirPath, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+
+	index := ociIndex{SchemaVersion: 2}
+	indexPath := filepath.Join(dirPath, "index.json")
+	if existing, err := readFile(fs, indexPath); err == nil {
+		json.Unmarshal(existing, &index)
+	}
+	var manifests []OCIDescriptor
+	for _, descriptor := range index.Manifests {
+		name := descriptor.Annotations[ociRefNameAnnotation]
+		if descriptor.Digest == manifest.Digest || (name != "" && name == manifest.Annotations[ociRefNameAnnotation]) {
+			continue
+		}
+		manifests = append(manifests, descriptor)
+	}
+	index.Manifests = append(manifests, manifest)
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(fs, indexPath, data)
+}
@@ -0,0 +1,271 @@
+package lib
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// OCIClient talks to an OCI distribution (Docker registry v2) api. As a
+// Client it serves blob urls of the form
+// oci://registry/repository/blobs/sha256/<hex>, which map onto the registry
+// blob endpoint, and reports the blob digest so the Downloader verifies it.
+// Bearer tokens are fetched with the registry token handshake and cached per
+// repository.
+type OCIClient struct {
+	Username string
+	Password string
+	// PlainHTTP talks to the registry without TLS, for local registries.
+	PlainHTTP  bool
+	HTTPClient *http.Client
+
+	mutex  sync.Mutex
+	tokens map[string]string
+}
+
+func (c *OCIClient) ResumeGet(url string, existingFileSize int64) (resp *Response, err error) {
+	return c.blob("GET", url, fmt.Sprintf("bytes=%d-", existingFileSize))
+}
+
+func (c *OCIClient) Head(url string) (resp *Response, err error) {
+	return c.blob("HEAD", url, "")
+}
+
+func (c *OCIClient) Get(url string, rangeHeader string) (resp *Response, err error) {
+	return c.blob("GET", url, fmt.Sprintf("bytes=%s", rangeHeader))
+}
+
+func (c *OCIClient) blob(method string, blobURL string, rangeHeader string) (*Response, error) {
+	registry, repository, digest, err := parseBlobURL(blobURL)
+	if err != nil {
+		return nil, err
+	}
+	headers := http.Header{}
+	if rangeHeader != "" {
+		headers.Set("Range", rangeHeader)
+	}
+	resp, err := c.do(method, registry, repository, "blobs/"+digest, headers)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Body: resp.Body, ContentLength: resp.ContentLength, Digest: digest}, nil
+}
+
+// BlobURL returns the Client url of a blob in a repository.
+func BlobURL(registry string, repository string, digest string) string {
+	return fmt.Sprintf("oci://%s/%s/blobs/%s", registry, repository, strings.Replace(digest, ":", "/", 1))
+}
+
+func parseBlobURL(blobURL string) (registry string, repository string, digest string, err error) {
+	u, err := url.Parse(blobURL)
+	if err != nil {
+		return "", "", "", err
+	}
+	index := strings.LastIndex(u.Path, "/blobs/")
+	if u.Scheme != "oci" || index < 1 {
+		return "", "", "", fmt.Errorf("invalid blob url %q", blobURL)
+	}
+	digest = strings.Replace(u.Path[index+len("/blobs/"):], "/", ":", 1)
+	return u.Host, strings.TrimPrefix(u.Path[:index], "/"), digest, nil
+}
+
+// fetchManifest returns the manifest or index body and its media type.
+func (c *OCIClient) fetchManifest(registry string, repository string, reference string) ([]byte, string, error) {
+	headers := http.Header{}
+	headers.Set("Accept", strings.Join([]string{
+		mediaTypeOCIIndex, mediaTypeOCIManifest, mediaTypeDockerManifestList, mediaTypeDockerManifest,
+	}, ", "))
+	resp, err := c.do("GET", registry, repository, "manifests/"+reference, headers)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// do sends a request to the repository api and repeats it once with
+// credentials when the registry challenges it.
+func (c *OCIClient) do(method string, registry string, repository string, path string, headers http.Header) (*http.Response, error) {
+	scheme := "https"
+	if c.PlainHTTP {
+		scheme = "http"
+	}
+	endpoint := fmt.Sprintf("%s://%s/v2/%s/%s", scheme, registry, repository, path)
+
+	resp, err := c.send(method, endpoint, headers, c.cachedAuthorization(registry, repository))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		authorization, err := c.authorize(registry, repository, challenge)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = c.send(method, endpoint, headers, authorization)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		// a StatusError, so 429 and 503 with Retry-After are retried
+		return nil, newStatusError(resp)
+	}
+	return resp, nil
+}
+
+func (c *OCIClient) send(method string, endpoint string, headers http.Header, authorization string) (*http.Response, error) {
+	req, err := http.NewRequest(method, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return c.httpClient().Do(req)
+}
+
+func (c *OCIClient) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *OCIClient) cachedAuthorization(registry string, repository string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.tokens[registry+"/"+repository]
+}
+
+// authorize answers a WWW-Authenticate challenge. Basic challenges use the
+// configured credentials, bearer challenges exchange them for a token at the
+// realm of the challenge.
+func (c *OCIClient) authorize(registry string, repository string, challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	var authorization string
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.Username == "" {
+			return "", fmt.Errorf("registry %s requires credentials", registry)
+		}
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+	case "bearer":
+		token, err := c.fetchToken(params, repository)
+		if err != nil {
+			return "", err
+		}
+		authorization = "Bearer " + token
+	default:
+		return "", fmt.Errorf("unsupported registry authentication challenge %q", challenge)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.tokens == nil {
+		c.tokens = map[string]string{}
+	}
+	c.tokens[registry+"/"+repository] = authorization
+	return authorization, nil
+}
+
+func (c *OCIClient) fetchToken(params map[string]string, repository string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", repository)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request to %s failed with status %s", realm.Host, resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", fmt.Errorf("token response from %s carries no token", realm.Host)
+}
+
+// parseChallenge splits `Bearer realm="...",service="..."` into the scheme and
+// its parameters.
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	tokens := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(tokens) < 2 {
+		return tokens[0], params
+	}
+	rest := tokens[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return tokens[0], params
+}
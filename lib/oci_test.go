@@ -0,0 +1,263 @@
+package lib_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRegistryToken = "test-token"
+
+// registryTestServer is an OCI distribution stand-in that requires a bearer
+// token obtained from its own /token endpoint.
+type registryTestServer struct {
+	*httptest.Server
+	manifests    map[string][]byte
+	blobs        map[string][]byte
+	tokenCalls   int32
+	rangeGets    int32
+	corruptBlobs bool
+	// throttled requests are answered with 429
+	throttled int32
+}
+
+func newRegistryTestServer() *registryTestServer {
+	s := &registryTestServer{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *registryTestServer) Host() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+func (s *registryTestServer) addBlob(content []byte) lib.OCIDescriptor {
+	digest := testDigest(content)
+	s.blobs[digest] = content
+	return lib.OCIDescriptor{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: digest, Size: int64(len(content))}
+}
+
+func (s *registryTestServer) addManifest(tag string, mediaType string, manifest interface{}) lib.OCIDescriptor {
+	body, _ := json.Marshal(manifest)
+	digest := testDigest(body)
+	s.manifests[digest] = body
+	if tag != "" {
+		s.manifests[tag] = body
+	}
+	return lib.OCIDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(body))}
+}
+
+func (s *registryTestServer) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		atomic.AddInt32(&s.tokenCalls, 1)
+		if r.URL.Query().Get("scope") != "repository:team/model:pull" || r.URL.Query().Get("service") != "test-registry" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"token":%q}`, testRegistryToken)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+testRegistryToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry",scope="repository:team/model:pull"`, s.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if atomic.AddInt32(&s.throttled, -1) >= 0 {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	const prefix = "/v2/team/model/"
+	switch {
+	case strings.HasPrefix(r.URL.Path, prefix+"manifests/"):
+		body, ok := s.manifests[strings.TrimPrefix(r.URL.Path, prefix+"manifests/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var probe struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(body, &probe)
+		w.Header().Set("Content-Type", probe.MediaType)
+		w.Write(body)
+	case strings.HasPrefix(r.URL.Path, prefix+"blobs/"):
+		content, ok := s.blobs[strings.TrimPrefix(r.URL.Path, prefix+"blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if s.corruptBlobs {
+			content = bytes.ToUpper(content)
+		}
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&s.rangeGets, 1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func testDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// multiPlatformImage publishes an index with an amd64 and an arm64 image
+// under the tag v1 and returns the layers of both.
+func multiPlatformImage(s *registryTestServer) (amd64Layers []lib.OCIDescriptor, arm64Layers []lib.OCIDescriptor) {
+	config := s.addBlob([]byte(`{"architecture":"amd64","os":"linux"}`))
+	amd64Layers = []lib.OCIDescriptor{s.addBlob(testContent(200 * 1024)), s.addBlob([]byte("weights-amd64"))}
+	amd64 := s.addManifest("", "application/vnd.oci.image.manifest.v1+json", map[string]interface{}{
+		"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "config": config, "layers": amd64Layers,
+	})
+	amd64.Platform = &lib.OCIPlatform{OS: "linux", Architecture: "amd64"}
+
+	armConfig := s.addBlob([]byte(`{"architecture":"arm64","os":"linux"}`))
+	arm64Layers = []lib.OCIDescriptor{s.addBlob([]byte("weights-arm64"))}
+	arm64 := s.addManifest("", "application/vnd.oci.image.manifest.v1+json", map[string]interface{}{
+		"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "config": armConfig, "layers": arm64Layers,
+	})
+	arm64.Platform = &lib.OCIPlatform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+
+	s.addManifest("v1", "application/vnd.oci.image.index.v1+json", map[string]interface{}{
+		"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": []lib.OCIDescriptor{amd64, arm64},
+	})
+	return amd64Layers, arm64Layers
+}
+
+func TestOCIPullerResolvesIndexForPlatform(t *testing.T) {
+	server := newRegistryTestServer()
+	defer server.Close()
+	amd64Layers, arm64Layers := multiPlatformImage(server)
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	puller := lib.OCIPuller{Registry: &lib.OCIClient{PlainHTTP: true}, FileUtils: &lib.File{}, Platform: "linux/arm64/v8"}
+
+	result, err := puller.Pull(dir, fmt.Sprintf("oci://%s/team/model:v1", server.Host()))
+
+	assert.NoError(t, err)
+	assert.Equal(t, arm64Layers, result.Layers)
+	assert.Equal(t, "arm64", result.Manifest.Platform.Architecture)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(arm64Layers[0].Digest, "sha256:")))
+	assert.NoError(t, err)
+	assert.Equal(t, "weights-arm64", string(data))
+	assert.NoFileExists(t, filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(amd64Layers[1].Digest, "sha256:")))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&server.tokenCalls))
+}
+
+func TestOCIPullerDownloadsLayersInSegmentsAndWritesLayout(t *testing.T) {
+	server := newRegistryTestServer()
+	defer server.Close()
+	amd64Layers, _ := multiPlatformImage(server)
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	puller := lib.OCIPuller{Registry: &lib.OCIClient{PlainHTTP: true}, FileUtils: &lib.File{}, Platform: "linux/amd64", Concurrency: 4, WriteLayout: true}
+
+	result, err := puller.Pull(dir, fmt.Sprintf("oci://%s/team/model:v1", server.Host()))
+
+	assert.NoError(t, err)
+	for _, layer := range amd64Layers {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(layer.Digest, "sha256:")))
+		assert.NoError(t, err)
+		assert.Equal(t, server.blobs[layer.Digest], data)
+	}
+	assert.True(t, atomic.LoadInt32(&server.rangeGets) >= 4)
+	assert.FileExists(t, filepath.Join(dir, "oci-layout"))
+
+	var index struct {
+		Manifests []lib.OCIDescriptor `json:"manifests"`
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &index))
+	assert.Len(t, index.Manifests, 1)
+	assert.Equal(t, result.Manifest.Digest, index.Manifests[0].Digest)
+	assert.Equal(t, "v1", index.Manifests[0].Annotations["org.opencontainers.image.ref.name"])
+	assert.FileExists(t, filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(result.Manifest.Digest, "sha256:")))
+}
+
+func TestOCIPullerFailsOnBlobDigestMismatch(t *testing.T) {
+	server := newRegistryTestServer()
+	defer server.Close()
+	multiPlatformImage(server)
+	server.corruptBlobs = true
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	puller := lib.OCIPuller{Registry: &lib.OCIClient{PlainHTTP: true}, FileUtils: &lib.File{}, Platform: "linux/amd64"}
+
+	_, err = puller.Pull(dir, fmt.Sprintf("oci://%s/team/model:v1", server.Host()))
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+}
+
+func TestOCIPullerFailsWhenPlatformIsMissing(t *testing.T) {
+	server := newRegistryTestServer()
+	defer server.Close()
+	multiPlatformImage(server)
+	puller := lib.OCIPuller{Registry: &lib.OCIClient{PlainHTTP: true}, FileUtils: &lib.File{}, Platform: "windows/amd64"}
+
+	_, err := puller.Pull(os.TempDir(), fmt.Sprintf("oci://%s/team/model:v1", server.Host()))
+
+	assert.EqualError(t, err, "no manifest for platform windows/amd64")
+}
+
+func TestOCIPullerPullsManifestByDigest(t *testing.T) {
+	server := newRegistryTestServer()
+	defer server.Close()
+	layer := server.addBlob([]byte("tool binary"))
+	config := server.addBlob([]byte("{}"))
+	manifest := server.addManifest("", "application/vnd.oci.image.manifest.v1+json", map[string]interface{}{
+		"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "config": config, "layers": []lib.OCIDescriptor{layer},
+	})
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	puller := lib.OCIPuller{Registry: &lib.OCIClient{PlainHTTP: true}, FileUtils: &lib.File{}}
+
+	result, err := puller.Pull(dir, fmt.Sprintf("oci://%s/team/model@%s", server.Host(), manifest.Digest))
+
+	assert.NoError(t, err)
+	assert.Equal(t, manifest.Digest, result.Manifest.Digest)
+	assert.Equal(t, []lib.OCIDescriptor{layer}, result.Layers)
+}
+
+func TestOCIClientReportsThrottlingAsStatusError(t *testing.T) {
+	server := newRegistryTestServer()
+	defer server.Close()
+	layer := server.addBlob([]byte("tool binary"))
+	server.throttled = 1
+	client := &lib.OCIClient{PlainHTTP: true}
+
+	_, err := client.Head(lib.BlobURL(server.Host(), "team/model", layer.Digest))
+
+	statusErr, ok := err.(*lib.StatusError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusTooManyRequests, statusErr.StatusCode)
+	assert.Equal(t, 3*time.Second, statusErr.RetryAfter)
+
+	resp, err := client.Head(lib.BlobURL(server.Host(), "team/model", layer.Digest))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("tool binary")), resp.ContentLength)
+}
@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// partSuffix marks a file that is still being downloaded, it is renamed to
+// its real name once it is complete and verified.
+const partSuffix = ".part"
+
+// partMeta is kept next to a .part file and tells whether it belongs to the
+// same remote file as a later download, which may then continue it.
+type partMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified,omitempty"`
+	// Size is the length of the complete file, -1 when unknown.
+	Size int64 `json:"size"`
+	// Ranges are the segments of a concurrent download.
+	Ranges []string `json:"ranges,omitempty"`
+}
+
+func newPartMeta(url string, resp *Response, ranges []string) partMeta {
+	return partMeta{URL: url, ETag: resp.ETag, LastModified: resp.LastModified, Size: resp.ContentLength, Ranges: ranges}
+}
+
+// resumable reports whether the parts described by m can be continued for a
+// download described by next. The remote file has to carry a validator that
+// is unchanged, otherwise the parts could belong to an older version.
+func (m *partMeta) resumable(next partMeta) bool {
+	if m == nil || m.URL != next.URL || m.Size != next.Size || len(m.Ranges) != len(next.Ranges) {
+		return false
+	}
+	for index := range m.Ranges {
+		if m.Ranges[index] != next.Ranges[index] {
+			return false
+		}
+	}
+	if next.ETag == "" && next.LastModified.IsZero() {
+		return false
+	}
+	return m.ETag == next.ETag && m.LastModified.Equal(next.LastModified)
+}
+
+// sameVersion reports whether resp, the answer to a request resuming the
+// part after done bytes, continues the file m was written from. Without an
+// ETag or Last-Modified there is no telling, like with resumable.
+func (m *partMeta) sameVersion(resp *Response, done int64) bool {
+	if m == nil || (m.ETag == "" && m.LastModified.IsZero()) {
+		return false
+	}
+	if m.ETag != resp.ETag || !m.LastModified.Equal(resp.LastModified) {
+		return false
+	}
+	// a server ignoring the range sends the whole file again
+	if m.Size >= 0 && resp.ContentLength >= 0 && done+resp.ContentLength != m.Size {
+		return false
+	}
+	return true
+}
+
+func partMetaPath(partPath string) string {
+	return partPath + ".json"
+}
+
+func readPartMeta(fs FS, partPath string) *partMeta {
+	data, err := readFile(fs, partMetaPath(partPath))
+	if err != nil {
+		return nil
+	}
+	var meta partMeta
+	if json.Unmarshal(data, &meta) != nil {
+		return nil
+	}
+	return &meta
+}
+
+// writePartMeta is best effort, without it the part is only thrown away
+// instead of continued.
+func writePartMeta(fs FS, partPath string, meta partMeta) {
+	data, err := json.Marshal(meta)
+	if err == nil {
+		writeFile(fs, partMetaPath(partPath), data)
+	}
+}
+
+// discardPart removes a part that can't be finished and its metadata.
+func (d *Downloader) discardPart(partPath string) {
+	d.FileUtils.DeleteFile(partPath)
+	d.fs().Remove(partMetaPath(partPath))
+}
+
+// partCheck is run on a complete part before it is renamed into place.
+type partCheck func(partPath string) error
+
+// digestCheck checks a part against digest, nil when there is none.
+func (d *Downloader) digestCheck(digest string) partCheck {
+	if digest == "" {
+		return nil
+	}
+	return func(partPath string) error {
+		return d.verifyDigest(partPath, digest)
+	}
+}
+
+// commitPart runs checks on partPath, nil ones are skipped, and moves it into
+// place at filePath. A part that fails a check is removed.
+func (d *Downloader) commitPart(partPath string, filePath string, checks ...partCheck) error {
+	for _, check := range checks {
+		if check == nil {
+			continue
+		}
+		if err := check(partPath); err != nil {
+			d.discardPart(partPath)
+			return err
+		}
+	}
+	if err := d.FileUtils.CommitFile(partPath, filePath); err != nil {
+		return err
+	}
+	d.fs().Remove(partMetaPath(partPath))
+	return nil
+}
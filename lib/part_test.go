@@ -0,0 +1,182 @@
+package lib_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+// cutWriter drops the connection once limit bytes of the body are written.
+type cutWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *cutWriter) Write(data []byte) (int, error) {
+	if len(data) > w.limit {
+		w.ResponseWriter.Write(data[:w.limit])
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.limit -= len(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// interruptedServer serves content with validators and breaks off the
+// first GET after cut bytes. It records the Range of every GET. A plain
+// server sends no validators, one ignoring ranges answers every GET with
+// the whole file in chunks.
+type interruptedServer struct {
+	*httptest.Server
+	mutex       sync.Mutex
+	cut         int
+	ranges      []string
+	plain       bool
+	ignoreRange bool
+}
+
+func newInterruptedServer(content []byte, cut int) *interruptedServer {
+	server := &interruptedServer{cut: cut}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		plain, ignoreRange := server.plain, server.ignoreRange
+		server.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		if plain {
+			modified = time.Time{}
+		} else {
+			w.Header().Set("ETag", `"v1"`)
+		}
+		if r.Method == http.MethodGet {
+			server.mutex.Lock()
+			server.ranges = append(server.ranges, r.Header.Get("Range"))
+			cut := server.cut
+			server.cut = -1
+			server.mutex.Unlock()
+			if cut >= 0 {
+				w = &cutWriter{ResponseWriter: w, limit: cut}
+			}
+			if ignoreRange {
+				w.Write(content)
+				return
+			}
+		}
+		http.ServeContent(w, r, "", modified, bytes.NewReader(content))
+	}))
+	return server
+}
+
+func (s *interruptedServer) requestedRanges() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+func TestDownloadFileResumesInterruptedPart(t *testing.T) {
+	content := testContent(64 * 1024)
+	server := newInterruptedServer(content, 20000)
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+	assert.Error(t, downloader.DownloadFile("dl", server.URL+"/file.bin"))
+	_, err := fs.ReadFile("dl/file.bin")
+	assert.Error(t, err)
+	part, err := fs.ReadFile("dl/file.bin.part")
+	assert.NoError(t, err)
+	assert.True(t, len(part) > 0)
+
+	assert.NoError(t, downloader.DownloadFile("dl", server.URL+"/file.bin"))
+	data, err := fs.ReadFile("dl/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, []string{"dl/file.bin"}, fs.Files())
+	ranges := server.requestedRanges()
+	assert.Len(t, ranges, 2)
+	assert.NotEqual(t, "bytes=0-", ranges[1])
+}
+
+func TestDownloadFileRestartsPartWithoutValidators(t *testing.T) {
+	content := testContent(64 * 1024)
+	server := newInterruptedServer(content, 20000)
+	server.plain = true
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+	assert.Error(t, downloader.DownloadFile("dl", server.URL+"/file.bin"))
+	assert.NoError(t, downloader.DownloadFile("dl", server.URL+"/file.bin"))
+
+	data, err := fs.ReadFile("dl/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, []string{"bytes=0-", "bytes=0-"}, server.requestedRanges())
+}
+
+func TestDownloadFileRestartsPartWhenTheRangeIsIgnored(t *testing.T) {
+	content := testContent(64 * 1024)
+	server := newInterruptedServer(content, 20000)
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+	assert.Error(t, downloader.DownloadFile("dl", server.URL+"/file.bin"))
+	server.mutex.Lock()
+	server.ignoreRange = true
+	server.mutex.Unlock()
+	assert.NoError(t, downloader.DownloadFile("dl", server.URL+"/file.bin"))
+
+	data, err := fs.ReadFile("dl/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	ranges := server.requestedRanges()
+	assert.Len(t, ranges, 3)
+	assert.Equal(t, "bytes=0-", ranges[2])
+}
+
+func TestDownloadFileDiscardsUnknownPart(t *testing.T) {
+	content := testContent(4096)
+	server := newInterruptedServer(content, -1)
+	defer server.Close()
+	fs := &lib.MemFS{}
+	assert.NoError(t, fs.MkdirAll("dl", 0755))
+	part, err := fs.Create("dl/file.bin.part")
+	assert.NoError(t, err)
+	part.Write([]byte("left over from something else"))
+	part.Close()
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+	assert.NoError(t, downloader.DownloadFile("dl", server.URL+"/file.bin"))
+	data, err := fs.ReadFile("dl/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, []string{"dl/file.bin"}, fs.Files())
+}
+
+func TestDownloadFileConcurrentResumesInterruptedParts(t *testing.T) {
+	content := testContent(64 * 1024)
+	server := newInterruptedServer(content, 5000)
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}}
+
+	assert.Error(t, downloader.DownloadFileConcurrent("dl", server.URL+"/file.bin", 4))
+	_, err := fs.ReadFile("dl/file.bin")
+	assert.Error(t, err)
+
+	assert.NoError(t, downloader.DownloadFileConcurrent("dl", server.URL+"/file.bin", 4))
+	data, err := fs.ReadFile("dl/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, []string{"dl/file.bin"}, fs.Files())
+	// only the interrupted segment is fetched again, from where it broke off
+	ranges := server.requestedRanges()
+	assert.Len(t, ranges, 5)
+}
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ProtocolClient dispatches every call to the Client registered for the
+// scheme of the url, so a single Downloader can fetch http, ftp, sftp, s3
+// and oci blob urls alike.
+type ProtocolClient struct {
+	clients map[string]Client
+}
+
+// NewProtocolClient returns a ProtocolClient with the built in transports
+// registered.
+func NewProtocolClient() *ProtocolClient {
+	httpClient := &HTTPClient{}
+	httpClient.NewHttpClient()
+	ftpClient := &FTPClient{}
+	sftpClient := &SFTPClient{}
+
+	p := &ProtocolClient{}
+	p.Register("http", httpClient)
+	p.Register("https", httpClient)
+	p.Register("ftp", ftpClient)
+	p.Register("ftps", ftpClient)
+	p.Register("ftpes", ftpClient)
+	p.Register("sftp", sftpClient)
+	p.Register("scp", sftpClient)
+	p.Register("s3", &S3Client{})
+	p.Register("oci", &OCIClient{})
+	return p
+}
+
+func (p *ProtocolClient) Register(scheme string, client Client) {
+	if p.clients == nil {
+		p.clients = map[string]Client{}
+	}
+	p.clients[strings.ToLower(scheme)] = client
+}
+
+func (p *ProtocolClient) ResumeGet(url string, existingFileSize int64) (resp *Response, err error) {
+	client, err := p.clientFor(url)
+	if err != nil {
+		return nil, err
+	}
+	return client.ResumeGet(url, existingFileSize)
+}
+
+func (p *ProtocolClient) Head(url string) (resp *Response, err error) {
+	client, err := p.clientFor(url)
+	if err != nil {
+		return nil, err
+	}
+	return client.Head(url)
+}
+
+func (p *ProtocolClient) HeadIfChanged(url string, validators Validators) (resp *Response, err error) {
+	client, err := p.clientFor(url)
+	if err != nil {
+		return nil, err
+	}
+	return headIfChanged(client, url, validators)
+}
+
+func (p *ProtocolClient) Get(url string, rangeHeader string) (resp *Response, err error) {
+	client, err := p.clientFor(url)
+	if err != nil {
+		return nil, err
+	}
+	return client.Get(url, rangeHeader)
+}
+
+func (p *ProtocolClient) clientFor(rawURL string) (Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	client, ok := p.clients[strings.ToLower(u.Scheme)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+	return client, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package lib
+
+import "errors"
+
+func reflinkFile(src string, dst string) error {
+	return errors.New("reflinks are not supported on this platform")
+}
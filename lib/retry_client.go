@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	defaultRetryAttempts = 3
+	defaultRetryBackoff  = 500 * time.Millisecond
+	maxRetryBackoff      = 30 * time.Second
+)
+
+// RetryClient retries the calls of the wrapped Client that fail with a
+// network error or a retryable status (408, 429 and 5xx). The delay doubles
+// after every attempt, starting at Backoff, unless the server sent
+// Retry-After.
+type RetryClient struct {
+	Client   Client
+	Attempts int
+	Backoff  time.Duration
+}
+
+func (c *RetryClient) ResumeGet(url string, existingFileSize int64) (resp *Response, err error) {
+	return c.retry(func() (*Response, error) {
+		return c.Client.ResumeGet(url, existingFileSize)
+	})
+}
+
+func (c *RetryClient) Head(url string) (resp *Response, err error) {
+	return c.retry(func() (*Response, error) {
+		return c.Client.Head(url)
+	})
+}
+
+func (c *RetryClient) HeadIfChanged(url string, validators Validators) (resp *Response, err error) {
+	return c.retry(func() (*Response, error) {
+		return headIfChanged(c.Client, url, validators)
+	})
+}
+
+func (c *RetryClient) Get(url string, rangeHeader string) (resp *Response, err error) {
+	return c.retry(func() (*Response, error) {
+		return c.Client.Get(url, rangeHeader)
+	})
+}
+
+func (c *RetryClient) retry(call func() (*Response, error)) (*Response, error) {
+	attempts := c.Attempts
+	if attempts < 1 {
+		attempts = defaultRetryAttempts
+	}
+	backoff := c.Backoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var resp *Response
+		resp, err = call()
+		if err == nil || attempt == attempts || !isRetryable(err) {
+			return resp, err
+		}
+
+		delay := backoff
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+			delay = statusErr.RetryAfter
+		}
+		if delay > maxRetryBackoff {
+			delay = maxRetryBackoff
+		}
+		time.Sleep(delay)
+		backoff *= 2
+	}
+}
+
+func isRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		code := statusErr.StatusCode
+		return code == 408 || code == 429 || code >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,55 @@
+package lib_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/amithnair91/godownload/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryClientRetriesRetryableStatus(t *testing.T) {
+	url := "www.someurl.com/file.txt"
+	response := &lib.Response{ContentLength: 10}
+	unavailable := &lib.StatusError{URL: url, StatusCode: 503, Status: "503 Service Unavailable"}
+	mockClient := &mocks.MockClient{}
+	mockClient.On("Head", url).Return(nil, unavailable).Twice()
+	mockClient.On("Head", url).Return(response, nil).Once()
+	client := lib.RetryClient{Client: mockClient, Attempts: 3, Backoff: time.Millisecond}
+
+	resp, err := client.Head(url)
+
+	assert.NoError(t, err)
+	assert.Equal(t, response, resp)
+	mockClient.AssertNumberOfCalls(t, "Head", 3)
+}
+
+func TestRetryClientGivesUpAfterAttempts(t *testing.T) {
+	url := "www.someurl.com/file.txt"
+	tooMany := &lib.StatusError{URL: url, StatusCode: 429, Status: "429 Too Many Requests", RetryAfter: time.Millisecond}
+	mockClient := &mocks.MockClient{}
+	mockClient.On("Get", url, "0-9").Return(nil, tooMany)
+	client := lib.RetryClient{Client: mockClient, Attempts: 2, Backoff: time.Millisecond}
+
+	_, err := client.Get(url, "0-9")
+
+	assert.Equal(t, tooMany, err)
+	mockClient.AssertNumberOfCalls(t, "Get", 2)
+}
+
+func TestRetryClientDoesNotRetryPermanentErrors(t *testing.T) {
+	url := "www.someurl.com/file.txt"
+	notFound := &lib.StatusError{URL: url, StatusCode: 404, Status: "404 Not Found"}
+	mockClient := &mocks.MockClient{}
+	mockClient.On("ResumeGet", url, int64(0)).Return(nil, notFound).Once()
+	mockClient.On("Head", url).Return(nil, errors.New("unsupported url scheme")).Once()
+	client := lib.RetryClient{Client: mockClient, Attempts: 3, Backoff: time.Millisecond}
+
+	_, err := client.ResumeGet(url, 0)
+	assert.Equal(t, notFound, err)
+	_, err = client.Head(url)
+	assert.EqualError(t, err, "unsupported url scheme")
+	mockClient.AssertExpectations(t)
+}
@@ -0,0 +1,317 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	amzDateFormat    = "20060102T150405Z"
+)
+
+// S3Client implements Client for s3://bucket/key urls. Requests are signed
+// with AWS Signature Version 4 using the explicit credentials, the
+// AWS_ACCESS_KEY_ID family of environment variables or the shared
+// credentials file, in that order. Setting Endpoint targets an S3 compatible
+// server such as MinIO with path style addressing.
+type S3Client struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Region          string
+	// Profile selects the section of the shared config files, it defaults to
+	// AWS_PROFILE or "default".
+	Profile    string
+	Endpoint   string
+	HTTPClient *http.Client
+}
+
+type s3Credentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (c *S3Client) ResumeGet(url string, existingFileSize int64) (resp *Response, err error) {
+	return c.do("GET", url, fmt.Sprintf("bytes=%d-", existingFileSize))
+}
+
+func (c *S3Client) Head(url string) (resp *Response, err error) {
+	return c.do("HEAD", url, "")
+}
+
+func (c *S3Client) Get(url string, rangeHeader string) (resp *Response, err error) {
+	return c.do("GET", url, fmt.Sprintf("bytes=%s", rangeHeader))
+}
+
+func (c *S3Client) do(method string, rawURL string, rangeHeader string) (*Response, error) {
+	endpoint, err := c.objectURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+
+	credentials, err := c.credentials()
+	if err != nil {
+		return nil, err
+	}
+	signV4(req, credentials, c.region(), "s3", time.Now())
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, newS3Error(rawURL, resp)
+	}
+
+	response := &Response{Body: resp.Body, ContentLength: resp.ContentLength, ETag: resp.Header.Get("ETag")}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		response.LastModified = lastModified
+	}
+	// the ETag of an object uploaded in a single part is its md5, multipart
+	// ETags carry a "-<parts>" suffix and can't be checked locally
+	etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+	if len(etag) == 32 && !strings.Contains(etag, "-") {
+		response.Digest = "md5:" + etag
+	}
+	return response, nil
+}
+
+// newS3Error is a StatusError, so 503 SlowDown and the like are retried,
+// with the error code of the response body in its status.
+func newS3Error(rawURL string, resp *http.Response) error {
+	statusErr := newStatusError(resp)
+	statusErr.URL = rawURL
+	var s3Err s3Error
+	body, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		statusErr.Status = fmt.Sprintf("%s (%s: %s)", resp.Status, s3Err.Code, s3Err.Message)
+	}
+	return statusErr
+}
+
+func (c *S3Client) objectURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	bucket := u.Host
+	key := strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return "", fmt.Errorf("invalid s3 url %q, expected s3://bucket/key", rawURL)
+	}
+
+	if c.Endpoint != "" {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(c.Endpoint, "/"), bucket, s3Escape(key)), nil
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, c.region(), s3Escape(key)), nil
+}
+
+func (c *S3Client) region() string {
+	if c.Region != "" {
+		return c.Region
+	}
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region
+		}
+	}
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = awsSharedFile("config")
+	}
+	profile := c.profile()
+	section := "profile " + profile
+	if profile == "default" {
+		section = profile
+	}
+	if region := readIniFile(configFile)[section]["region"]; region != "" {
+		return region
+	}
+	return "us-east-1"
+}
+
+func (c *S3Client) profile() string {
+	if c.Profile != "" {
+		return c.Profile
+	}
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+		return profile
+	}
+	return "default"
+}
+
+func (c *S3Client) credentials() (s3Credentials, error) {
+	if c.AccessKeyID != "" {
+		return s3Credentials{c.AccessKeyID, c.SecretAccessKey, c.SessionToken}, nil
+	}
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return s3Credentials{id, os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	credentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = awsSharedFile("credentials")
+	}
+	section := readIniFile(credentialsFile)[c.profile()]
+	if section["aws_access_key_id"] == "" {
+		return s3Credentials{}, fmt.Errorf("no aws credentials found for profile %s", c.profile())
+	}
+	return s3Credentials{section["aws_access_key_id"], section["aws_secret_access_key"], section["aws_session_token"]}, nil
+}
+
+func awsSharedFile(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".aws", name)
+}
+
+// readIniFile parses the subset of ini used by the aws shared config files.
+// A missing file yields no sections.
+func readIniFile(path string) map[string]map[string]string {
+	sections := map[string]map[string]string{}
+	file, err := os.Open(path)
+	if err != nil {
+		return sections
+	}
+	defer file.Close()
+
+	var current map[string]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			current = map[string]string{}
+			sections[name] = current
+		case current != nil && strings.Contains(line, "="):
+			kv := strings.SplitN(line, "=", 2)
+			current[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return sections
+}
+
+// signV4 adds the AWS Signature Version 4 headers to a request without a body.
+func signV4(req *http.Request, credentials s3Credentials, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if credentials.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, credentials.accessKeyID, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(values url.Values) string {
+	var pairs []string
+	for key, vals := range values {
+		for _, val := range vals {
+			pairs = append(pairs, queryEscape(key)+"="+queryEscape(val))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent encodes everything but the unreserved characters and '/'.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || ch == '/' {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+func queryEscape(s string) string {
+	return strings.Replace(s3Escape(s), "/", "%2F", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,312 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServeOptions tunes a FileServer. The faults are for testing clients
+// against a misbehaving server.
+type ServeOptions struct {
+	// Rate limits every response to this many bytes per second, zero means
+	// unlimited.
+	Rate int64
+	// ErrorRate is the share of requests turned down with 503 and a
+	// Retry-After of a second.
+	ErrorRate float64
+	// ResetRate is the share of responses whose connection is dropped half
+	// way through the body.
+	ResetRate float64
+	// Seed makes the faults repeatable, zero picks one from the clock.
+	Seed int64
+}
+
+// FileServer serves the files below Root of an FS over http with ranges,
+// validators and the sha256 digest of every file. Directories are listed as
+// html index pages and a missing <file>.blockindex is generated from <file>,
+// so clients can update older copies with DownloadDelta.
+type FileServer struct {
+	FS      FS
+	Root    string
+	Options ServeOptions
+
+	once    sync.Once
+	mutex   sync.Mutex
+	random  *rand.Rand
+	digests map[string]*servedSum
+	indexes map[string]*servedSum
+}
+
+// servedSum is something computed from a file, valid as long as its size
+// and mtime are unchanged. data and err are set once ready is closed.
+type servedSum struct {
+	size    int64
+	modTime time.Time
+	ready   chan struct{}
+	data    []byte
+	err     error
+}
+
+func (s *FileServer) init() {
+	s.once.Do(func() {
+		seed := s.Options.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		s.random = rand.New(rand.NewSource(seed))
+		s.digests = map[string]*servedSum{}
+		s.indexes = map[string]*servedSum{}
+	})
+}
+
+func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.init()
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.fault(s.Options.ErrorRate) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	name := path.Clean("/" + r.URL.Path)
+	filePath := path.Join(s.Root, name)
+
+	info, err := s.FS.Stat(filePath)
+	if os.IsNotExist(err) && strings.HasSuffix(name, DeltaSuffix) {
+		s.serveBlockIndex(w, r, strings.TrimSuffix(filePath, DeltaSuffix))
+		return
+	}
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		s.serveDir(w, name, filePath)
+		return
+	}
+
+	digest, err := s.cached(s.digests, filePath, info, func() ([]byte, error) {
+		checksum, err := (&File{FS: s.FS}).Checksum(filePath, "sha256")
+		if err != nil {
+			return nil, err
+		}
+		return hex.DecodeString(checksum)
+	})
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	file, err := s.FS.Open(filePath)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	defer file.Close()
+
+	encoded := base64.StdEncoding.EncodeToString(digest)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	w.Header().Set("Repr-Digest", "sha-256=:"+encoded+":")
+	w.Header().Set("Digest", "SHA-256="+encoded)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+	if w.Header().Get("Content-Type") == "" && mime.TypeByExtension(path.Ext(name)) == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	http.ServeContent(s.wrap(w), r, info.Name(), info.ModTime(), file)
+}
+
+// serveBlockIndex answers a request for <file>.blockindex with the block
+// index of filePath.
+func (s *FileServer) serveBlockIndex(w http.ResponseWriter, r *http.Request, filePath string) {
+	info, err := s.FS.Stat(filePath)
+	if err == nil && info.IsDir() {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	data, err := s.cached(s.indexes, filePath, info, func() ([]byte, error) {
+		file, err := s.FS.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		index, err := GenerateBlockIndex(file, DefaultBlockSize)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		_, err = index.WriteTo(&buf)
+		return buf.Bytes(), err
+	})
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x.blockindex"`, info.Size(), info.ModTime().UnixNano()))
+	http.ServeContent(s.wrap(w), r, "", info.ModTime(), bytes.NewReader(data))
+}
+
+func (s *FileServer) serveDir(w http.ResponseWriter, name string, dirPath string) {
+	infos, err := s.FS.ReadDir(dirPath)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	var page bytes.Buffer
+	fmt.Fprintf(&page, "<html><head><title>Index of %s</title></head><body>\n<h1>Index of %s</h1>\n<pre>\n", html.EscapeString(name), html.EscapeString(name))
+	if name != "/" {
+		fmt.Fprintf(&page, "<a href=\"../\">../</a>\n")
+	}
+	for _, info := range infos {
+		entry := info.Name()
+		if info.IsDir() {
+			entry += "/"
+		}
+		fmt.Fprintf(&page, "<a href=\"%s\">%s</a> %d\n", (&url.URL{Path: entry}).EscapedPath(), html.EscapeString(entry), info.Size())
+	}
+	page.WriteString("</pre>\n</body></html>\n")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(page.Len()))
+	s.wrap(w).Write(page.Bytes())
+}
+
+// cached returns what compute makes of filePath, computing it again once the
+// file changed. Concurrent requests for a file wait for the same compute.
+func (s *FileServer) cached(cache map[string]*servedSum, filePath string, info os.FileInfo, compute func() ([]byte, error)) ([]byte, error) {
+	s.mutex.Lock()
+	sum, ok := cache[filePath]
+	if ok && sum.size == info.Size() && sum.modTime.Equal(info.ModTime()) {
+		s.mutex.Unlock()
+		<-sum.ready
+		return sum.data, sum.err
+	}
+	sum = &servedSum{size: info.Size(), modTime: info.ModTime(), ready: make(chan struct{})}
+	cache[filePath] = sum
+	s.mutex.Unlock()
+
+	sum.data, sum.err = compute()
+	close(sum.ready)
+	if sum.err != nil {
+		// the next request tries again
+		s.mutex.Lock()
+		if cache[filePath] == sum {
+			delete(cache, filePath)
+		}
+		s.mutex.Unlock()
+	}
+	return sum.data, sum.err
+}
+
+func (s *FileServer) fault(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.random.Float64() < rate
+}
+
+func (s *FileServer) wrap(w http.ResponseWriter) http.ResponseWriter {
+	served := &servedWriter{ResponseWriter: w, cut: -1, half: s.fault(s.Options.ResetRate)}
+	if s.Options.Rate > 0 {
+		served.limiter = &rateLimiter{limit: s.Options.Rate}
+	}
+	return served
+}
+
+// NewFaultyWriter returns w throttled to rate bytes per second, unlimited
+// when zero, dropping the connection once cut bytes of the body are written,
+// never when cut is negative. It lets test servers misbehave like FileServer.
+func NewFaultyWriter(w http.ResponseWriter, rate int64, cut int64) http.ResponseWriter {
+	served := &servedWriter{ResponseWriter: w, cut: cut}
+	if rate > 0 {
+		served.limiter = &rateLimiter{limit: rate}
+	}
+	return served
+}
+
+func serveError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "not found", http.StatusNotFound)
+	case os.IsPermission(err):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+// servedWriter throttles a response and, when cut isn't negative, drops the
+// connection once cut bytes of the body are written, or half of them when
+// half is set.
+type servedWriter struct {
+	http.ResponseWriter
+	limiter *rateLimiter
+	half    bool
+	cut     int64
+	written int64
+}
+
+func (w *servedWriter) Write(p []byte) (int, error) {
+	if w.half {
+		w.half = false
+		length, _ := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+		if length/2 > 0 {
+			w.cut = length / 2
+		}
+	}
+	n := 0
+	for n < len(p) {
+		chunk := len(p) - n
+		if w.limiter != nil {
+			chunk = w.limiter.chunk(chunk)
+			w.limiter.wait(chunk, nil)
+		}
+		if w.cut >= 0 && w.written+int64(chunk) > w.cut {
+			chunk = int(w.cut - w.written)
+			written, _ := w.ResponseWriter.Write(p[n : n+chunk])
+			w.written += int64(written)
+			w.flush()
+			panic(http.ErrAbortHandler)
+		}
+		written, err := w.ResponseWriter.Write(p[n : n+chunk])
+		n += written
+		w.written += int64(written)
+		if err != nil {
+			return n, err
+		}
+		// a throttled body trickles out instead of waiting in the buffer
+		if w.limiter != nil {
+			w.flush()
+		}
+	}
+	return n, nil
+}
+
+func (w *servedWriter) flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
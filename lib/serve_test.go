@@ -0,0 +1,182 @@
+package lib_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func newServedFS(t *testing.T, files map[string][]byte) *lib.MemFS {
+	fs := &lib.MemFS{}
+	for name, content := range files {
+		writeMemFile(t, fs, "www/"+name, content)
+	}
+	return fs
+}
+
+func TestFileServerRanges(t *testing.T) {
+	content := testContent(1000)
+	server := httptest.NewServer(&lib.FileServer{FS: newServedFS(t, map[string][]byte{"data.bin": content}), Root: "www"})
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/data.bin")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, `attachment; filename=data.bin`, resp.Header.Get("Content-Disposition"))
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+
+	request, _ := http.NewRequest("GET", server.URL+"/data.bin", nil)
+	request.Header.Set("Range", "bytes=0-9,500-509")
+	resp, err = http.DefaultClient.Do(request)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	parts := multipart.NewReader(resp.Body, params["boundary"])
+	for _, from := range []int{0, 500} {
+		part, err := parts.NextPart()
+		assert.NoError(t, err)
+		data, _ := ioutil.ReadAll(part)
+		assert.Equal(t, content[from:from+10], data)
+	}
+	resp.Body.Close()
+
+	for ifRange, status := range map[string]int{etag: http.StatusPartialContent, `"stale"`: http.StatusOK} {
+		request, _ = http.NewRequest("GET", server.URL+"/data.bin", nil)
+		request.Header.Set("Range", "bytes=100-")
+		request.Header.Set("If-Range", ifRange)
+		resp, err = http.DefaultClient.Do(request)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, ifRange)
+	}
+
+	resp, err = http.Get(server.URL + "/../www/data.bin")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDownloadFromFileServer(t *testing.T) {
+	content := randomContent(7, 100000)
+	fs := newServedFS(t, map[string][]byte{"dist/app.bin": content})
+	server := httptest.NewServer(&lib.FileServer{FS: fs, Root: "www"})
+	defer server.Close()
+	client := lib.NewProtocolClient()
+
+	head, err := client.Head(server.URL + "/dist/app.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, sha256Digest(content), head.Digest)
+
+	downloader := lib.Downloader{Client: client, FileUtils: &lib.File{FS: fs}}
+	assert.NoError(t, downloader.DownloadFileConcurrent("dl", server.URL+"/dist/app.bin", 4))
+	data, err := fs.ReadFile("dl/app.bin")
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(content, data))
+
+	// the server generates the block index for delta updates
+	updated := append(append([]byte{}, content[:60000]...), randomContent(8, 5000)...)
+	writeMemFile(t, fs, "www/dist/app.bin", updated)
+	result, err := downloader.DownloadDelta("dl", server.URL+"/dist/app.bin", "", 2)
+	assert.NoError(t, err)
+	assert.True(t, result.Reused >= 56000, "reused %d bytes", result.Reused)
+	data, err = fs.ReadFile("dl/app.bin")
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(updated, data))
+
+	resp, err := http.Get(server.URL + "/dist")
+	assert.NoError(t, err)
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, server.URL+"/dist/", resp.Request.URL.String())
+	assert.True(t, strings.Contains(string(page), `<a href="app.bin">app.bin</a>`), string(page))
+}
+
+func TestFileServerFaults(t *testing.T) {
+	fs := newServedFS(t, map[string][]byte{"data.bin": testContent(100000)})
+
+	failing := httptest.NewServer(&lib.FileServer{FS: fs, Root: "www", Options: lib.ServeOptions{ErrorRate: 1}})
+	defer failing.Close()
+	resp, err := http.Get(failing.URL + "/data.bin")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	resetting := httptest.NewServer(&lib.FileServer{FS: fs, Root: "www", Options: lib.ServeOptions{ResetRate: 1}})
+	defer resetting.Close()
+	resp, err = http.Get(resetting.URL + "/data.bin")
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Error(t, err)
+	assert.Equal(t, 50000, len(data))
+}
+
+func TestFileServerRate(t *testing.T) {
+	server := httptest.NewServer(&lib.FileServer{FS: newServedFS(t, map[string][]byte{"data.bin": testContent(20000)}), Root: "www", Options: lib.ServeOptions{Rate: 100000}})
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := http.Get(server.URL + "/data.bin")
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Len(t, data, 20000)
+	assert.True(t, time.Since(start) >= 150*time.Millisecond, "took %v", time.Since(start))
+}
+
+// slowOpenFS counts the files opened and takes its time opening them.
+type slowOpenFS struct {
+	*lib.MemFS
+	opens int32
+}
+
+func (fs *slowOpenFS) Open(name string) (lib.FSFile, error) {
+	atomic.AddInt32(&fs.opens, 1)
+	time.Sleep(50 * time.Millisecond)
+	return fs.MemFS.Open(name)
+}
+
+func TestFileServerHashesAFileOnceForConcurrentFirstRequests(t *testing.T) {
+	content := testContent(100000)
+	fs := &slowOpenFS{MemFS: newServedFS(t, map[string][]byte{"data.bin": content})}
+	server := httptest.NewServer(&lib.FileServer{FS: fs, Root: "www"})
+	defer server.Close()
+	sum := sha256.Sum256(content)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(server.URL + "/data.bin")
+			assert.NoError(t, err)
+			data, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.NoError(t, err)
+			assert.Equal(t, content, data)
+			assert.Equal(t, "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":", resp.Header.Get("Repr-Digest"))
+		}()
+	}
+	wg.Wait()
+	// once to hash it, then once per response
+	assert.Equal(t, int32(6), atomic.LoadInt32(&fs.opens))
+}
@@ -0,0 +1,264 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const defaultSSHTimeout = 30 * time.Second
+
+var defaultSSHKeyFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// SFTPClient implements Client for sftp:// and scp:// urls over SSH. It
+// authenticates with the ssh agent, private key files and passwords, in that
+// order, and verifies host keys against known_hosts unless HostKeyCallback
+// is set. Ranges are served with SFTP read-at offsets, and every call opens
+// its own SSH connection so segments are transferred in parallel.
+type SFTPClient struct {
+	// KeyFiles defaults to the usual keys in ~/.ssh.
+	KeyFiles      []string
+	KeyPassphrase string
+	// Password is used when the url carries none.
+	Password     string
+	DisableAgent bool
+	// KnownHostsFile defaults to ~/.ssh/known_hosts.
+	KnownHostsFile  string
+	HostKeyCallback ssh.HostKeyCallback
+	Timeout         time.Duration
+}
+
+func (c *SFTPClient) ResumeGet(url string, existingFileSize int64) (resp *Response, err error) {
+	return c.read(url, existingFileSize, -1)
+}
+
+func (c *SFTPClient) Head(url string) (resp *Response, err error) {
+	session, path, err := c.open(url)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	info, err := session.sftp.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Body: ioutil.NopCloser(bytes.NewReader(nil)), ContentLength: info.Size(), LastModified: info.ModTime()}, nil
+}
+
+func (c *SFTPClient) Get(url string, rangeHeader string) (resp *Response, err error) {
+	from, to, err := parseByteRange(rangeHeader)
+	if err != nil {
+		return nil, err
+	}
+	return c.read(url, from, to)
+}
+
+func (c *SFTPClient) read(url string, from int64, to int64) (*Response, error) {
+	session, path, err := c.open(url)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := session.sftp.Open(path)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		session.Close()
+		return nil, err
+	}
+	if to < 0 || to >= info.Size() {
+		to = info.Size() - 1
+	}
+
+	session.file = file
+	length := to - from + 1
+	if length < 0 {
+		length = 0
+	}
+	return &Response{Body: &sftpBody{Reader: io.NewSectionReader(file, from, length), session: session}, ContentLength: length}, nil
+}
+
+type sftpSession struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+	file *sftp.File
+}
+
+func (s *sftpSession) Close() error {
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.sftp.Close()
+	return s.ssh.Close()
+}
+
+type sftpBody struct {
+	io.Reader
+	session *sftpSession
+}
+
+func (b *sftpBody) Close() error {
+	return b.session.Close()
+}
+
+func (c *SFTPClient) open(rawURL string) (*sftpSession, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	config, agentConn, err := c.clientConfig(u)
+	if err != nil {
+		return nil, "", err
+	}
+	if agentConn != nil {
+		defer agentConn.Close()
+	}
+
+	port := "22"
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	sshClient, err := ssh.Dial("tcp", net.JoinHostPort(u.Hostname(), port), config)
+	if err != nil {
+		return nil, "", err
+	}
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, "", err
+	}
+
+	// sftp://host/~/file is relative to the home directory of the user
+	path := u.Path
+	if strings.HasPrefix(path, "/~/") {
+		path = path[len("/~/"):]
+	}
+	return &sftpSession{ssh: sshClient, sftp: sftpClient}, path, nil
+}
+
+// clientConfig returns the connection to the ssh agent alongside the config,
+// it has to stay open until the handshake is done.
+func (c *SFTPClient) clientConfig(u *url.URL) (*ssh.ClientConfig, net.Conn, error) {
+	hostKeyCallback, err := c.hostKeyCallback()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user := os.Getenv("USER")
+	if u.User != nil && u.User.Username() != "" {
+		user = u.User.Username()
+	}
+
+	var auth []ssh.AuthMethod
+	var signers []ssh.Signer
+	var agentConn net.Conn
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" && !c.DisableAgent {
+		if agentConn, err = net.Dial("unix", socket); err == nil {
+			if agentSigners, err := agent.NewClient(agentConn).Signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+	keySigners, err := c.keySigners()
+	if err != nil {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+		return nil, nil, err
+	}
+	signers = append(signers, keySigners...)
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	password := c.Password
+	if u.User != nil {
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultSSHTimeout
+	}
+	return &ssh.ClientConfig{User: user, Auth: auth, HostKeyCallback: hostKeyCallback, Timeout: timeout}, agentConn, nil
+}
+
+func (c *SFTPClient) keySigners() ([]ssh.Signer, error) {
+	keyFiles := c.KeyFiles
+	explicit := len(keyFiles) > 0
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		for _, name := range defaultSSHKeyFiles {
+			keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, keyFile := range keyFiles {
+		pemBytes, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			if explicit {
+				return nil, err
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(pemBytes)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) && c.KeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(c.KeyPassphrase))
+		}
+		if err != nil {
+			if explicit {
+				return nil, fmt.Errorf("unable to load ssh key %s: %v", keyFile, err)
+			}
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+func (c *SFTPClient) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if c.HostKeyCallback != nil {
+		return c.HostKeyCallback, nil
+	}
+	knownHostsFile := c.KnownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load known hosts: %v", err)
+	}
+	return callback, nil
+}
@@ -0,0 +1,239 @@
+package lib_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshTestServer serves the local filesystem over the sftp subsystem and
+// accepts either the given password or the given public key.
+type sshTestServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.Signer
+	logins   int32
+}
+
+func newSSHTestServer(t *testing.T, password string, authorizedKey ssh.PublicKey) *sshTestServer {
+	s := &sshTestServer{hostKey: newTestSigner(t)}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, given []byte) (*ssh.Permissions, error) {
+			if password != "" && string(given) == password {
+				atomic.AddInt32(&s.logins, 1)
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", conn.User())
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if authorizedKey != nil && bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				atomic.AddInt32(&s.logins, 1)
+				return nil, nil
+			}
+			return nil, fmt.Errorf("public key rejected for %s", conn.User())
+		},
+	}
+	s.config.AddHostKey(s.hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s.listener = listener
+	go s.serve()
+	return s
+}
+
+func (s *sshTestServer) Close() {
+	s.listener.Close()
+}
+
+func (s *sshTestServer) URL(userinfo string, path string) string {
+	return fmt.Sprintf("sftp://%s@%s%s", userinfo, s.listener.Addr().String(), path)
+}
+
+func (s *sshTestServer) knownHosts(t *testing.T, dir string, key ssh.PublicKey) string {
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.listener.Addr().String())}, key)
+	assert.NoError(t, ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+	return knownHostsFile
+}
+
+func (s *sshTestServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *sshTestServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range channelRequests {
+				isSFTP := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(isSFTP, nil)
+				if isSFTP {
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						channel.Close()
+						return
+					}
+					go func() {
+						server.Serve()
+						server.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+	return signer
+}
+
+func writeTestFile(t *testing.T, dir string, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(path, content, 0644))
+	return path
+}
+
+func TestSFTPClientHeadWithPasswordAndKnownHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	content := testContent(5000)
+	remotePath := writeTestFile(t, dir, "build.tar", content)
+	server := newSSHTestServer(t, "secret", nil)
+	defer server.Close()
+	client := lib.SFTPClient{DisableAgent: true, KnownHostsFile: server.knownHosts(t, dir, server.hostKey.PublicKey())}
+
+	resp, err := client.Head(server.URL("builder:secret", remotePath))
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), resp.ContentLength)
+}
+
+func TestSFTPClientRejectsUnknownHostKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remotePath := writeTestFile(t, dir, "build.tar", testContent(10))
+	server := newSSHTestServer(t, "secret", nil)
+	defer server.Close()
+	otherKey := newTestSigner(t).PublicKey()
+	client := lib.SFTPClient{DisableAgent: true, KnownHostsFile: server.knownHosts(t, dir, otherKey)}
+
+	_, err = client.Head(server.URL("builder:secret", remotePath))
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "key mismatch")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&server.logins))
+}
+
+func TestSFTPClientGetReadsRangeWithKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	content := testContent(5000)
+	remotePath := writeTestFile(t, dir, "build.tar", content)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	assert.NoError(t, err)
+	keyFile := writeTestFile(t, dir, "id_ed25519", pem.EncodeToMemory(block))
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+	server := newSSHTestServer(t, "", signer.PublicKey())
+	defer server.Close()
+	client := lib.SFTPClient{DisableAgent: true, KeyFiles: []string{keyFile}, HostKeyCallback: ssh.FixedHostKey(server.hostKey.PublicKey())}
+
+	resp, err := client.Get(server.URL("builder", remotePath), "1000-1999")
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), resp.ContentLength)
+	assert.Equal(t, content[1000:2000], data)
+}
+
+func TestDownloadFileConcurrentOverSFTPWithAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	content := testContent(256 * 1024)
+	remotePath := writeTestFile(t, dir, "build.tar", content)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	keyring := agent.NewKeyring()
+	assert.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: key}))
+	socket := filepath.Join(dir, "agent.sock")
+	agentListener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	defer agentListener.Close()
+	go func() {
+		for {
+			conn, err := agentListener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+	server := newSSHTestServer(t, "", signer.PublicKey())
+	defer server.Close()
+	client := &lib.SFTPClient{KeyFiles: []string{}, KnownHostsFile: server.knownHosts(t, dir, server.hostKey.PublicKey())}
+	protocolClient := lib.NewProtocolClient()
+	protocolClient.Register("sftp", client)
+	destination := filepath.Join(dir, "out")
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: protocolClient}
+
+	err = downloader.DownloadFileConcurrent(destination, server.URL("builder", remotePath), 4)
+
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(destination, "build.tar"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&server.logins))
+}
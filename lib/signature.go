@@ -0,0 +1,305 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp"
+)
+
+// maxSignatureSize bounds the companion signature files that are fetched.
+const maxSignatureSize = 64 * 1024
+
+// SignatureVerifier checks a detached signature of a downloaded file.
+type SignatureVerifier interface {
+	// SignatureSuffixes are appended to the url of a file to find its
+	// signature, in the order they are tried.
+	SignatureSuffixes() []string
+	Verify(content io.Reader, signature []byte) (*Signer, error)
+}
+
+// Signer is the key that made a valid signature. Identity is the user id of
+// a PGP key or the trusted comment of a minisign signature.
+type Signer struct {
+	KeyID    string `json:"keyId"`
+	Identity string `json:"identity,omitempty"`
+}
+
+// SignatureError is returned when a file has no valid signature, the file
+// is then not kept.
+type SignatureError struct {
+	URL    string
+	Reason string
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("signature verification failed for %s: %s", e.URL, e.Reason)
+}
+
+// PGPVerifier checks OpenPGP signatures, armored or binary, against a
+// keyring.
+type PGPVerifier struct {
+	keyring openpgp.EntityList
+}
+
+// NewPGPVerifier reads an armored or binary keyring of public keys.
+func NewPGPVerifier(keyring io.Reader) (*PGPVerifier, error) {
+	data, err := ioutil.ReadAll(keyring)
+	if err != nil {
+		return nil, err
+	}
+	var entities openpgp.EntityList
+	if armored(data) {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyring: %v", err)
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("invalid keyring: no keys")
+	}
+	return &PGPVerifier{keyring: entities}, nil
+}
+
+func (v *PGPVerifier) SignatureSuffixes() []string {
+	return []string{".asc", ".sig"}
+}
+
+func (v *PGPVerifier) Verify(content io.Reader, signature []byte) (*Signer, error) {
+	var entity *openpgp.Entity
+	var err error
+	if armored(signature) {
+		entity, err = openpgp.CheckArmoredDetachedSignature(v.keyring, content, bytes.NewReader(signature))
+	} else {
+		entity, err = openpgp.CheckDetachedSignature(v.keyring, content, bytes.NewReader(signature))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{KeyID: entity.PrimaryKey.KeyIdString(), Identity: primaryIdentity(entity)}, nil
+}
+
+func armored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP"))
+}
+
+// primaryIdentity is the user id marked as primary, or the first one by
+// name.
+func primaryIdentity(entity *openpgp.Entity) string {
+	var names []string
+	for name, identity := range entity.Identities {
+		if identity.SelfSignature != nil && identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			return name
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return names[0]
+}
+
+// MinisignKey is a minisign public key.
+type MinisignKey struct {
+	ID        [8]byte
+	PublicKey ed25519.PublicKey
+}
+
+// ParseMinisignKey reads a public key as printed by minisign, either the
+// base64 line alone or the whole key file.
+func ParseMinisignKey(text string) (*MinisignKey, error) {
+	var encoded string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "untrusted comment:") {
+			encoded = line
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) != 2+8+ed25519.PublicKeySize || string(data[:2]) != "Ed" {
+		return nil, fmt.Errorf("invalid minisign public key")
+	}
+	key := &MinisignKey{PublicKey: ed25519.PublicKey(data[10:])}
+	copy(key.ID[:], data[2:10])
+	return key, nil
+}
+
+// MinisignVerifier checks minisign signatures, prehashed or legacy, made by
+// one of Keys.
+type MinisignVerifier struct {
+	Keys []*MinisignKey
+}
+
+func (v *MinisignVerifier) SignatureSuffixes() []string {
+	return []string{".minisig"}
+}
+
+func (v *MinisignVerifier) Verify(content io.Reader, signature []byte) (*Signer, error) {
+	sig, err := parseMinisignSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+	var key *MinisignKey
+	for _, candidate := range v.Keys {
+		if candidate.ID == sig.keyID {
+			key = candidate
+		}
+	}
+	keyID := fmt.Sprintf("%016X", binary.LittleEndian.Uint64(sig.keyID[:]))
+	if key == nil {
+		return nil, fmt.Errorf("signed by unknown key %s", keyID)
+	}
+
+	var message []byte
+	if sig.prehashed {
+		hash, _ := blake2b.New512(nil)
+		if _, err = io.Copy(hash, content); err != nil {
+			return nil, err
+		}
+		message = hash.Sum(nil)
+	} else if message, err = ioutil.ReadAll(content); err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key.PublicKey, message, sig.signature) {
+		return nil, errors.New("invalid signature")
+	}
+	if !ed25519.Verify(key.PublicKey, append(sig.signature, sig.trustedComment...), sig.globalSignature) {
+		return nil, errors.New("invalid signature of the trusted comment")
+	}
+	return &Signer{KeyID: keyID, Identity: sig.trustedComment}, nil
+}
+
+type minisignSignature struct {
+	prehashed       bool
+	keyID           [8]byte
+	signature       []byte
+	trustedComment  string
+	globalSignature []byte
+}
+
+// parseMinisignSignature reads the four lines of a .minisig file: an
+// untrusted comment, the signature, the trusted comment and the signature
+// of the signature and the trusted comment.
+func parseMinisignSignature(data []byte) (*minisignSignature, error) {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[0], "untrusted comment:") || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return nil, errors.New("invalid minisign signature")
+	}
+	encoded, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(encoded) != 2+8+ed25519.SignatureSize {
+		return nil, errors.New("invalid minisign signature")
+	}
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return nil, errors.New("invalid minisign signature")
+	}
+	sig := &minisignSignature{signature: encoded[10:], trustedComment: strings.TrimPrefix(lines[2], "trusted comment: "), globalSignature: global}
+	switch string(encoded[:2]) {
+	case "ED":
+		sig.prehashed = true
+	case "Ed":
+	default:
+		return nil, fmt.Errorf("unsupported minisign algorithm %q", encoded[:2])
+	}
+	copy(sig.keyID[:], encoded[2:10])
+	return sig, nil
+}
+
+// signatureCheck verifies a part with the Verifier of a Downloader. Without
+// a signature the one next to url is fetched. signer is set once the part is
+// verified.
+type signatureCheck struct {
+	d         *Downloader
+	url       string
+	signature []byte
+	signer    *Signer
+}
+
+// signatureCheck is nil when the Downloader has no Verifier.
+func (d *Downloader) signatureCheck(url string, signature []byte) (*signatureCheck, error) {
+	if d.Verifier == nil {
+		if signature != nil {
+			return nil, fmt.Errorf("unable to verify the signature of %s: no verifier", url)
+		}
+		return nil, nil
+	}
+	return &signatureCheck{d: d, url: url, signature: signature}, nil
+}
+
+// verifiedSigner is the signer of the verified part, nil without a check.
+func (c *signatureCheck) verifiedSigner() *Signer {
+	if c == nil {
+		return nil
+	}
+	return c.signer
+}
+
+func (c *signatureCheck) partCheck() partCheck {
+	if c == nil {
+		return nil
+	}
+	return c.check
+}
+
+func (c *signatureCheck) check(filePath string) error {
+	if c.signature == nil {
+		signature, err := c.fetch()
+		if err != nil {
+			return err
+		}
+		c.signature = signature
+	}
+	file, err := c.d.fs().Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	signer, err := c.d.Verifier.Verify(file, c.signature)
+	if err != nil {
+		return &SignatureError{URL: c.url, Reason: err.Error()}
+	}
+	c.signer = signer
+	return nil
+}
+
+// fetch downloads the first signature found at url with one of the
+// suffixes of the Verifier.
+func (c *signatureCheck) fetch() ([]byte, error) {
+	suffixes := c.d.Verifier.SignatureSuffixes()
+	for _, suffix := range suffixes {
+		resp, err := c.d.Client.ResumeGet(c.url+suffix, 0)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		signature, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSignatureSize+1))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(signature) > maxSignatureSize {
+			return nil, &SignatureError{URL: c.url, Reason: fmt.Sprintf("%s%s is too large", c.url, suffix)}
+		}
+		return signature, nil
+	}
+	return nil, &SignatureError{URL: c.url, Reason: fmt.Sprintf("no signature found at %s{%s}", c.url, strings.Join(suffixes, ","))}
+}
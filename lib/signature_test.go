@@ -0,0 +1,210 @@
+package lib_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func newFileServer(files map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func newPGPKey(t *testing.T, name string) (*openpgp.Entity, []byte) {
+	entity, err := openpgp.NewEntity(name, "", strings.ToLower(name)+"@example.com", nil)
+	assert.NoError(t, err)
+	var keyring bytes.Buffer
+	out, err := armor.Encode(&keyring, openpgp.PublicKeyType, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, entity.Serialize(out))
+	assert.NoError(t, out.Close())
+	return entity, keyring.Bytes()
+}
+
+func pgpSign(t *testing.T, entity *openpgp.Entity, content []byte) []byte {
+	var signature bytes.Buffer
+	assert.NoError(t, openpgp.ArmoredDetachSign(&signature, entity, bytes.NewReader(content), nil))
+	return signature.Bytes()
+}
+
+type minisignKey struct {
+	id      []byte
+	private ed25519.PrivateKey
+}
+
+// newMinisignKey returns a throwaway key and its public key as minisign
+// prints it.
+func newMinisignKey(t *testing.T) (*minisignKey, string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key := &minisignKey{id: []byte{1, 2, 3, 4, 5, 6, 7, 8}, private: private}
+	encoded := append(append([]byte("Ed"), key.id...), public...)
+	return key, "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(encoded) + "\n"
+}
+
+func (k *minisignKey) sign(content []byte, prehashed bool, trustedComment string) []byte {
+	algorithm, message := "Ed", content
+	if prehashed {
+		sum := blake2b.Sum512(content)
+		algorithm, message = "ED", sum[:]
+	}
+	signature := ed25519.Sign(k.private, message)
+	global := ed25519.Sign(k.private, append(append([]byte{}, signature...), trustedComment...))
+	return []byte("untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte(algorithm), k.id...), signature...)) + "\n" +
+		"trusted comment: " + trustedComment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+func TestDownloadVerifiesCompanionPGPSignature(t *testing.T) {
+	content := testContent(20000)
+	entity, keyring := newPGPKey(t, "Release")
+	server := newFileServer(map[string][]byte{"/tool.bin": content, "/tool.bin.asc": pgpSign(t, entity, content)})
+	defer server.Close()
+	verifier, err := lib.NewPGPVerifier(bytes.NewReader(keyring))
+	assert.NoError(t, err)
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}, Verifier: verifier}
+
+	result, err := downloader.DownloadFileWithResult("dl", server.URL+"/tool.bin", 4)
+	assert.NoError(t, err)
+	assert.Equal(t, &lib.Signer{KeyID: entity.PrimaryKey.KeyIdString(), Identity: "Release <release@example.com>"}, result.Signer)
+	data, err := fs.ReadFile("dl/tool.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestDownloadRejectsSignatureOfAnotherKey(t *testing.T) {
+	content := testContent(20000)
+	_, keyring := newPGPKey(t, "Release")
+	other, _ := newPGPKey(t, "Mallory")
+	server := newFileServer(map[string][]byte{"/tool.bin": content, "/tool.bin.sig": pgpSign(t, other, content)})
+	defer server.Close()
+	verifier, err := lib.NewPGPVerifier(bytes.NewReader(keyring))
+	assert.NoError(t, err)
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}, Verifier: verifier}
+
+	_, err = downloader.DownloadFileWithResult("dl", server.URL+"/tool.bin", 4)
+	var signatureErr *lib.SignatureError
+	assert.True(t, errors.As(err, &signatureErr))
+	assert.Equal(t, server.URL+"/tool.bin", signatureErr.URL)
+	assert.Empty(t, fs.Files())
+}
+
+func TestDownloadVerifiesMinisignSignatures(t *testing.T) {
+	content := testContent(5000)
+	key, publicKey := newMinisignKey(t)
+	parsed, err := lib.ParseMinisignKey(publicKey)
+	assert.NoError(t, err)
+	server := newFileServer(map[string][]byte{
+		"/app.tar":         content,
+		"/app.tar.minisig": key.sign(content, true, "timestamp:1700000000\tfile:app.tar"),
+		"/legacy.bin":      content,
+	})
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}, Verifier: &lib.MinisignVerifier{Keys: []*lib.MinisignKey{parsed}}}
+
+	assert.NoError(t, downloader.DownloadFile("dl", server.URL+"/app.tar"))
+	result, err := downloader.DownloadFileWithSignature("dl", server.URL+"/legacy.bin", key.sign(content, false, "legacy"), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, &lib.Signer{KeyID: "0807060504030201", Identity: "legacy"}, result.Signer)
+	assert.Equal(t, []string{"dl/app.tar", "dl/legacy.bin"}, fs.Files())
+
+	tampered := key.sign(content, true, "timestamp:1700000000")
+	tampered = bytes.Replace(tampered, []byte("timestamp:1700000000"), []byte("timestamp:1800000000"), 1)
+	_, err = downloader.DownloadFileWithSignature("other", server.URL+"/app.tar", tampered, 2)
+	var signatureErr *lib.SignatureError
+	assert.True(t, errors.As(err, &signatureErr))
+	assert.Equal(t, "invalid signature of the trusted comment", signatureErr.Reason)
+	assert.Equal(t, []string{"dl/app.tar", "dl/legacy.bin"}, fs.Files())
+}
+
+func TestDownloadFailsWithoutSignature(t *testing.T) {
+	content := testContent(100)
+	_, publicKey := newMinisignKey(t)
+	parsed, err := lib.ParseMinisignKey(publicKey)
+	assert.NoError(t, err)
+	server := newFileServer(map[string][]byte{"/file.bin": content})
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}, Verifier: &lib.MinisignVerifier{Keys: []*lib.MinisignKey{parsed}}}
+
+	err = downloader.DownloadFile("dl", server.URL+"/file.bin")
+	assert.EqualError(t, err, "signature verification failed for "+server.URL+"/file.bin: no signature found at "+server.URL+"/file.bin{.minisig}")
+	assert.Empty(t, fs.Files())
+}
+
+func TestExtractDecompressAndStreamVerifySignatures(t *testing.T) {
+	key, publicKey := newMinisignKey(t)
+	parsed, err := lib.ParseMinisignKey(publicKey)
+	assert.NoError(t, err)
+	archive := buildTar(t, "tar.gz", []archiveEntry{{name: "app/README", body: "hello"}})
+	compressed := compress(t, "gzip", []byte("log line\n"))
+	server := newFileServer(map[string][]byte{
+		"/app.tar.gz":          archive,
+		"/app.tar.gz.minisig":  key.sign(archive, true, "app"),
+		"/evil.tar.gz":         archive,
+		"/evil.tar.gz.minisig": key.sign([]byte("something else"), true, "evil"),
+		"/app.log.gz":          compressed,
+		"/app.log.gz.minisig":  key.sign(compressed, true, "log"),
+		"/evil.log.gz":         compressed,
+	})
+	defer server.Close()
+	fs := &lib.MemFS{}
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: fs}, Verifier: &lib.MinisignVerifier{Keys: []*lib.MinisignKey{parsed}}}
+
+	assert.NoError(t, downloader.DownloadAndExtract("app", server.URL+"/app.tar.gz", 2, lib.ExtractOptions{}))
+	var signatureErr *lib.SignatureError
+	assert.True(t, errors.As(downloader.DownloadAndExtract("evil", server.URL+"/evil.tar.gz", 2, lib.ExtractOptions{}), &signatureErr))
+	assert.NoError(t, downloader.DownloadDecompressed("logs", server.URL+"/app.log.gz", 2))
+	assert.True(t, errors.As(downloader.DownloadDecompressed("logs", server.URL+"/evil.log.gz", 2), &signatureErr))
+	assert.Equal(t, []string{"app/app/README", "logs/app.log"}, fs.Files())
+
+	var output bytes.Buffer
+	err = downloader.DownloadToWriter(&output, server.URL+"/app.log.gz", 2, lib.StreamOptions{})
+	assert.EqualError(t, err, "unable to verify the signature of "+server.URL+"/app.log.gz while streaming it")
+	assert.Empty(t, output.Bytes())
+}
+
+func TestJobQueueKeepsSigner(t *testing.T) {
+	content := testContent(4096)
+	key, publicKey := newMinisignKey(t)
+	parsed, err := lib.ParseMinisignKey(publicKey)
+	assert.NoError(t, err)
+	server := newFileServer(map[string][]byte{"/file.bin": content, "/file.bin.minisig": key.sign(content, true, "release 1.0")})
+	defer server.Close()
+	downloader := lib.Downloader{Client: lib.NewProtocolClient(), FileUtils: &lib.File{FS: &lib.MemFS{}}, Verifier: &lib.MinisignVerifier{Keys: []*lib.MinisignKey{parsed}}}
+	queue, err := lib.NewJobQueue(downloader, lib.QueueOptions{Dir: "jobs"})
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	job, err := queue.Add(server.URL+"/file.bin", lib.JobOptions{})
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return jobStatus(queue, job.ID) == lib.JobComplete })
+	job, err = queue.Status(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, &lib.Signer{KeyID: "0807060504030201", Identity: "release 1.0"}, job.Signer)
+}
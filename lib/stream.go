@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const defaultStreamChunkSize = 1 << 20
+
+var errRangeIgnored = errors.New("server ignored the requested range")
+
+// StreamOptions tune DownloadToWriter. At most BufferedChunks chunks of
+// ChunkSize bytes are held in memory while waiting for an earlier chunk,
+// zero values default to 1MiB and twice the concurrency.
+type StreamOptions struct {
+	ChunkSize      int64
+	BufferedChunks int
+}
+
+type streamChunk struct {
+	data []byte
+	err  error
+}
+
+// DownloadToWriter writes the file at url to w without touching the disk.
+// With a concurrency above one and a known length, chunks are fetched in
+// parallel and written in order. Servers that don't support ranges are read
+// in one go. It fails with a Verifier, w would get the file before its
+// signature is checked.
+func (d *Downloader) DownloadToWriter(w io.Writer, url string, concurrency int64, options StreamOptions) error {
+	if url == "" {
+		return fmt.Errorf("url cannot be empty")
+	}
+	if d.Verifier != nil {
+		return fmt.Errorf("unable to verify the signature of %s while streaming it", url)
+	}
+	headResp, err := d.Client.Head(url)
+	if err != nil {
+		return err
+	}
+	if concurrency > 1 && headResp.ContentLength > 0 {
+		version := Validators{ETag: headResp.ETag, LastModified: headResp.LastModified}
+		err = d.streamChunks(w, url, headResp.ContentLength, version, concurrency, options)
+		if err != errRangeIgnored {
+			return err
+		}
+	}
+	response, err := d.Client.ResumeGet(url, 0)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+// streamChunks fetches chunks of the version of the file with concurrency
+// workers and writes them in order. It returns errRangeIgnored before
+// writing anything if the server answers the first chunk with the whole
+// file.
+func (d *Downloader) streamChunks(w io.Writer, url string, contentLength int64, version Validators, concurrency int64, options StreamOptions) error {
+	chunkSize := options.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultStreamChunkSize
+	}
+	buffered := options.BufferedChunks
+	if buffered <= 0 {
+		buffered = 2 * int(concurrency)
+	}
+	var ranges [][2]int64
+	for from := int64(0); from < contentLength; from += chunkSize {
+		to := from + chunkSize - 1
+		if to >= contentLength {
+			to = contentLength - 1
+		}
+		ranges = append(ranges, [2]int64{from, to})
+	}
+
+	results := make([]chan streamChunk, len(ranges))
+	for index := range results {
+		results[index] = make(chan streamChunk, 1)
+	}
+	// a token is taken for every chunk before it is fetched and given back
+	// once it is written, which caps the chunks in memory
+	tokens := make(chan struct{}, buffered)
+	indexes := make(chan int)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(done)
+
+	go func() {
+		defer close(indexes)
+		for index := range ranges {
+			select {
+			case tokens <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case indexes <- index:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for i := int64(0); i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				data, err := d.fetchChunk(url, ranges[index][0], ranges[index][1], version)
+				results[index] <- streamChunk{data: data, err: err}
+			}
+		}()
+	}
+
+	for index := range ranges {
+		chunk := <-results[index]
+		if chunk.err == errRangeIgnored && index > 0 {
+			return fmt.Errorf("unable to read range %d-%d of %s: %v", ranges[index][0], ranges[index][1], url, chunk.err)
+		}
+		if chunk.err != nil {
+			return chunk.err
+		}
+		if _, err := w.Write(chunk.data); err != nil {
+			return err
+		}
+		<-tokens
+	}
+	return nil
+}
+
+// fetchChunk reads the range from-to of url. It fails when the response
+// doesn't carry the validators of version, the chunk would come from
+// another version of the file.
+func (d *Downloader) fetchChunk(url string, from int64, to int64, version Validators) ([]byte, error) {
+	response, err := d.Client.Get(url, fmt.Sprintf("%d-%d", from, to))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.ContentLength >= 0 && response.ContentLength != to-from+1 {
+		return nil, errRangeIgnored
+	}
+	if (version.ETag != "" && response.ETag != version.ETag) ||
+		(!version.LastModified.IsZero() && !response.LastModified.Equal(version.LastModified)) {
+		return nil, fmt.Errorf("%s changed while it was downloaded", url)
+	}
+	data := make([]byte, to-from+1)
+	if _, err = io.ReadFull(response.Body, data); err != nil {
+		return nil, fmt.Errorf("unable to read range %d-%d of %s: %v", from, to, url, err)
+	}
+	return data, nil
+}
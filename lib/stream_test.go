@@ -0,0 +1,127 @@
+package lib_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowWriter counts what was written and takes its time doing so.
+type slowWriter struct {
+	bytes.Buffer
+	written int64
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(2 * time.Millisecond)
+	atomic.AddInt64(&w.written, int64(len(p)))
+	return w.Buffer.Write(p)
+}
+
+func TestDownloadToWriterEmitsChunksInOrder(t *testing.T) {
+	content := testContent(256 * 1024)
+	chunkSize, buffered := int64(8*1024), 4
+	output := &slowWriter{}
+	var maxAhead int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var from int64
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &from)
+		if ahead := from - atomic.LoadInt64(&output.written); ahead > atomic.LoadInt64(&maxAhead) {
+			atomic.StoreInt64(&maxAhead, ahead)
+		}
+		time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	downloader := lib.Downloader{Client: lib.NewProtocolClient()}
+
+	err := downloader.DownloadToWriter(output, server.URL+"/stream.bin", 4, lib.StreamOptions{ChunkSize: chunkSize, BufferedChunks: buffered})
+
+	assert.NoError(t, err)
+	assert.Equal(t, content, output.Bytes())
+	assert.True(t, maxAhead < int64(buffered)*chunkSize, "fetched %d bytes ahead", maxAhead)
+}
+
+func TestDownloadToWriterStreamsWithoutConcurrency(t *testing.T) {
+	content := testContent(10 * 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	downloader := lib.Downloader{Client: lib.NewProtocolClient()}
+	var output bytes.Buffer
+
+	err := downloader.DownloadToWriter(&output, server.URL+"/stream.bin", 1, lib.StreamOptions{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, content, output.Bytes())
+}
+
+func TestDownloadToWriterStopsAtFailedChunk(t *testing.T) {
+	content := testContent(64 * 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Range"), "bytes=16384-") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	downloader := lib.Downloader{Client: lib.NewProtocolClient()}
+	var output bytes.Buffer
+
+	err := downloader.DownloadToWriter(&output, server.URL+"/stream.bin", 3, lib.StreamOptions{ChunkSize: 4096})
+
+	assert.Error(t, err)
+	assert.Equal(t, content[:16384], output.Bytes())
+}
+
+func TestDownloadToWriterFallsBackWhenRangesAreIgnored(t *testing.T) {
+	content := testContent(20 * 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content)
+	}))
+	defer server.Close()
+	downloader := lib.Downloader{Client: lib.NewProtocolClient()}
+	var output bytes.Buffer
+
+	err := downloader.DownloadToWriter(&output, server.URL+"/stream.bin", 4, lib.StreamOptions{ChunkSize: 4096})
+
+	assert.NoError(t, err)
+	assert.Equal(t, content, output.Bytes())
+}
+
+func TestDownloadToWriterStopsWhenTheFileChanges(t *testing.T) {
+	content := testContent(64 * 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"v1"`
+		var from int64
+		if fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &from); from >= 32768 {
+			etag = `"v2"`
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	downloader := lib.Downloader{Client: lib.NewProtocolClient()}
+	var output bytes.Buffer
+
+	err := downloader.DownloadToWriter(&output, server.URL+"/stream.bin", 2, lib.StreamOptions{ChunkSize: 16384})
+
+	assert.EqualError(t, err, server.URL+"/stream.bin changed while it was downloaded")
+	assert.Equal(t, content[:32768], output.Bytes())
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type SyncStatus string
+
+const (
+	SyncNew       SyncStatus = "new"
+	SyncUpdated   SyncStatus = "updated"
+	SyncUnchanged SyncStatus = "unchanged"
+)
+
+// syncState is stored next to every synced file in .<name>.sync and holds
+// the validators of the version on disk.
+type syncState struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified"`
+	Size         int64     `json:"size"`
+}
+
+// SyncFile downloads url into dirPath unless the copy there is still
+// current. The validators saved by the previous sync are sent with the Head
+// request, a file that is reported unchanged is not downloaded again. An
+// updated file replaces the old copy only once it is complete and its
+// signature is verified, and takes its mtime from Last-Modified. Hooks are
+// refused, they could move the file away from where the next sync looks.
+func (d *Downloader) SyncFile(dirPath string, url string, concurrency int64) (SyncStatus, error) {
+	if len(d.Hooks) > 0 {
+		return "", fmt.Errorf("unable to sync %s: hooks can't run on synced files", url)
+	}
+	fileName, err := d.FileUtils.GetFileNameFromURL(url)
+	if err != nil {
+		return "", err
+	}
+	check, err := d.signatureCheck(url, nil)
+	if err != nil {
+		return "", err
+	}
+	filePath := fmt.Sprintf("%s/%s", dirPath, fileName)
+	statePath := fmt.Sprintf("%s/.%s.sync", dirPath, fileName)
+
+	status := SyncNew
+	var headResp *Response
+	if d.FileUtils.FileExists(filePath) {
+		status = SyncUpdated
+		state, err := readSyncState(d.fs(), statePath)
+		info, statErr := d.fs().Stat(filePath)
+		if err == nil && statErr == nil && state.URL == url && info.Size() == state.Size {
+			headResp, err = headIfChanged(d.Client, url, Validators{ETag: state.ETag, LastModified: state.LastModified})
+			if err != nil {
+				return "", err
+			}
+			if headResp.NotModified {
+				return SyncUnchanged, nil
+			}
+		}
+	}
+	if headResp == nil {
+		if headResp, err = d.Client.Head(url); err != nil {
+			return "", err
+		}
+	}
+
+	// the current file stays in place until the new one is complete
+	download := func() error {
+		return d.downloadParts(dirPath, fileName, url, concurrency, headResp, check.partCheck())
+	}
+	if d.Cache != nil {
+		err = d.downloadCached(dirPath, fileName, url, headResp, "", download, check.partCheck())
+	} else {
+		err = download()
+	}
+	if err != nil {
+		return "", err
+	}
+	if !headResp.LastModified.IsZero() {
+		if err = d.fs().Chtimes(filePath, time.Now(), headResp.LastModified); err != nil {
+			return "", err
+		}
+	}
+
+	state := syncState{URL: url, ETag: headResp.ETag, LastModified: headResp.LastModified, Size: headResp.ContentLength}
+	if err = writeSyncState(d.fs(), statePath, state); err != nil {
+		return "", err
+	}
+	return status, nil
+}
+
+func readSyncState(fs FS, statePath string) (*syncState, error) {
+	data, err := readFile(fs, statePath)
+	if err != nil {
+		return nil, err
+	}
+	var state syncState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func writeSyncState(fs FS, statePath string, state syncState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFile(fs, statePath, data)
+}
@@ -0,0 +1,171 @@
+package lib_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+// versionedTestServer serves a single file whose content, ETag and
+// Last-Modified change with every publish.
+type versionedTestServer struct {
+	*httptest.Server
+	content      atomic.Value
+	version      int32
+	modified     time.Time
+	sendETag     bool
+	ignoreCaches bool
+	gets         int32
+}
+
+func newVersionedTestServer(sendETag bool) *versionedTestServer {
+	s := &versionedTestServer{sendETag: sendETag}
+	s.publish(testContent(5000))
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&s.gets, 1)
+		}
+		if s.sendETag {
+			w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, atomic.LoadInt32(&s.version)))
+		}
+		if s.ignoreCaches {
+			r.Header.Del("If-None-Match")
+			r.Header.Del("If-Modified-Since")
+		}
+		http.ServeContent(w, r, "", s.modified, bytes.NewReader(s.content.Load().([]byte)))
+	}))
+	return s
+}
+
+func (s *versionedTestServer) publish(content []byte) {
+	s.content.Store(content)
+	version := atomic.AddInt32(&s.version, 1)
+	s.modified = time.Date(2020, 1, int(version), 12, 0, 0, 0, time.UTC)
+}
+
+// plainClient hides the conditional Head of the wrapped client.
+type plainClient struct {
+	client lib.Client
+}
+
+func (c plainClient) ResumeGet(url string, existingFileSize int64) (*lib.Response, error) {
+	return c.client.ResumeGet(url, existingFileSize)
+}
+
+func (c plainClient) Head(url string) (*lib.Response, error) {
+	return c.client.Head(url)
+}
+
+func (c plainClient) Get(url string, rangeHeader string) (*lib.Response, error) {
+	return c.client.Get(url, rangeHeader)
+}
+
+func TestSyncFileSkipsUnchangedAndReplacesUpdatedFiles(t *testing.T) {
+	server := newVersionedTestServer(true)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: lib.NewProtocolClient()}
+	url := server.URL + "/nightly/build.bin"
+	filePath := filepath.Join(dir, "build.bin")
+
+	status, err := downloader.SyncFile(dir, url, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, lib.SyncNew, status)
+	info, err := os.Stat(filePath)
+	assert.NoError(t, err)
+	assert.True(t, server.modified.Equal(info.ModTime()))
+	gets := atomic.LoadInt32(&server.gets)
+
+	status, err = downloader.SyncFile(dir, url, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, lib.SyncUnchanged, status)
+	assert.Equal(t, gets, atomic.LoadInt32(&server.gets))
+
+	server.publish(testContent(7000)[2000:])
+	status, err = downloader.SyncFile(dir, url, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, lib.SyncUpdated, status)
+	data, err := ioutil.ReadFile(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, server.content.Load().([]byte), data)
+	info, err = os.Stat(filePath)
+	assert.NoError(t, err)
+	assert.True(t, server.modified.Equal(info.ModTime()))
+	assert.NoFileExists(t, filePath+".part")
+}
+
+func TestSyncFileVerifiesSignaturesAndRefusesHooks(t *testing.T) {
+	server := newVersionedTestServer(true)
+	defer server.Close()
+	url := server.URL + "/nightly/build.bin"
+	fs := &lib.MemFS{}
+	verifier := &finalFileVerifier{fs: fs, path: "dl/build.bin"}
+	downloader := lib.Downloader{FileUtils: &lib.File{FS: fs}, Client: lib.NewProtocolClient(), Verifier: verifier}
+
+	_, err := downloader.SyncFile("dl", url, 2)
+	assert.EqualError(t, err, "signature verification failed for "+url+": bad signature")
+	assert.True(t, verifier.verified)
+	assert.False(t, verifier.inPlace)
+	assert.Empty(t, fs.Files())
+
+	downloader = lib.Downloader{FileUtils: &lib.File{FS: fs}, Client: lib.NewProtocolClient(), Hooks: []lib.Hook{&lib.ChmodHook{Mode: 0600}}}
+	_, err = downloader.SyncFile("dl", url, 2)
+	assert.EqualError(t, err, "unable to sync "+url+": hooks can't run on synced files")
+	assert.Empty(t, fs.Files())
+}
+
+func TestSyncFileUsesLastModifiedWithoutETag(t *testing.T) {
+	server := newVersionedTestServer(false)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: &lib.RetryClient{Client: lib.NewProtocolClient()}}
+	url := server.URL + "/build.bin"
+
+	_, err = downloader.SyncFile(dir, url, 2)
+	assert.NoError(t, err)
+	status, err := downloader.SyncFile(dir, url, 2)
+
+	assert.NoError(t, err)
+	assert.Equal(t, lib.SyncUnchanged, status)
+}
+
+func TestSyncFileComparesValidatorsWhenServerIgnoresConditionalRequests(t *testing.T) {
+	server := newVersionedTestServer(true)
+	server.ignoreCaches = true
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "godownload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	httpClient := &lib.HTTPClient{}
+	httpClient.NewHttpClient()
+	downloader := lib.Downloader{FileUtils: &lib.File{}, Client: plainClient{client: httpClient}}
+	url := server.URL + "/build.bin"
+
+	_, err = downloader.SyncFile(dir, url, 2)
+	assert.NoError(t, err)
+	status, err := downloader.SyncFile(dir, url, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, lib.SyncUnchanged, status)
+
+	assert.NoError(t, os.Truncate(filepath.Join(dir, "build.bin"), 10))
+	status, err = downloader.SyncFile(dir, url, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, lib.SyncUpdated, status)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "build.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, server.content.Load().([]byte), data)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package lib
+
+func processSyscalls() int64 {
+	return -1
+}
@@ -1,8 +1,8 @@
 package mocks
 
 import (
+	"github.com/amithnair91/godownload/lib"
 	"github.com/stretchr/testify/mock"
-	"net/http"
 )
 
 type MockFileUtils struct {
@@ -31,7 +31,7 @@ func (m *MockFileUtils) GetFileNameFromURL(url string) (fileName string, err err
 	return
 }
 
-func (m *MockFileUtils) WriteToFile(response *http.Response, filePath string) (err error) {
+func (m *MockFileUtils) WriteToFile(response *lib.Response, filePath string) (err error) {
 	args := m.Called(response, filePath)
 	if args.Get(0) != nil {
 		err = args.Get(0).(error)
@@ -62,3 +62,22 @@ func (m *MockFileUtils) FileExists(path string) (exists bool) {
 	}
 	return
 }
+
+func (m *MockFileUtils) Checksum(filePath string, algorithm string) (checksum string, err error) {
+	args := m.Called(filePath, algorithm)
+	if args.Get(0) != nil {
+		checksum = args.Get(0).(string)
+	}
+	if args.Get(1) != nil {
+		err = args.Get(1).(error)
+	}
+	return
+}
+
+func (m *MockFileUtils) CommitFile(tempPath string, filePath string) (err error) {
+	args := m.Called(tempPath, filePath)
+	if args.Get(0) != nil {
+		err = args.Get(0).(error)
+	}
+	return
+}
@@ -0,0 +1,189 @@
+package testserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amithnair91/godownload/lib"
+)
+
+// Options make a Server misbehave the way real servers do. The zero value
+// serves files correctly.
+type Options struct {
+	// IgnoreRange answers range requests with the whole file and 200.
+	IgnoreRange bool
+	// WrongContentRange answers range requests with the range a byte further
+	// on than the one asked for.
+	WrongContentRange bool
+	// ResetAfter drops the connection once this many bytes of a body are
+	// sent, for the first Resets responses or all of them when Resets is 0.
+	ResetAfter int64
+	Resets     int
+	// Rate sends bodies at this many bytes per second, zero means
+	// unlimited.
+	Rate int64
+	// TooManyRequests turns down the first requests with 429 and a
+	// Retry-After of RetryAfter seconds.
+	TooManyRequests int
+	RetryAfter      int
+	// ChangeETag sends a new ETag with every response, as if the file was
+	// replaced between requests.
+	ChangeETag bool
+	// Redirects sends every request through this many redirects first.
+	Redirects int
+	// Gzip sends files gzip encoded whatever the client accepts, ranges are
+	// of the encoded bytes.
+	Gzip bool
+	// Digest sends the sha-256 digest of every file in Repr-Digest.
+	Digest bool
+}
+
+// Request is a request the Server received.
+type Request struct {
+	Method string
+	Path   string
+	// Range is the Range header, if any.
+	Range string
+}
+
+// Server is an httptest.Server for the files added to it, behaving as its
+// Options say.
+type Server struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	options  Options
+	files    map[string][]byte
+	requests []Request
+	limited  int
+	resets   int
+	versions int
+}
+
+// New starts a Server, it is stopped with Close.
+func New(options Options) *Server {
+	s := &Server{options: options, files: map[string][]byte{}}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Add serves content at name and returns its url.
+func (s *Server) Add(name string, content []byte) string {
+	name = "/" + strings.TrimPrefix(name, "/")
+	s.mutex.Lock()
+	s.files[name] = content
+	s.mutex.Unlock()
+	return s.URL + name
+}
+
+// SetOptions changes the behaviour for the following requests.
+func (s *Server) SetOptions(options Options) {
+	s.mutex.Lock()
+	s.options = options
+	s.limited = 0
+	s.resets = 0
+	s.mutex.Unlock()
+}
+
+// Requests returns the requests received so far, redirects included.
+func (s *Server) Requests() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	options := s.options
+	s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Range: r.Header.Get("Range")})
+	content, ok := s.files[r.URL.Path]
+	limited := s.limited < options.TooManyRequests
+	if limited {
+		s.limited++
+	}
+	s.mutex.Unlock()
+
+	hop, _ := strconv.Atoi(r.URL.Query().Get("hop"))
+	if hop < options.Redirects {
+		http.Redirect(w, r, fmt.Sprintf("%s?hop=%d", r.URL.Path, hop+1), http.StatusFound)
+		return
+	}
+	if limited {
+		w.Header().Set("Retry-After", strconv.Itoa(options.RetryAfter))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	sum := sha256.Sum256(content)
+	if options.Digest {
+		w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	}
+	if options.Gzip {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		writer.Write(content)
+		writer.Close()
+		content = buf.Bytes()
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	s.mutex.Lock()
+	if options.ChangeETag {
+		s.versions++
+		w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, s.versions))
+	} else {
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum[:8]))
+	}
+	cut := int64(-1)
+	if r.Method == "GET" && options.ResetAfter > 0 && (options.Resets == 0 || s.resets < options.Resets) {
+		s.resets++
+		cut = options.ResetAfter
+	}
+	s.mutex.Unlock()
+	writer := lib.NewFaultyWriter(w, options.Rate, cut)
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if options.IgnoreRange {
+		r.Header.Del("Range")
+	}
+	if from, to, ok := parseRange(r.Header.Get("Range"), int64(len(content))); ok && options.WrongContentRange {
+		if to+1 < int64(len(content)) {
+			from, to = from+1, to+1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, to, len(content)))
+		w.Header().Set("Content-Length", strconv.FormatInt(to-from+1, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method != "HEAD" {
+			writer.Write(content[from : to+1])
+		}
+		return
+	}
+	http.ServeContent(writer, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// parseRange parses a single "bytes=from-to" range of a file of size bytes.
+func parseRange(header string, size int64) (int64, int64, bool) {
+	var from, to int64
+	if _, err := fmt.Sscanf(header, "bytes=%d-%d", &from, &to); err != nil {
+		if _, err = fmt.Sscanf(header, "bytes=%d-", &from); err != nil {
+			return 0, 0, false
+		}
+		to = size - 1
+	}
+	if to >= size {
+		to = size - 1
+	}
+	return from, to, from <= to
+}